@@ -0,0 +1,287 @@
+// Package diskcache is a persistent, content-addressed LRU cache of immutable blobs.
+//
+// Blobs are stored under the cache directory named by the SHA-256 of their key.
+// File modification times double as the LRU clock, so recency survives restarts.
+package diskcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type entry struct {
+	hash string
+	size int64
+}
+
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	mtx     sync.Mutex
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+	size    int64
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type Stats struct {
+	Entries   int
+	Bytes     int64
+	MaxBytes  int64
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+// New opens (or creates) a cache in dir holding at most maxBytes of data.
+// Any blobs left over from a previous run are picked back up.
+func New(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	type found struct {
+		entry
+		mtime time.Time
+	}
+	existing := []found{}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".tmp") {
+			// left behind by a crash mid-write
+			os.Remove(path)
+			return nil
+		}
+		if !c.isEntry(path, d.Name()) {
+			// not ours, so leave it alone and don't count it
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		existing = append(existing, found{entry{d.Name(), info.Size()}, info.ModTime()})
+		return nil
+	})
+	// oldest first, so the most recent end up at the front
+	sort.Slice(existing, func(i, j int) bool { return existing[i].mtime.Before(existing[j].mtime) })
+	for _, f := range existing {
+		c.entries[f.hash] = c.lru.PushFront(&entry{f.hash, f.size})
+		c.size += f.size
+	}
+	c.mtx.Lock()
+	c.evict()
+	c.mtx.Unlock()
+	logrus.Debugf("diskcache: loaded %d entries (%d bytes) from %q", len(c.entries), c.size, dir)
+
+	return c, nil
+}
+
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func (c *Cache) path(hash string) string {
+	return filepath.Join(c.dir, hash[:2], hash)
+}
+
+// isEntry reports whether the file name at path is where a blob would be stored, i.e. named
+// by a hex SHA-256 in the directory for its first two characters
+func (c *Cache) isEntry(path, name string) bool {
+	if len(name) != 2*sha256.Size || strings.ToLower(name) != name {
+		return false
+	}
+	if _, err := hex.DecodeString(name); err != nil {
+		return false
+	}
+	return path == c.path(name)
+}
+
+// Get opens the blob for key, if present. The caller must close the file.
+func (c *Cache) Get(key string) (*os.File, bool) {
+	hash := hashKey(key)
+
+	c.mtx.Lock()
+	el, ok := c.entries[hash]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mtx.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	path := c.path(hash)
+	f, err := os.Open(path)
+	if err != nil {
+		// someone removed it out from under us
+		c.mtx.Lock()
+		c.removeIfCurrent(hash, el)
+		c.mtx.Unlock()
+		c.misses.Add(1)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	c.hits.Add(1)
+	return f, true
+}
+
+// Has reports whether key is cached without touching its recency
+func (c *Cache) Has(key string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	_, ok := c.entries[hashKey(key)]
+	return ok
+}
+
+// Put stores everything read from r under key
+func (c *Cache) Put(key string, r io.Reader) error {
+	w, err := c.NewWriter(key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// Writer streams a blob into the cache. Nothing is visible to Get until Commit.
+type Writer struct {
+	c    *Cache
+	hash string
+	f    *os.File
+	n    int64
+	done bool
+}
+
+func (c *Cache) NewWriter(key string) (*Writer, error) {
+	hash := hashKey(key)
+	if err := os.MkdirAll(filepath.Dir(c.path(hash)), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.path(hash)), ".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{c: c, hash: hash, f: f}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Abort throws away everything written so far
+func (w *Writer) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// Commit atomically makes the blob visible, evicting old entries as needed
+func (w *Writer) Commit() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	c := w.c
+	if w.n > c.maxBytes {
+		os.Remove(w.f.Name())
+		return nil
+	}
+	// renamed under the lock so evicting an older blob for the same key can't delete this one
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err := os.Rename(w.f.Name(), c.path(w.hash)); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	if el, ok := c.entries[w.hash]; ok {
+		// raced with another writer for the same key; the rename replaced it
+		c.size -= el.Value.(*entry).size
+		c.lru.Remove(el)
+	}
+	c.entries[w.hash] = c.lru.PushFront(&entry{w.hash, w.n})
+	c.size += w.n
+	c.evict()
+	return nil
+}
+
+// remove drops el from the index and disk. c.mtx must be held.
+func (c *Cache) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	c.lru.Remove(el)
+	delete(c.entries, e.hash)
+	c.size -= e.size
+	os.Remove(c.path(e.hash))
+}
+
+// removeIfCurrent removes el if it's still the entry for hash, and not already evicted or
+// replaced by a newer Put of the same key. c.mtx must be held.
+func (c *Cache) removeIfCurrent(hash string, el *list.Element) {
+	if c.entries[hash] == el {
+		c.remove(el)
+	}
+}
+
+// evict removes least recently used entries until the cache is within budget. c.mtx must be held.
+func (c *Cache) evict() {
+	for c.size > c.maxBytes {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.remove(el)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *Cache) Stats() Stats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return Stats{
+		Entries:   len(c.entries),
+		Bytes:     c.size,
+		MaxBytes:  c.maxBytes,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
@@ -0,0 +1,256 @@
+package diskcache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func put(t *testing.T, c *Cache, key string, size int) {
+	t.Helper()
+	if err := c.Put(key, strings.NewReader(strings.Repeat("x", size))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get returns the blob for key, or false if it's not cached
+func get(t *testing.T, c *Cache, key string) (string, bool) {
+	t.Helper()
+	f, ok := c.Get(key)
+	if !ok {
+		return "", false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), true
+}
+
+// checkConsistent checks the cache's bookkeeping matches its entries and the files on disk
+func checkConsistent(t *testing.T, c *Cache) {
+	t.Helper()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.lru.Len() != len(c.entries) {
+		t.Errorf("lru has %d entries, map has %d", c.lru.Len(), len(c.entries))
+	}
+	var size int64
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*entry)
+		size += e.size
+		if c.entries[e.hash] != el {
+			t.Errorf("entry %s in lru isn't the one in the map", e.hash)
+		}
+		info, err := os.Stat(c.path(e.hash))
+		if err != nil {
+			t.Errorf("entry %s has no file: %v", e.hash, err)
+		} else if info.Size() != e.size {
+			t.Errorf("entry %s is %d bytes on disk, %d in the index", e.hash, info.Size(), e.size)
+		}
+	}
+	if size != c.size {
+		t.Errorf("entries add up to %d bytes, cache thinks it has %d", size, c.size)
+	}
+	if c.size > c.maxBytes {
+		t.Errorf("cache holds %d bytes, over its budget of %d", c.size, c.maxBytes)
+	}
+}
+
+func TestEvictsLeastRecentlyUsedToBudget(t *testing.T) {
+	c, err := New(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, c, "a", 40)
+	put(t, c, "b", 40)
+	// a is now more recently used than b
+	if _, ok := get(t, c, "a"); !ok {
+		t.Fatal("a missing")
+	}
+	put(t, c, "c", 40)
+
+	for _, tt := range []struct {
+		key    string
+		cached bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+	} {
+		if c.Has(tt.key) != tt.cached {
+			t.Errorf("Has(%q) = %v, want %v", tt.key, !tt.cached, tt.cached)
+		}
+	}
+	if st := c.Stats(); st.Entries != 2 || st.Bytes != 80 || st.Evictions != 1 {
+		t.Errorf("stats = %+v, want 2 entries, 80 bytes, 1 eviction", st)
+	}
+	if _, err := os.Stat(c.path(hashKey("b"))); !os.IsNotExist(err) {
+		t.Errorf("evicted blob still on disk: %v", err)
+	}
+
+	// too big to ever fit, so it isn't stored (and nothing is evicted for it)
+	put(t, c, "huge", 101)
+	if c.Has("huge") || !c.Has("a") || !c.Has("c") {
+		t.Error("blob larger than the whole cache changed its contents")
+	}
+	checkConsistent(t, c)
+}
+
+func TestRecoversEntriesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().Add(-time.Hour)
+	for i, key := range []string{"old", "mid", "new"} {
+		put(t, c, key, 100)
+		// recency comes from mtimes
+		mtime := base.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(c.path(hashKey(key)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a write interrupted by a crash
+	tmp := filepath.Join(dir, "ab", ".tmp123")
+	os.MkdirAll(filepath.Dir(tmp), 0755)
+	if err := os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = New(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Stats(); st.Entries != 3 || st.Bytes != 300 {
+		t.Errorf("stats after restart = %+v, want 3 entries, 300 bytes", st)
+	}
+	if data, ok := get(t, c, "mid"); !ok || len(data) != 100 {
+		t.Errorf("Get(mid) after restart = %d bytes, %v", len(data), ok)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("leftover temp file wasn't cleaned up: %v", err)
+	}
+	checkConsistent(t, c)
+
+	// restarting with a smaller budget drops the least recently used first; mid was just read
+	c, err = New(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Has("old") || !c.Has("mid") || !c.Has("new") {
+		t.Errorf("after shrinking: old=%v mid=%v new=%v, want only mid and new", c.Has("old"), c.Has("mid"), c.Has("new"))
+	}
+	checkConsistent(t, c)
+}
+
+func TestIgnoresForeignFilesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, c, "a", 100)
+	h := hashKey("a")
+
+	foreign := []string{
+		filepath.Join(dir, "README"),
+		filepath.Join(dir, "x"),
+		filepath.Join(dir, "ab", "x"),
+		// right name, wrong place
+		filepath.Join(dir, h),
+		filepath.Join(dir, "zz", h),
+		filepath.Join(dir, h[:2], strings.ToUpper(h)),
+	}
+	for _, path := range foreign {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(strings.Repeat("f", 500)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// older than the real entry, so they'd be evicted first if they were picked up
+		old := time.Now().Add(-time.Hour)
+		os.Chtimes(path, old, old)
+	}
+
+	// small enough that counting any foreign file forces evictions
+	c, err = New(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Stats(); st.Entries != 1 || st.Bytes != 100 {
+		t.Errorf("stats after restart = %+v, want 1 entry, 100 bytes", st)
+	}
+	if data, ok := get(t, c, "a"); !ok || len(data) != 100 {
+		t.Errorf("Get(a) after restart = %d bytes, %v", len(data), ok)
+	}
+	for _, path := range foreign {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("foreign file %s: %v", path, err)
+		}
+	}
+	checkConsistent(t, c)
+
+	put(t, c, "b", 100)
+	put(t, c, "c", 100)
+	if c.Has("a") || !c.Has("b") || !c.Has("c") {
+		t.Errorf("after filling: a=%v b=%v c=%v, want only b and c", c.Has("a"), c.Has("b"), c.Has("c"))
+	}
+	checkConsistent(t, c)
+}
+
+func TestStaleGetDoesNotRemoveReplacement(t *testing.T) {
+	c, err := New(t.TempDir(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := hashKey("k")
+	put(t, c, "k", 10)
+	c.mtx.Lock()
+	stale := c.entries[hash]
+	c.mtx.Unlock()
+
+	// a Get which found stale, then failed to open it after this Put replaced it
+	put(t, c, "k", 20)
+	c.mtx.Lock()
+	c.removeIfCurrent(hash, stale)
+	c.mtx.Unlock()
+
+	if data, ok := get(t, c, "k"); !ok || len(data) != 20 {
+		t.Errorf("Get(k) = %d bytes, %v; want the 20 byte replacement", len(data), ok)
+	}
+	if st := c.Stats(); st.Entries != 1 || st.Bytes != 20 {
+		t.Errorf("stats = %+v, want 1 entry of 20 bytes", st)
+	}
+	checkConsistent(t, c)
+}
+
+func TestConcurrentGetPutEvict(t *testing.T) {
+	c, err := New(t.TempDir(), 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("k%d", (w+i)%12)
+				if f, ok := c.Get(key); ok {
+					f.Close()
+				} else {
+					c.Put(key, strings.NewReader(strings.Repeat("x", 50+i%50)))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	checkConsistent(t, c)
+}
@@ -10,11 +10,13 @@ require (
 	github.com/aws/aws-sdk-go v1.55.8
 	github.com/dsnet/compress v0.0.1
 	github.com/fogleman/mc v0.0.0-20200516034030-c30b20ace55a
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/gin-contrib/cache v1.4.1
 	github.com/gin-gonic/gin v1.10.1
 	github.com/kallsyms/go-nexrad v0.0.0-20220101004302-66ae80633604
-	github.com/llgcode/draw2d v0.0.0-20240627062922-0ed1ff131195
+	github.com/klauspost/compress v1.18.0
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/sync v0.16.0
 	google.golang.org/api v0.248.0
 )
 
@@ -49,7 +51,6 @@ require (
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/go-playground/validator/v10 v10.27.0 // indirect
 	github.com/goccy/go-json v0.10.5 // indirect
-	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
 	github.com/gomodule/redigo v2.0.0+incompatible // indirect
 	github.com/google/s2a-go v0.1.9 // indirect
 	github.com/google/uuid v1.6.0 // indirect
@@ -80,10 +81,8 @@ require (
 	go.opentelemetry.io/otel/trace v1.38.0 // indirect
 	golang.org/x/arch v0.20.0 // indirect
 	golang.org/x/crypto v0.41.0 // indirect
-	golang.org/x/image v0.30.0 // indirect
 	golang.org/x/net v0.43.0 // indirect
 	golang.org/x/oauth2 v0.30.0 // indirect
-	golang.org/x/sync v0.16.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/text v0.28.0 // indirect
 	golang.org/x/time v0.12.0 // indirect
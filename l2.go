@@ -1,53 +1,27 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gin-gonic/gin"
 	"github.com/kallsyms/radserv/render"
 )
 
 func l2ListSitesHandler(c *gin.Context) {
-	sess, _ := session.NewSession(&aws.Config{
-		Credentials: credentials.AnonymousCredentials,
-		Region:      aws.String("us-east-1"),
-	})
-	svc := s3.New(sess)
-	bucket := aws.String("unidata-nexrad-level2")
-
 	// check yesterday to get a list of all radars
 	t := time.Now().UTC().AddDate(0, 0, -1)
-	sites := make([]string, 0, 512)
-	var token *string
-	for {
-		resp, err := svc.ListObjectsV2WithContext(c.Request.Context(), &s3.ListObjectsV2Input{
-			Bucket:            bucket,
-			Prefix:            aws.String(t.Format("2006/01/02/")),
-			Delimiter:         aws.String("/"),
-			ContinuationToken: token,
-		})
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
-			return
-		}
-		for _, d := range resp.CommonPrefixes {
-			sites = append(sites, filepath.Base(*d.Prefix))
-		}
-		if resp.IsTruncated == nil || !*resp.IsTruncated {
-			break
-		}
-		token = resp.NextContinuationToken
+	sites, err := L2Data.ListSites(c.Request.Context(), t)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
 	}
 
 	c.JSON(200, sites)
@@ -57,34 +31,9 @@ func l2ListFilesHandler(c *gin.Context) {
 	site := c.Param("site")
 	dateParam := c.Param("date") // may be empty if route is /l2/:site
 
-	sess, _ := session.NewSession(&aws.Config{
-		Credentials: credentials.AnonymousCredentials,
-		Region:      aws.String("us-east-1"),
-	})
-	svc := s3.New(sess)
-	bucket := aws.String("unidata-nexrad-level2")
-
-	// Helper to list all objects for a given day prefix
-	listDay := func(day time.Time) ([]*s3.Object, error) {
-		prefix := day.Format("2006/01/02/") + site
-		var token *string
-		objs := make([]*s3.Object, 0, 1024)
-		for {
-			resp, err := svc.ListObjectsV2WithContext(c.Request.Context(), &s3.ListObjectsV2Input{
-				Bucket:            bucket,
-				Prefix:            aws.String(prefix),
-				ContinuationToken: token,
-			})
-			if err != nil {
-				return nil, err
-			}
-			objs = append(objs, resp.Contents...)
-			if resp.IsTruncated == nil || !*resp.IsTruncated {
-				break
-			}
-			token = resp.NextContinuationToken
-		}
-		return objs, nil
+	// Helper to list all objects for a given day
+	listDay := func(day time.Time) ([]L2FileInfo, error) {
+		return L2Data.ListFiles(c.Request.Context(), site, day)
 	}
 
 	// If a date is provided
@@ -92,7 +41,7 @@ func l2ListFilesHandler(c *gin.Context) {
 		if strings.EqualFold(dateParam, "latest") {
 			// Gather latest up to 100 scans, going back across days
 			now := time.Now().UTC()
-			objects := make([]*s3.Object, 0, 200)
+			objects := make([]L2FileInfo, 0, 200)
 			// Limit how far back to search to avoid excessive listing; usually a day or two suffices
 			for i := 0; i < 7 && len(objects) < 100; i++ {
 				day := now.AddDate(0, 0, -i)
@@ -105,29 +54,17 @@ func l2ListFilesHandler(c *gin.Context) {
 			}
 			// Sort by LastModified asc
 			sort.Slice(objects, func(i, j int) bool {
-				ti := time.Time{}
-				tj := time.Time{}
-				if objects[i].LastModified != nil {
-					ti = *objects[i].LastModified
-				}
-				if objects[j].LastModified != nil {
-					tj = *objects[j].LastModified
-				}
-				return ti.Before(tj)
+				return objects[i].LastModified.Before(objects[j].LastModified)
 			})
 			if len(objects) > 100 {
 				objects = objects[len(objects)-100:]
 			}
 			files := make([]string, 0, len(objects))
 			for _, o := range objects {
-				if o.Key == nil {
+				if isMDMFile(o.Name) {
 					continue
 				}
-				base := filepath.Base(*o.Key)
-				if isMDMFile(base) {
-					continue
-				}
-				files = append(files, base)
+				files = append(files, o.Name)
 			}
 			// Return newest-first for convenience
 			c.JSON(200, files)
@@ -146,14 +83,10 @@ func l2ListFilesHandler(c *gin.Context) {
 		}
 		files := make([]string, 0, len(objs))
 		for _, d := range objs {
-			if d.Key == nil {
-				continue
-			}
-			base := filepath.Base(*d.Key)
-			if isMDMFile(base) {
+			if isMDMFile(d.Name) {
 				continue
 			}
-			files = append(files, base)
+			files = append(files, d.Name)
 		}
 		c.JSON(200, files)
 		return
@@ -168,14 +101,10 @@ func l2ListFilesHandler(c *gin.Context) {
 	}
 	files := make([]string, 0, len(objs))
 	for _, d := range objs {
-		if d.Key == nil {
+		if isMDMFile(d.Name) {
 			continue
 		}
-		base := filepath.Base(*d.Key)
-		if isMDMFile(base) {
-			continue
-		}
-		files = append(files, base)
+		files = append(files, d.Name)
 	}
 	c.JSON(200, files)
 }
@@ -192,101 +121,231 @@ func l2FileMetaHandler(c *gin.Context) {
 	c.JSON(200, meta)
 }
 
-func l2FileIsosurfaceHandler(c *gin.Context) {
+// l2FileFramesHandler lists the low level scans of a volume, including SAILS supplemental ones
+func l2FileFramesHandler(c *gin.Context) {
 	fn := c.Param("fn")
-	threshold, err := strconv.ParseFloat(c.Param("threshold"), 64)
+
+	meta, _, err := ChunkCache.GetMeta(c.Request.Context(), fn)
 	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, errors.New("Invalid threshold"))
+		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
-	product := strings.ToLower(c.Param("product"))
+	c.JSON(200, lowLevelFrames(meta))
+}
 
-	ar2, err := ChunkCache.GetFile(c.Request.Context(), fn)
+// l2RadialOptions are the query options shared by the L2 radial and render endpoints
+type l2RadialOptions struct {
+	// dealias=1
+	Dealias bool
+	// Storm motion for srv from u,v or dir,speed. nil to estimate it.
+	Motion *render.Motion
+	// Reflectivity threshold for et in dBZ
+	Threshold float64
+}
+
+func parseL2RadialOptions(c *gin.Context, product string) (l2RadialOptions, error) {
+	opts := l2RadialOptions{
+		Dealias:   c.Query("dealias") == "1",
+		Threshold: render.DefaultEchoTopsThreshold,
+	}
+	if opts.Dealias && product != "vel" && product != "srv" {
+		return opts, errors.New("dealias is only supported for vel and srv")
+	}
+	if s, ok := c.GetQuery("threshold"); ok {
+		if product != "et" {
+			return opts, errors.New("threshold is only supported for et")
+		}
+		t, err := strconv.ParseFloat(s, 64)
+		if err != nil || t < -30 || t > 80 {
+			return opts, errors.New("Invalid threshold, expected dBZ")
+		}
+		opts.Threshold = t
+	}
+	if product == "srv" {
+		m, err := stormMotionParams(c)
+		if err != nil {
+			return opts, err
+		}
+		opts.Motion = m
+	}
+	return opts, nil
+}
+
+// l2VolumeProducts are derived from the reflectivity of every elevation of a volume, so
+// don't have an elevation of their own
+var l2VolumeProducts = map[string]func(render.ElevationSet, l2RadialOptions) *render.RadialSet{
+	"cref": func(elvs render.ElevationSet, _ l2RadialOptions) *render.RadialSet {
+		return render.Composite(elvs)
+	},
+	"et": func(elvs render.ElevationSet, opts l2RadialOptions) *render.RadialSet {
+		return render.EchoTops(elvs, opts.Threshold)
+	},
+	"vil": func(elvs render.ElevationSet, _ l2RadialOptions) *render.RadialSet {
+		return render.VIL(elvs)
+	},
+	"vild": func(elvs render.ElevationSet, _ l2RadialOptions) *render.RadialSet {
+		return render.VILDensity(elvs)
+	},
+}
+
+// isLevel2Product returns whether product is stored as is in Level 2 volumes
+func isLevel2Product(product string) bool {
+	for _, p := range render.Level2Products {
+		if p == product {
+			return true
+		}
+	}
+	return false
+}
+
+// l2BaseProduct returns the product stored in the volume which product is derived from
+func l2BaseProduct(product string) string {
+	if product == "srv" {
+		return "vel"
+	}
+	if _, ok := l2VolumeProducts[product]; ok {
+		return "ref"
+	}
+	return product
+}
+
+// l2RadialSet loads the RadialSet for product at elv of fn, applying opts.
+// elv is ignored for volume products.
+func l2RadialSet(ctx context.Context, site, fn, product string, elv int, opts l2RadialOptions) (*render.RadialSet, error) {
+	if _, ok := l2VolumeProducts[product]; ok {
+		return RadialCache.GetVolumeProduct(ctx, fn, product, opts)
+	}
+
+	var rs *render.RadialSet
+	var err error
+	if opts.Dealias {
+		rs, err = RadialCache.GetDealiased(ctx, fn, elv)
+	} else {
+		rs, err = RadialCache.Get(ctx, fn, l2BaseProduct(product), elv)
+	}
+	if err != nil || product != "srv" {
+		return rs, err
+	}
+
+	m := opts.Motion
+	if m == nil {
+		est, err := estimateStormMotion(ctx, site, fn)
+		if err != nil {
+			return nil, err
+		}
+		m = &est
+	}
+	return render.StormRelative(rs, *m), nil
+}
+
+// loadL2RadialSets loads the RadialSets a radial or render request refers to, aborting the
+// request on error
+func loadL2RadialSets(c *gin.Context, sel sweepSelector) (string, []*render.RadialSet, bool) {
+	fn := c.Param("fn")
+	product := render.CanonicalProduct(strings.ToLower(c.Param("product")))
+	opts, err := parseL2RadialOptions(c, product)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
+		c.AbortWithError(http.StatusBadRequest, err)
+		return "", nil, false
 	}
 
-	elevations := render.ElevationSet{}
-	for _, scan := range ar2.ElevationScans {
-		elv, err := render.RadialSetFromLevel2(scan, product)
+	if sel.CAPPI {
+		if !isLevel2Product(product) {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("altitude is not supported for %s", product))
+			return "", nil, false
+		}
+		rs, err := RadialCache.GetCAPPI(c.Request.Context(), fn, product, sel.Altitude)
 		if err != nil {
 			c.AbortWithError(http.StatusInternalServerError, err)
-			return
+			return "", nil, false
 		}
-		elevations = append(elevations, elv)
+		return product, []*render.RadialSet{rs}, true
 	}
 
-	// If request already canceled, abort before heavy work
-	select {
-	case <-c.Request.Context().Done():
-		return
-	default:
+	elvs := []int{0}
+	if _, ok := l2VolumeProducts[product]; !ok {
+		elvs, err = resolveSweeps(c.Request.Context(), fn, product, sel)
+	}
+	if errors.Is(err, errNoSweep) {
+		c.AbortWithError(http.StatusNotFound, err)
+		return "", nil, false
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return "", nil, false
 	}
-	tris := render.CreateIsosurface(c.Request.Context(), elevations, threshold)
 
-	// Check again before writing
-	select {
-	case <-c.Request.Context().Done():
-		return
-	default:
+	sets := make([]*render.RadialSet, 0, len(elvs))
+	for _, elv := range elvs {
+		r, err := l2RadialSet(c.Request.Context(), c.Param("site"), fn, product, elv, opts)
+		if errors.Is(err, errNoStormMotion) {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return "", nil, false
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return "", nil, false
+		}
+		sets = append(sets, r)
 	}
-	c.Status(http.StatusOK)
-	c.Header("Content-Type", "text/plain")
-	render.WriteOBJ(tris, c.Writer)
+	return product, sets, true
 }
 
+// l2FileRadialHandler serves /:product/:elv/radial and /:product/radial?angle=
 func l2FileRadialHandler(c *gin.Context) {
-	fn := c.Param("fn")
-	elv, err := strconv.Atoi(c.Param("elv"))
+	sel, err := parseSweepSelector(c)
 	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, errors.New("Invalid elv"))
+		c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
 
-	product := strings.ToLower(c.Param("product"))
-
-	ar2, err := ChunkCache.GetFileWithElevation(c.Request.Context(), fn, elv)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	_, sets, ok := loadL2RadialSets(c, sel)
+	if !ok {
 		return
 	}
 
-	r, err := render.RadialSetFromLevel2(ar2.ElevationScans[elv], product)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	if sel.Which == "all" {
+		c.JSON(200, sets)
 		return
 	}
-
-	c.JSON(200, r)
+	c.JSON(200, sets[0])
 }
 
+// l2FileRenderHandler serves /:product/:elv/render and /:product/render?angle=
 func l2FileRenderHandler(c *gin.Context) {
-	fn := c.Param("fn")
-	elv, err := strconv.Atoi(c.Param("elv"))
-	if err != nil || elv < 1 {
-		c.AbortWithError(http.StatusBadRequest, errors.New("Invalid elv"))
+	sel, err := parseSweepSelector(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
-
-	product := strings.ToLower(c.Param("product"))
-
-	ar2, err := ChunkCache.GetFileWithElevation(c.Request.Context(), fn, elv)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	if sel.Which == "all" {
+		c.AbortWithError(http.StatusBadRequest, errors.New("which=all is not supported for render"))
 		return
 	}
 
-	r, err := render.RadialSetFromLevel2(ar2.ElevationScans[elv], product)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	product, sets, ok := loadL2RadialSets(c, sel)
+	if !ok {
 		return
 	}
+	r := sets[0]
 	lut := render.DefaultLUT(product)
 	if _, ok := c.GetQuery("nolut"); ok {
 		lut = render.DefaultLUT("")
 	}
+	target, err := parseTarget(c, r)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	format, err := parseRenderFormat(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	interp, err := parseInterp(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
 
 	// If request canceled, bail early
 	select {
@@ -294,21 +353,22 @@ func l2FileRenderHandler(c *gin.Context) {
 		return
 	default:
 	}
-	pngFile, err := render.RenderAndReproject(c.Request.Context(), r, lut, 6000, 2600)
+	out, contentType, err := renderRadialSet(c.Request.Context(), r, lut, target, format, interp)
 	if err != nil {
+		if c.Request.Context().Err() == nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
 		return
 	}
-	png, _ := ioutil.ReadAll(pngFile)
-	pngFile.Close()
+	data, _ := ioutil.ReadAll(out)
+	out.Close()
 	// If canceled during render/encode, skip writing response
 	select {
 	case <-c.Request.Context().Done():
 		return
 	default:
 	}
-	// Strong client caching: rendered outputs are immutable per file/product/elevation
-	c.Header("Cache-Control", "public, max-age=31536000, immutable")
-	// Optional Expires header for intermediaries that honor it
-	c.Header("Expires", time.Now().UTC().AddDate(1, 0, 0).Format(http.TimeFormat))
-	c.Data(http.StatusOK, "image/png", png)
+	// Rendered outputs only depend on the file/product/elevation
+	setFileCacheHeaders(c)
+	c.Data(http.StatusOK, contentType, data)
 }
@@ -3,78 +3,98 @@ package main
 import (
 	"context"
 	"fmt"
-	"net/http"
+	"io"
+	"math"
 	"sort"
 	"sync"
 	"time"
 
 	"github.com/kallsyms/go-nexrad/archive2"
+	"github.com/kallsyms/radserv/render"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 type Archive2Metadata struct {
+	// Length of the whole file in bytes
+	Size       int64
 	LDMOffsets []int
 	// For each elevation, the list of chunk offsets which hold any data for that elevation
 	ElevationChunks [][]int
+	// For each elevation, a summary of what's in it
+	Sweeps []SweepInfo
+}
+
+type SweepInfo struct {
+	ElevationNumber int
+	ElevationAngle  float64
+	// When the first and last radials of the sweep were collected
+	Time    time.Time
+	EndTime time.Time
+	// Whether this is a SAILS/MESO-SAILS supplemental low level sweep
+	Supplemental bool
+	// Volume coverage pattern the sweep was collected under
+	VCP int
+	// Which products (see render.Level2Products) have data in this sweep
+	Products []string
 }
 
 type Archive2ChunkCacheManager struct {
-	mtx  sync.RWMutex
-	meta map[string]Archive2Metadata
+	meta *lruCache[string, Archive2Metadata]
+	// Coalesces concurrent full-volume loads of the same file
+	loads singleflight.Group
 }
 
-var ChunkCache Archive2ChunkCacheManager
+var ChunkCache *Archive2ChunkCacheManager
 
-func init() {
-	ChunkCache = Archive2ChunkCacheManager{
-		meta: make(map[string]Archive2Metadata),
+// NewArchive2ChunkCacheManager creates a manager caching metadata for at most maxEntries
+// files, each for at most ttl (0 for no expiry)
+func NewArchive2ChunkCacheManager(maxEntries int, ttl time.Duration) *Archive2ChunkCacheManager {
+	return &Archive2ChunkCacheManager{
+		meta: newLRUCache[string, Archive2Metadata](int64(maxEntries), ttl, nil),
 	}
 }
 
-func urlForFile(fn string) (string, error) {
-	// fn is like KOKX20210902_000428_V06
-	site := fn[:4]
-	date, err := time.Parse("20060102_150405", fn[4:19])
-	if err != nil {
-		return "", err
-	}
-	return "https://unidata-nexrad-level2.s3.amazonaws.com/" + date.Format("2006/01/02/") + site + "/" + fn, nil
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	n int64
 }
 
-func loadArchive2(ctx context.Context, fn string) (*archive2.Archive2, error) {
-	url, err := urlForFile(fn)
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// loadArchive2 fetches and decodes the whole of fn, also returning its length
+func loadArchive2(ctx context.Context, fn string) (*archive2.Archive2, int64, error) {
+	body, err := L2Data.Open(ctx, fn)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
-	resp, err := http.DefaultClient.Do(req)
+	defer body.Close()
+
+	cr := &countingReader{Reader: body}
+	ar2, err := archive2.Extract(cr)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Bad status code fetching file: %d", resp.StatusCode)
+	// anything after the last record still counts
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return nil, 0, err
 	}
-
-	return archive2.Extract(resp.Body)
+	return ar2, cr.n, nil
 }
 
-func (cm *Archive2ChunkCacheManager) GetMeta(ctx context.Context, filename string) (Archive2Metadata, *archive2.Archive2, error) {
-	cm.mtx.RLock()
-	if meta, ok := cm.meta[filename]; ok {
-		cm.mtx.RUnlock()
-		return meta, nil, nil
-	}
-	cm.mtx.RUnlock()
-
-	logrus.Debugf("%q not in cache", filename)
-	ar2, err := loadArchive2(ctx, filename)
-	if err != nil {
-		return Archive2Metadata{}, nil, err
-	}
+// m31Time returns when a radial was collected.
+// Header.Date() is a day late since NEXRAD dates are 1 on 1970-01-01, not 0.
+func m31Time(m31 *archive2.Message31) time.Time {
+	return m31.Header.Date().AddDate(0, 0, -1)
+}
 
+func metadataFromArchive2(ar2 *archive2.Archive2) Archive2Metadata {
 	meta := Archive2Metadata{
 		LDMOffsets:      ar2.LDMOffsets,
 		ElevationChunks: make([][]int, len(ar2.ElevationScans)),
@@ -106,15 +126,125 @@ func (cm *Archive2ChunkCacheManager) GetMeta(ctx context.Context, filename strin
 		meta.ElevationChunks[elv] = offsets
 	}
 
-	cm.mtx.Lock()
-	cm.meta[filename] = meta
-	cm.mtx.Unlock()
+	meta.Sweeps = make([]SweepInfo, 0, len(ar2.ElevationScans))
+	for elv := 1; elv <= len(ar2.ElevationScans); elv++ {
+		m31s := ar2.ElevationScans[elv]
+		if len(m31s) == 0 {
+			continue
+		}
+		start, end := m31Time(m31s[0]), m31Time(m31s[0])
+		for _, m31 := range m31s {
+			if m31 == nil {
+				continue
+			}
+			t := m31Time(m31)
+			if t.Before(start) {
+				start = t
+			}
+			if t.After(end) {
+				end = t
+			}
+		}
+		meta.Sweeps = append(meta.Sweeps, SweepInfo{
+			ElevationNumber: elv,
+			ElevationAngle:  float64(m31s[0].Header.ElevationAngle),
+			Time:            start,
+			EndTime:         end,
+			VCP:             int(m31s[0].VolumeData.VolumeCoveragePatternNumber),
+			Products:        render.Level2ProductsIn(m31s),
+		})
+	}
+	markSupplementalSweeps(meta.Sweeps)
+
+	return meta
+}
+
+// Sweeps within this many degrees of each other are considered to be at the same angle
+const sameAngleTolerance = 0.2
+
+// markSupplementalSweeps flags the extra low level sweeps SAILS/MESO-SAILS insert part
+// way through a volume, i.e. sweeps at the lowest angle after a higher one has been scanned
+func markSupplementalSweeps(sweeps []SweepInfo) {
+	if len(sweeps) == 0 {
+		return
+	}
+	lowest := sweeps[0].ElevationAngle
+	for _, s := range sweeps {
+		lowest = math.Min(lowest, s.ElevationAngle)
+	}
+
+	wentHigher := false
+	for i := range sweeps {
+		if sweeps[i].ElevationAngle-lowest > sameAngleTolerance {
+			wentHigher = true
+		} else if wentHigher {
+			sweeps[i].Supplemental = true
+		}
+	}
+}
+
+// loadedArchive2 is a full volume along with its metadata
+type loadedArchive2 struct {
+	ar2  *archive2.Archive2
+	meta Archive2Metadata
+}
+
+// load fetches the full volume, sharing the download with any concurrent loads of
+// the same file, and caches its metadata along the way.
+// The returned Archive2 may be shared, so callers must not modify it.
+func (cm *Archive2ChunkCacheManager) load(ctx context.Context, filename string) (*archive2.Archive2, Archive2Metadata, error) {
+	ch := cm.loads.DoChan(filename, func() (interface{}, error) {
+		logrus.Debugf("loading %q", filename)
+		// Don't let one canceled request fail everyone else waiting on this load
+		ar2, size, err := loadArchive2(context.WithoutCancel(ctx), filename)
+		if err != nil {
+			return nil, err
+		}
+		meta := metadataFromArchive2(ar2)
+		meta.Size = size
+		cm.meta.Put(filename, meta)
+		return loadedArchive2{ar2, meta}, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, Archive2Metadata{}, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, Archive2Metadata{}, res.Err
+		}
+		loaded := res.Val.(loadedArchive2)
+		return loaded.ar2, loaded.meta, nil
+	}
+}
+
+func (cm *Archive2ChunkCacheManager) GetMeta(ctx context.Context, filename string) (Archive2Metadata, *archive2.Archive2, error) {
+	if meta, ok := cm.meta.Get(filename); ok {
+		return meta, nil, nil
+	}
+
+	logrus.Debugf("%q not in cache", filename)
+	ar2, meta, err := cm.load(ctx, filename)
+	if err != nil {
+		return Archive2Metadata{}, nil, err
+	}
 
 	return meta, ar2, nil
 }
 
 func (cm *Archive2ChunkCacheManager) GetFile(ctx context.Context, filename string) (*archive2.Archive2, error) {
-	return loadArchive2(ctx, filename)
+	ar2, _, err := cm.load(ctx, filename)
+	return ar2, err
+}
+
+// Forget drops the cached metadata of filename (e.g. because the file changed), and stops any
+// load of it in progress from being shared with later callers
+func (cm *Archive2ChunkCacheManager) Forget(filename string) {
+	cm.loads.Forget(filename)
+	cm.meta.Remove(filename)
+}
+
+func (cm *Archive2ChunkCacheManager) Stats() CacheStats {
+	return cm.meta.Stats()
 }
 
 func (cm *Archive2ChunkCacheManager) GetFileWithElevation(ctx context.Context, filename string, elv int) (*archive2.Archive2, error) {
@@ -125,56 +255,55 @@ func (cm *Archive2ChunkCacheManager) GetFileWithElevation(ctx context.Context, f
 	if ar2 != nil {
 		return ar2, nil
 	}
-
-	url, err := urlForFile(filename)
-	if err != nil {
-		return nil, err
+	if elv < 1 || elv > len(meta.ElevationChunks) {
+		return nil, fmt.Errorf("No elevation %d in %q", elv, filename)
 	}
 
 	// Load the main header and the first LDM message (should be a Message2)
-	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
-	req.Header.Add("Range", fmt.Sprintf("bytes=0-%d", meta.LDMOffsets[1]-1))
-	resp, err := http.DefaultClient.Do(req)
+	header, err := L2Data.OpenRange(ctx, filename, 0, int64(meta.LDMOffsets[1]-1))
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	ar2, err = archive2.Extract(resp.Body)
+	ar2, err = archive2.Extract(header)
+	header.Close()
 	if err != nil {
 		return nil, err
 	}
 
 	mtx := sync.Mutex{}
-	wg := sync.WaitGroup{}
+	// A sweep missing any of its records would be cached as if it were complete, so fail
+	// (and stop loading the rest) if any of them can't be loaded
+	g, gctx := errgroup.WithContext(ctx)
 
 	// Load all of the other records we need for this elevation
 	for _, offset := range meta.ElevationChunks[elv-1] {
-		wg.Add(1)
-		go func(offset int) {
-			defer wg.Done()
-
-			req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
-			// everything is streamed so it should be fine that we request to EOF here,
-			// despite only needing probably a few hundred KB
-			req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
-			resp, err := http.DefaultClient.Do(req)
+		g.Go(func() error {
+			// Only request this record, so ranges are stable (and cacheable).
+			// Even the last one is bounded, as open-ended ranges are never cached.
+			end := meta.Size - 1
+			if i := sort.SearchInts(meta.LDMOffsets, offset); i+1 < len(meta.LDMOffsets) {
+				end = int64(meta.LDMOffsets[i+1] - 1)
+			}
+			body, err := L2Data.OpenRange(gctx, filename, int64(offset), end)
 			if err != nil {
-				return
+				return fmt.Errorf("loading record at %d of %q: %w", offset, filename, err)
 			}
 
-			record, err := ar2.LoadLDMRecord(resp.Body)
-			resp.Body.Close()
+			record, err := ar2.LoadLDMRecord(body)
+			body.Close()
 			if err != nil {
-				return
+				return fmt.Errorf("loading record at %d of %q: %w", offset, filename, err)
 			}
 
 			mtx.Lock()
 			ar2.AddFromLDMRecord(record)
 			mtx.Unlock()
-		}(offset)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
 	}
-	wg.Wait()
 
 	return ar2, nil
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kallsyms/radserv/render"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Largest number of values in a grid
+	maxGridPoints  = 10 * 1000 * 1000
+	maxGridLevels  = 100
+	minGridSpacing = 250.0
+)
+
+// gridSpec parses ?spacing= and ?radius= (meters) and ?heights= (meters above sea level),
+// defaulting to 1km columns out to 150km every 500m from 1km to 15km
+func gridSpec(c *gin.Context) (render.GridSpec, error) {
+	spec := render.GridSpec{Spacing: 1000, Radius: 150000}
+	var err error
+	if s := c.Query("spacing"); s != "" {
+		spec.Spacing, err = strconv.ParseFloat(s, 64)
+		if err != nil || spec.Spacing < minGridSpacing {
+			return spec, fmt.Errorf("Invalid spacing, expected at least %g meters", minGridSpacing)
+		}
+	}
+	if s := c.Query("radius"); s != "" {
+		spec.Radius, err = strconv.ParseFloat(s, 64)
+		if err != nil || spec.Radius <= 0 || spec.Radius > 460000 {
+			return spec, errors.New("Invalid radius, expected up to 460000 meters")
+		}
+	}
+	if s := c.Query("heights"); s != "" {
+		for _, p := range strings.Split(s, ",") {
+			h, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil || (len(spec.Heights) > 0 && h <= spec.Heights[len(spec.Heights)-1]) {
+				return spec, errors.New("Invalid heights, expected ascending meters above sea level")
+			}
+			spec.Heights = append(spec.Heights, h)
+		}
+	} else {
+		for h := 1000.0; h <= 15000; h += 500 {
+			spec.Heights = append(spec.Heights, h)
+		}
+	}
+	if len(spec.Heights) > maxGridLevels {
+		return spec, fmt.Errorf("Too many heights, at most %d are allowed", maxGridLevels)
+	}
+
+	n := 2*int(spec.Radius/spec.Spacing) + 1
+	if n*n*len(spec.Heights) > maxGridPoints {
+		return spec, fmt.Errorf("Grid of %dx%dx%d is too large", n, n, len(spec.Heights))
+	}
+	return spec, nil
+}
+
+// gridEncodings are the binary grid value encodings by ?format=
+var gridEncodings = map[string]render.GridEncoding{
+	"uint8":   render.Uint8,
+	"float16": render.Float16,
+}
+
+// gridContentEncoding picks how to compress a grid from an Accept-Encoding header: whichever of
+// zstd and gzip the client prefers (zstd on ties), or "" for neither
+func gridContentEncoding(accept string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "zstd" && coding != "gzip" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > bestQ || (q == bestQ && coding == "zstd") {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// l2FileGridHandler serves /:product/grid, the volume interpolated onto a Cartesian grid as JSON
+// (by default) or with ?format=uint8|float16 as a binary grid, compressed with zstd or gzip if
+// the client accepts either
+func l2FileGridHandler(c *gin.Context) {
+	fn := c.Param("fn")
+	product := render.CanonicalProduct(strings.ToLower(c.Param("product")))
+	if !isLevel2Product(product) {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Product %q can't be gridded", product))
+		return
+	}
+	spec, err := gridSpec(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	interp, err := parseInterp(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	format := strings.ToLower(c.DefaultQuery("format", "json"))
+	enc, binary := gridEncodings[format]
+	if !binary && format != "json" {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Invalid format %q, expected json, uint8 or float16", format))
+		return
+	}
+
+	elevations, err := RadialCache.GetVolume(c.Request.Context(), fn, product)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	grid, err := render.NewGrid(c.Request.Context(), elevations, spec, interp)
+	if err != nil {
+		if c.Request.Context().Err() == nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	setFileCacheHeaders(c)
+	c.Header("Vary", "Accept-Encoding")
+	contentType := "application/json; charset=utf-8"
+	if binary {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Type", contentType)
+	w := io.Writer(c.Writer)
+	switch encoding := gridContentEncoding(c.GetHeader("Accept-Encoding")); encoding {
+	case "zstd":
+		zw, err := zstd.NewWriter(c.Writer)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		defer zw.Close()
+		c.Header("Content-Encoding", encoding)
+		w = zw
+	case "gzip":
+		gz := gzip.NewWriter(c.Writer)
+		defer gz.Close()
+		c.Header("Content-Encoding", encoding)
+		w = gz
+	}
+	c.Status(http.StatusOK)
+	if binary {
+		render.WriteGrid(grid, enc, w)
+	} else {
+		json.NewEncoder(w).Encode(grid)
+	}
+}
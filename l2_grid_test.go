@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestGridContentEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "gzip"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"zstd;q=0.5, gzip;q=1.0", "gzip"},
+		{"gzip;q=0.8, zstd;q=0.8", "zstd"},
+		{"ZSTD", "zstd"},
+		{"zstd;q=0, gzip", "gzip"},
+		{"gzip;q=0", ""},
+		{"br", ""},
+	}
+	for _, tt := range tests {
+		if got := gridContentEncoding(tt.accept); got != tt.want {
+			t.Errorf("gridContentEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kallsyms/radserv/render"
+)
+
+const (
+	// Most isosurfaces one request can ask for
+	maxIsosurfaceLevels = 8
+	// Coarsest ?lod=, which merges blocks of 2^lod gates by 2^lod radials
+	maxIsosurfaceLOD = 3
+	// Smallest ?maxTriangles=
+	minIsosurfaceTriangles = 100
+)
+
+// meshFormats are the isosurface formats by ?format=, with their content types
+var meshFormats = map[string]struct {
+	contentType string
+	write       func([]*render.Mesh, io.Writer) error
+}{
+	"obj": {"text/plain", render.WriteOBJ},
+	"glb": {"model/gltf-binary", render.WriteGLB},
+	"ply": {"application/octet-stream", render.WritePLY},
+	"stl": {"model/stl", render.WriteSTL},
+}
+
+// isosurfaceThresholds parses the :threshold path param, or without one, ?thresholds=30,45,60
+func isosurfaceThresholds(c *gin.Context) ([]float64, error) {
+	s := c.Param("threshold")
+	if s == "" {
+		s = c.Query("thresholds")
+	}
+	if s == "" {
+		return nil, errors.New("Missing thresholds")
+	}
+	var thresholds []float64
+	for _, p := range strings.Split(s, ",") {
+		t, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, errors.New("Invalid threshold")
+		}
+		thresholds = append(thresholds, t)
+	}
+	if len(thresholds) > maxIsosurfaceLevels {
+		return nil, fmt.Errorf("Too many thresholds, at most %d are allowed", maxIsosurfaceLevels)
+	}
+	return thresholds, nil
+}
+
+// meshCRSs are the vertex coordinate systems by ?crs=
+var meshCRSs = map[string]render.CRS{
+	"local": render.Local,
+	"enu":   render.ENU,
+	"lla":   render.LLA,
+	"ecef":  render.ECEF,
+}
+
+// isosurfaceDetail parses ?lod= into how many gates and radials to merge before meshing, and
+// ?maxTriangles= into the most triangles to decimate the result to (0 for no limit)
+func isosurfaceDetail(c *gin.Context) (int, int, error) {
+	lod, maxTriangles := 0, 0
+	var err error
+	if s := c.Query("lod"); s != "" {
+		lod, err = strconv.Atoi(s)
+		if err != nil || lod < 0 || lod > maxIsosurfaceLOD {
+			return 0, 0, fmt.Errorf("Invalid lod, expected 0-%d", maxIsosurfaceLOD)
+		}
+	}
+	if s := c.Query("maxTriangles"); s != "" {
+		maxTriangles, err = strconv.Atoi(s)
+		if err != nil || maxTriangles < minIsosurfaceTriangles {
+			return 0, 0, fmt.Errorf("Invalid maxTriangles, expected at least %d", minIsosurfaceTriangles)
+		}
+	}
+	return 1 << uint(lod), maxTriangles, nil
+}
+
+// parseLonLatBBox parses ?bbox= (in ?bbox_srs=, EPSG:4326 by default) into a lon/lat extent,
+// nil if not given
+func parseLonLatBBox(c *gin.Context) (*[4]float64, error) {
+	s := c.Query("bbox")
+	if s == "" {
+		return nil, nil
+	}
+	b, err := parseBBox(s)
+	if err != nil {
+		return nil, err
+	}
+	srs, err := parseSRS(c, "bbox_srs", "EPSG:4326")
+	if err != nil {
+		return nil, err
+	}
+	if srs != "EPSG:4326" {
+		if b, err = render.TransformExtent(b, srs, "EPSG:4326"); err != nil {
+			return nil, err
+		}
+	}
+	return &b, nil
+}
+
+// l2FileIsosurfaceHandler serves /:product/isosurface/:threshold and /:product/isosurface?thresholds=,
+// the surfaces where the volume crosses each threshold as indexed meshes with per-vertex normals
+// (obj by default, or ?format=glb|ply|stl). Surfaces enclose values above their thresholds, or with
+// ?below, values under them. ?color= colors each vertex by another moment where it passes through.
+// ?lod= coarsens the volume before meshing, ?maxTriangles= decimates the result and ?bbox= clips it.
+// ?crs= picks the coordinate system of the vertices.
+func l2FileIsosurfaceHandler(c *gin.Context) {
+	fn := c.Param("fn")
+	thresholds, err := isosurfaceThresholds(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	_, below := c.GetQuery("below")
+
+	product := render.CanonicalProduct(strings.ToLower(c.Param("product")))
+	if !isLevel2Product(product) {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Product %q has no volume to take isosurfaces of", product))
+		return
+	}
+
+	format := strings.ToLower(c.DefaultQuery("format", "obj"))
+	mf, ok := meshFormats[format]
+	if !ok {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Invalid format %q, expected obj, glb, ply or stl", format))
+		return
+	}
+
+	factor, maxTriangles, err := isosurfaceDetail(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	bbox, err := parseLonLatBBox(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	crs, ok := meshCRSs[strings.ToLower(c.DefaultQuery("crs", "local"))]
+	if !ok {
+		c.AbortWithError(http.StatusBadRequest, errors.New("Invalid crs, expected local, enu, lla or ecef"))
+		return
+	}
+
+	opts := render.IsosurfaceOptions{BBox: bbox, MaxTriangles: maxTriangles, CRS: crs}
+	if s := c.Query("color"); s != "" {
+		colorProduct := render.CanonicalProduct(strings.ToLower(s))
+		if !isLevel2Product(colorProduct) {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Can't color by %q", s))
+			return
+		}
+		opts.Color, err = RadialCache.GetVolume(c.Request.Context(), fn, colorProduct)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		opts.ColorLUT = render.DefaultLUT(colorProduct)
+	}
+
+	elevations, err := RadialCache.GetVolume(c.Request.Context(), fn, product)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// the volume is resampled once for every threshold
+	var meshes []*render.Mesh
+	volume, err := render.NewIsoVolume(c.Request.Context(), elevations, below)
+	if err == nil {
+		meshes, err = volume.Downsample(factor).Isosurfaces(c.Request.Context(), thresholds, opts)
+	}
+	if err != nil {
+		if c.Request.Context().Err() == nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+	for i, m := range meshes {
+		op := ">="
+		if below {
+			op = "<="
+		}
+		m.Name = fmt.Sprintf("%s%s%g", product, op, thresholds[i])
+	}
+
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", mf.contentType)
+	if err := mf.write(meshes, c.Writer); err != nil {
+		// too late for an error status, but it still gets logged
+		c.Error(err)
+	}
+}
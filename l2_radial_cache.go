@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kallsyms/go-nexrad/archive2"
+	"github.com/kallsyms/radserv/render"
+	"golang.org/x/sync/singleflight"
+)
+
+type radialSetKey struct {
+	File      string
+	Product   string
+	Elevation int
+}
+
+// RadialSetCacheManager caches decoded RadialSets so the render, radial and isosurface
+// handlers don't each re-fetch and re-decode the same elevation.
+// Cached RadialSets are shared between requests and must not be modified.
+type RadialSetCacheManager struct {
+	sets  *lruCache[radialSetKey, *render.RadialSet]
+	loads singleflight.Group
+}
+
+var RadialCache *RadialSetCacheManager
+
+// NewRadialSetCacheManager creates a cache holding roughly maxBytes worth of decoded data
+func NewRadialSetCacheManager(maxBytes int64) *RadialSetCacheManager {
+	return &RadialSetCacheManager{
+		sets: newLRUCache[radialSetKey, *render.RadialSet](maxBytes, 0, radialSetSize),
+	}
+}
+
+// radialSetSize estimates the memory held by rs
+func radialSetSize(rs *render.RadialSet) int64 {
+	size := int64(64)
+	for _, r := range rs.Radials {
+		size += 64 + 8*int64(cap(r.Gates))
+	}
+	return size
+}
+
+func (rc *RadialSetCacheManager) share(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	ch := rc.loads.DoChan(key, func() (interface{}, error) {
+		return fn(context.WithoutCancel(ctx))
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		return res.Val, res.Err
+	}
+}
+
+// Get returns the RadialSet for product at a single elevation of fn
+func (rc *RadialSetCacheManager) Get(ctx context.Context, fn, product string, elv int) (*render.RadialSet, error) {
+	key := radialSetKey{fn, product, elv}
+	if rs, ok := rc.sets.Get(key); ok {
+		return rs, nil
+	}
+
+	v, err := rc.share(ctx, fmt.Sprintf("%s/%s/%d", fn, product, elv), func(ctx context.Context) (interface{}, error) {
+		ar2, err := ChunkCache.GetFileWithElevation(ctx, fn, elv)
+		if err != nil {
+			return nil, err
+		}
+		rs, err := render.RadialSetFromLevel2(ar2.ElevationScans[elv], product)
+		if err != nil {
+			return nil, err
+		}
+		rc.sets.Put(key, rs)
+		return rs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*render.RadialSet), nil
+}
+
+// GetVolume returns the RadialSets for product at every elevation of fn which has it, in
+// elevation number order. Split cuts leave some products out of some sweeps (e.g. no velocity
+// in the surveillance cut, no dual pol in the Doppler cut), so those sweeps are skipped.
+func (rc *RadialSetCacheManager) GetVolume(ctx context.Context, fn, product string) (render.ElevationSet, error) {
+	// If we already know which elevations have product, try to avoid loading anything
+	if meta, ok := ChunkCache.meta.Get(fn); ok {
+		var elevations render.ElevationSet
+		cached := true
+		for _, s := range meta.Sweeps {
+			if !hasProduct(s.Products, product) {
+				continue
+			}
+			rs, ok := rc.sets.Get(radialSetKey{fn, product, s.ElevationNumber})
+			if !ok {
+				cached = false
+				break
+			}
+			elevations = append(elevations, rs)
+		}
+		if cached && len(elevations) > 0 {
+			return elevations, nil
+		}
+	}
+
+	v, err := rc.share(ctx, fmt.Sprintf("%s/%s/volume", fn, product), func(ctx context.Context) (interface{}, error) {
+		ar2, err := ChunkCache.GetFile(ctx, fn)
+		if err != nil {
+			return nil, err
+		}
+		return rc.volumeFromScans(fn, product, ar2.ElevationScans)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(render.ElevationSet), nil
+}
+
+// volumeFromScans returns the RadialSets for product of every elevation in scans which has
+// it, caching them as fn's
+func (rc *RadialSetCacheManager) volumeFromScans(fn, product string, scans map[int][]*archive2.Message31) (render.ElevationSet, error) {
+	elevations := make(render.ElevationSet, 0, len(scans))
+	for elv := 1; elv <= len(scans); elv++ {
+		key := radialSetKey{fn, product, elv}
+		rs, ok := rc.sets.Get(key)
+		if !ok {
+			if !hasProduct(render.Level2ProductsIn(scans[elv]), product) {
+				continue
+			}
+			var err error
+			rs, err = render.RadialSetFromLevel2(scans[elv], product)
+			if err != nil {
+				return nil, err
+			}
+			rc.sets.Put(key, rs)
+		}
+		elevations = append(elevations, rs)
+	}
+	if len(elevations) == 0 {
+		return nil, fmt.Errorf("no data for product %q in volume", product)
+	}
+	return elevations, nil
+}
+
+// hasProduct returns whether product is one of products
+func hasProduct(products []string, product string) bool {
+	for _, p := range products {
+		if p == product {
+			return true
+		}
+	}
+	return false
+}
+
+// GetVolumeProduct returns product (one of l2VolumeProducts) of fn, derived from the
+// reflectivity of every elevation
+func (rc *RadialSetCacheManager) GetVolumeProduct(ctx context.Context, fn, product string, opts l2RadialOptions) (*render.RadialSet, error) {
+	derive, ok := l2VolumeProducts[product]
+	if !ok {
+		return nil, fmt.Errorf("Invalid volume product %q", product)
+	}
+	variant := product
+	if product == "et" {
+		variant = fmt.Sprintf("et%g", opts.Threshold)
+	}
+	// not of any one elevation
+	key := radialSetKey{fn, variant, 0}
+	if rs, ok := rc.sets.Get(key); ok {
+		return rs, nil
+	}
+
+	v, err := rc.share(ctx, fmt.Sprintf("%s/%s", fn, variant), func(ctx context.Context) (interface{}, error) {
+		elevations, err := rc.GetVolume(ctx, fn, "ref")
+		if err != nil {
+			return nil, err
+		}
+		rs := derive(elevations, opts)
+		rc.sets.Put(key, rs)
+		return rs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*render.RadialSet), nil
+}
+
+// GetCAPPI returns the CAPPI of product (one stored in volumes) of fn at altitude meters above sea level
+func (rc *RadialSetCacheManager) GetCAPPI(ctx context.Context, fn, product string, altitude float64) (*render.RadialSet, error) {
+	variant := fmt.Sprintf("%s@%gm", product, altitude)
+	key := radialSetKey{fn, variant, 0}
+	if rs, ok := rc.sets.Get(key); ok {
+		return rs, nil
+	}
+
+	v, err := rc.share(ctx, fmt.Sprintf("%s/%s", fn, variant), func(ctx context.Context) (interface{}, error) {
+		elevations, err := rc.GetVolume(ctx, fn, product)
+		if err != nil {
+			return nil, err
+		}
+		rs := render.CAPPI(elevations, altitude)
+		rc.sets.Put(key, rs)
+		return rs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*render.RadialSet), nil
+}
+
+// dealiasedProduct is the cache key product for dealiased velocity
+const dealiasedProduct = "vel+dealias"
+
+// GetDealiased returns the velocity RadialSet at elv of fn with aliased velocities corrected.
+// The next lowest velocity sweep of the volume (itself dealiased) is used as a reference.
+func (rc *RadialSetCacheManager) GetDealiased(ctx context.Context, fn string, elv int) (*render.RadialSet, error) {
+	key := radialSetKey{fn, dealiasedProduct, elv}
+	if rs, ok := rc.sets.Get(key); ok {
+		return rs, nil
+	}
+
+	meta, _, err := ChunkCache.GetMeta(ctx, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := rc.share(ctx, fmt.Sprintf("%s/%s/%d", fn, dealiasedProduct, elv), func(ctx context.Context) (interface{}, error) {
+		rs, err := rc.Get(ctx, fn, "vel", elv)
+		if err != nil {
+			return nil, err
+		}
+
+		var prev *render.RadialSet
+		if prevElv := previousVelocitySweep(meta, elv); prevElv > 0 {
+			// best-effort: without a reference we still dealias, just less reliably
+			prev, _ = rc.GetDealiased(ctx, fn, prevElv)
+		}
+
+		d := render.Dealias(rs, prev)
+		rc.sets.Put(key, d)
+		return d, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*render.RadialSet), nil
+}
+
+// previousVelocitySweep returns the elevation number of the closest velocity sweep below elv
+// (at most 2 degrees lower, so it's still a useful reference), or 0 if there isn't one
+func previousVelocitySweep(meta Archive2Metadata, elv int) int {
+	var cur *SweepInfo
+	for i := range meta.Sweeps {
+		if meta.Sweeps[i].ElevationNumber == elv {
+			cur = &meta.Sweeps[i]
+		}
+	}
+	if cur == nil {
+		return 0
+	}
+
+	best := 0
+	bestAngle := -1.0
+	for _, s := range meta.Sweeps {
+		// only look at earlier sweeps, as SAILS repeats low tilts later in the volume
+		if s.ElevationNumber >= elv || s.ElevationAngle > cur.ElevationAngle || cur.ElevationAngle-s.ElevationAngle > 2 {
+			continue
+		}
+		// on ties prefer the later (closer in time) sweep
+		if hasProduct(s.Products, "vel") && s.ElevationAngle >= bestAngle {
+			best = s.ElevationNumber
+			bestAngle = s.ElevationAngle
+		}
+	}
+	return best
+}
+
+// Forget drops every cached RadialSet of fn (e.g. because the file changed)
+func (rc *RadialSetCacheManager) Forget(fn string) {
+	rc.sets.RemoveFunc(func(key radialSetKey) bool { return key.File == fn })
+}
+
+func (rc *RadialSetCacheManager) Stats() CacheStats {
+	return rc.sets.Stats()
+}
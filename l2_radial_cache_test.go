@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kallsyms/go-nexrad/archive2"
+)
+
+// testMoment returns a moment of n gates all at raw value 100
+func testMoment(n int) *archive2.DataMoment {
+	m := &archive2.DataMoment{Data: make([]byte, n)}
+	m.DataWordSize = 8
+	m.DataMomentRange = 2125
+	m.DataMomentRangeSampleInterval = 250
+	m.Scale = 2
+	m.Offset = 66
+	for i := range m.Data {
+		m.Data[i] = 100
+	}
+	return m
+}
+
+// testSweep returns a 360 radial sweep at angle with data for each of products
+func testSweep(elv int, angle float32, products ...string) []*archive2.Message31 {
+	var m31s []*archive2.Message31
+	for az := 0; az < 360; az++ {
+		m31 := &archive2.Message31{}
+		m31.Header.ElevationNumber = uint8(elv)
+		m31.Header.ElevationAngle = angle
+		m31.Header.AzimuthAngle = float32(az)
+		m31.Header.AzimuthResolutionSpacingCode = 2
+		for _, p := range products {
+			switch p {
+			case "ref":
+				m31.ReflectivityData = testMoment(100)
+			case "vel":
+				m31.VelocityData = testMoment(100)
+			case "sw":
+				m31.SwData = testMoment(100)
+			case "zdr":
+				m31.ZdrData = testMoment(100)
+			case "rho":
+				m31.RhoData = testMoment(100)
+			case "phi":
+				m31.PhiData = testMoment(100)
+			}
+		}
+		m31s = append(m31s, m31)
+	}
+	return m31s
+}
+
+func TestVolumeFromScansSplitCut(t *testing.T) {
+	// Split cuts at the two lowest angles (a surveillance sweep then a Doppler one), then batch cuts
+	scans := map[int][]*archive2.Message31{
+		1: testSweep(1, 0.5, "ref", "zdr", "rho", "phi"),
+		2: testSweep(2, 0.5, "vel", "sw"),
+		3: testSweep(3, 0.9, "ref", "zdr", "rho", "phi"),
+		4: testSweep(4, 0.9, "vel", "sw"),
+		5: testSweep(5, 1.3, "ref", "vel", "sw", "zdr", "rho", "phi"),
+	}
+
+	tests := []struct {
+		product string
+		angles  []float64
+	}{
+		{"ref", []float64{0.5, 0.9, 1.3}},
+		{"rho", []float64{0.5, 0.9, 1.3}},
+		{"vel", []float64{0.5, 0.9, 1.3}},
+		{"sw", []float64{0.5, 0.9, 1.3}},
+	}
+	for _, tt := range tests {
+		rc := NewRadialSetCacheManager(1 << 30)
+		elevations, err := rc.volumeFromScans("KTLX20240101_000000_V06", tt.product, scans)
+		if err != nil {
+			t.Errorf("%s: %v", tt.product, err)
+			continue
+		}
+		if len(elevations) != len(tt.angles) {
+			t.Errorf("%s: got %d elevations, want %d", tt.product, len(elevations), len(tt.angles))
+			continue
+		}
+		for i, rs := range elevations {
+			if float64(float32(tt.angles[i])) != rs.ElevationAngle {
+				t.Errorf("%s: elevation %d is at %g, want %g", tt.product, i, rs.ElevationAngle, tt.angles[i])
+			}
+			if len(rs.Radials) != 360 {
+				t.Errorf("%s: elevation %d has %d radials, want 360", tt.product, i, len(rs.Radials))
+			}
+		}
+
+		// and again from the cache
+		again, err := rc.volumeFromScans("KTLX20240101_000000_V06", tt.product, scans)
+		if err != nil || len(again) != len(elevations) {
+			t.Errorf("%s: cached volume has %d elevations (%v), want %d", tt.product, len(again), err, len(elevations))
+		}
+	}
+}
+
+func TestVolumeFromScansNoProduct(t *testing.T) {
+	scans := map[int][]*archive2.Message31{
+		1: testSweep(1, 0.5, "ref"),
+		2: testSweep(2, 0.9, "ref"),
+	}
+	rc := NewRadialSetCacheManager(1 << 30)
+	if _, err := rc.volumeFromScans("KTLX20240101_000000_V06", "vel", scans); err == nil {
+		t.Error("expected an error for a volume with no velocity")
+	}
+}
+
+// flakyL2Source serves the volume header of every file, but fails to open any other range.
+// It records the ranges asked for.
+type flakyL2Source struct {
+	mtx    sync.Mutex
+	ranges [][2]int64
+}
+
+func (s *flakyL2Source) ListSites(ctx context.Context, day time.Time) ([]string, error) {
+	return nil, nil
+}
+
+func (s *flakyL2Source) ListFiles(ctx context.Context, site string, day time.Time) ([]L2FileInfo, error) {
+	return nil, nil
+}
+
+func (s *flakyL2Source) Open(ctx context.Context, fn string) (io.ReadCloser, error) {
+	return nil, errors.New("not found")
+}
+
+func (s *flakyL2Source) OpenRange(ctx context.Context, fn string, start, end int64) (io.ReadCloser, error) {
+	s.mtx.Lock()
+	s.ranges = append(s.ranges, [2]int64{start, end})
+	s.mtx.Unlock()
+	if start == 0 {
+		return io.NopCloser(bytes.NewReader([]byte("AR2V0006.001\x00\x00\x4e\x20\x00\x00\x00\x00KTLX"))), nil
+	}
+	return nil, errors.New("connection reset")
+}
+
+func TestPartialSweepNotCached(t *testing.T) {
+	defer func(src L2Source, cc *Archive2ChunkCacheManager) { L2Data, ChunkCache = src, cc }(L2Data, ChunkCache)
+	L2Data = &flakyL2Source{}
+	ChunkCache = NewArchive2ChunkCacheManager(100, 0)
+
+	fn := "KTLX20240101_000000_V06"
+	ChunkCache.meta.Put(fn, Archive2Metadata{
+		LDMOffsets:      []int{24, 1000, 2000, 3000},
+		ElevationChunks: [][]int{{1000, 2000}},
+	})
+	if _, err := ChunkCache.GetFileWithElevation(context.Background(), fn, 1); err == nil {
+		t.Error("expected an error loading a sweep whose records fail to load")
+	}
+	rc := NewRadialSetCacheManager(1 << 30)
+	if _, err := rc.Get(context.Background(), fn, "ref", 1); err == nil {
+		t.Fatal("expected an error when records of the sweep fail to load")
+	}
+	if _, ok := rc.sets.Get(radialSetKey{fn, "ref", 1}); ok {
+		t.Error("partially loaded sweep was cached")
+	}
+}
+
+func TestLastRecordRangeBounded(t *testing.T) {
+	defer func(src L2Source, cc *Archive2ChunkCacheManager) { L2Data, ChunkCache = src, cc }(L2Data, ChunkCache)
+	src := &flakyL2Source{}
+	L2Data = src
+	ChunkCache = NewArchive2ChunkCacheManager(100, 0)
+
+	fn := "KTLX20240101_000000_V06"
+	ChunkCache.meta.Put(fn, Archive2Metadata{
+		Size:            3500,
+		LDMOffsets:      []int{24, 1000, 2000, 3000},
+		ElevationChunks: [][]int{{2000, 3000}},
+	})
+	ChunkCache.GetFileWithElevation(context.Background(), fn, 1)
+
+	last := false
+	for _, r := range src.ranges {
+		if r[1] < 0 {
+			t.Errorf("requested open-ended range from %d", r[0])
+		}
+		if r[0] == 3000 {
+			last = true
+			if r[1] != 3499 {
+				t.Errorf("last record requested up to %d, want 3499", r[1])
+			}
+		}
+	}
+	if !last {
+		t.Error("last record wasn't requested")
+	}
+}
@@ -144,13 +144,31 @@ func realtimeRenderHandler(c *gin.Context) {
 		return
 	}
 	lut := render.DefaultLUT(product)
+	target, err := parseTarget(c, r)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	format, err := parseRenderFormat(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	interp, err := parseInterp(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
 
-	pngFile, err := render.RenderAndReproject(c.Request.Context(), r, lut, 6000, 2600)
+	out, contentType, err := renderRadialSet(c.Request.Context(), r, lut, target, format, interp)
 	if err != nil {
+		if c.Request.Context().Err() == nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
 		return
 	}
-	png, _ := ioutil.ReadAll(pngFile)
-	pngFile.Close()
+	data, _ := ioutil.ReadAll(out)
+	out.Close()
 
-	c.Data(http.StatusOK, "image/png", png)
+	c.Data(http.StatusOK, contentType, data)
 }
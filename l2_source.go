@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const UNIDATA_L2_BUCKET = "unidata-nexrad-level2"
+
+// L2Source is anything that can list and serve Level 2 archive volumes.
+// Bucket-backed implementations are expected to lay files out the same way the unidata
+// bucket does, i.e. YYYY/MM/DD/SITE/SITEYYYYMMDD_HHMMSS_V06
+type L2Source interface {
+	// ListSites returns all sites which have at least one volume on the given (UTC) day
+	ListSites(ctx context.Context, day time.Time) ([]string, error)
+	// ListFiles returns all volumes for the site on the given (UTC) day
+	ListFiles(ctx context.Context, site string, day time.Time) ([]L2FileInfo, error)
+	// Open returns a reader for the entire volume
+	Open(ctx context.Context, fn string) (io.ReadCloser, error)
+	// OpenRange returns a reader for bytes [start, end] (inclusive) of the volume.
+	// An end of -1 reads through to EOF.
+	OpenRange(ctx context.Context, fn string, start, end int64) (io.ReadCloser, error)
+}
+
+type L2FileInfo struct {
+	Name         string
+	LastModified time.Time
+}
+
+// L2Data is the configured Level 2 source, set up in main
+var L2Data L2Source
+
+type L2SourceConfig struct {
+	// Kind is one of "unidata", "s3" or "local"
+	Kind string
+
+	// S3-compatible endpoint settings, used when Kind is "s3"
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3PathStyle bool
+	S3Anonymous bool
+
+	// Root of the directory tree, used when Kind is "local"
+	Dir string
+}
+
+func NewL2Source(cfg L2SourceConfig) (L2Source, error) {
+	switch cfg.Kind {
+	case "", "unidata":
+		return NewS3L2Source(S3L2SourceConfig{
+			Region:    "us-east-1",
+			Bucket:    UNIDATA_L2_BUCKET,
+			Anonymous: true,
+		})
+	case "s3":
+		if cfg.S3Bucket == "" {
+			return nil, errors.New("s3 L2 source requires a bucket")
+		}
+		region := cfg.S3Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		return NewS3L2Source(S3L2SourceConfig{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    region,
+			Bucket:    cfg.S3Bucket,
+			PathStyle: cfg.S3PathStyle,
+			Anonymous: cfg.S3Anonymous,
+		})
+	case "local":
+		return NewLocalL2Source(cfg.Dir)
+	default:
+		return nil, fmt.Errorf("Unknown L2 source %q", cfg.Kind)
+	}
+}
+
+// l2FileTime returns the volume start time encoded in the L2 filename fn
+func l2FileTime(fn string) (time.Time, error) {
+	// fn is like KOKX20210902_000428_V06
+	if len(fn) < 19 || fn != filepath.Base(fn) {
+		return time.Time{}, fmt.Errorf("Invalid L2 filename %q", fn)
+	}
+	return time.Parse("20060102_150405", fn[4:19])
+}
+
+// keyForL2File returns the path of fn relative to the root of the archive tree
+func keyForL2File(fn string) (string, error) {
+	date, err := l2FileTime(fn)
+	if err != nil {
+		return "", err
+	}
+	site := fn[:4]
+	return date.Format("2006/01/02/") + site + "/" + fn, nil
+}
+
+func validSite(site string) bool {
+	return site != "" && site != "." && site != ".." && !strings.ContainsAny(site, `/\`)
+}
+
+type S3L2SourceConfig struct {
+	// Endpoint overrides the AWS endpoint, e.g. for MinIO. Empty uses AWS.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	PathStyle bool
+	// Anonymous skips credential lookup entirely (for public buckets)
+	Anonymous bool
+}
+
+type S3L2Source struct {
+	svc    *s3.S3
+	bucket string
+}
+
+func NewS3L2Source(cfg S3L2SourceConfig) (*S3L2Source, error) {
+	awsCfg := &aws.Config{
+		Region:           aws.String(cfg.Region),
+		S3ForcePathStyle: aws.Bool(cfg.PathStyle),
+	}
+	if cfg.Endpoint != "" {
+		awsCfg.Endpoint = aws.String(cfg.Endpoint)
+	}
+	if cfg.Anonymous {
+		awsCfg.Credentials = credentials.AnonymousCredentials
+	}
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &S3L2Source{
+		svc:    s3.New(sess),
+		bucket: cfg.Bucket,
+	}, nil
+}
+
+func (s *S3L2Source) ListSites(ctx context.Context, day time.Time) ([]string, error) {
+	sites := make([]string, 0, 512)
+	var token *string
+	for {
+		resp, err := s.svc.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(s.bucket),
+			Prefix:            aws.String(day.Format("2006/01/02/")),
+			Delimiter:         aws.String("/"),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range resp.CommonPrefixes {
+			sites = append(sites, filepath.Base(*d.Prefix))
+		}
+		if resp.IsTruncated == nil || !*resp.IsTruncated {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+	return sites, nil
+}
+
+func (s *S3L2Source) ListFiles(ctx context.Context, site string, day time.Time) ([]L2FileInfo, error) {
+	if !validSite(site) {
+		return nil, fmt.Errorf("Invalid site %q", site)
+	}
+	prefix := day.Format("2006/01/02/") + site + "/"
+	var token *string
+	files := make([]L2FileInfo, 0, 1024)
+	for {
+		resp, err := s.svc.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(s.bucket),
+			Prefix:            aws.String(prefix),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range resp.Contents {
+			if o.Key == nil {
+				continue
+			}
+			fi := L2FileInfo{Name: filepath.Base(*o.Key)}
+			if o.LastModified != nil {
+				fi.LastModified = *o.LastModified
+			}
+			files = append(files, fi)
+		}
+		if resp.IsTruncated == nil || !*resp.IsTruncated {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+	return files, nil
+}
+
+func (s *S3L2Source) Open(ctx context.Context, fn string) (io.ReadCloser, error) {
+	return s.OpenRange(ctx, fn, 0, -1)
+}
+
+func (s *S3L2Source) OpenRange(ctx context.Context, fn string, start, end int64) (io.ReadCloser, error) {
+	key, err := keyForL2File(fn)
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if start > 0 || end >= 0 {
+		if end >= 0 {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", start, end))
+		} else {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-", start))
+		}
+	}
+	resp, err := s.svc.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// LocalL2Source serves volumes from a local directory tree, such as an LDM pqact
+// output tree. Volumes are found by filename anywhere under the root and new files
+// are picked up as soon as they are written.
+type LocalL2Source struct {
+	idx *LocalDirIndex
+}
+
+func NewLocalL2Source(root string) (*LocalL2Source, error) {
+	if root == "" {
+		return nil, errors.New("local L2 source requires a directory")
+	}
+	idx, err := localIndexFor(root)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalL2Source{idx: idx}, nil
+}
+
+// onDay matches L2 files whose filename timestamp falls on day
+func onDay(day time.Time) func(string, localFile) bool {
+	want := day.Format("20060102")
+	return func(name string, _ localFile) bool {
+		return name[4:12] == want
+	}
+}
+
+func (s *LocalL2Source) ListSites(ctx context.Context, day time.Time) ([]string, error) {
+	return s.idx.L2Sites(onDay(day)), nil
+}
+
+func (s *LocalL2Source) ListFiles(ctx context.Context, site string, day time.Time) ([]L2FileInfo, error) {
+	if !validSite(site) {
+		return nil, fmt.Errorf("Invalid site %q", site)
+	}
+	return s.idx.L2Files(site, onDay(day)), nil
+}
+
+func (s *LocalL2Source) Open(ctx context.Context, fn string) (io.ReadCloser, error) {
+	return s.OpenRange(ctx, fn, 0, -1)
+}
+
+func (s *LocalL2Source) OpenRange(ctx context.Context, fn string, start, end int64) (io.ReadCloser, error) {
+	lf, ok := s.idx.L2File(fn)
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", fn, os.ErrNotExist)
+	}
+	f, err := os.Open(lf.Path)
+	if err != nil {
+		return nil, err
+	}
+	return sectionReadCloser(f, start, end)
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// sectionReadCloser limits f to bytes [start, end] (inclusive, -1 for EOF), closing f when done
+func sectionReadCloser(f *os.File, start, end int64) (io.ReadCloser, error) {
+	if start > 0 {
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if end < 0 {
+		return f, nil
+	}
+	return limitedReadCloser{io.LimitReader(f, end-start+1), f}, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/kallsyms/radserv/diskcache"
+)
+
+// CachingL2Source keeps the raw bytes of volumes (and byte ranges of them) fetched from
+// another L2Source in a persistent disk cache. Archive volumes are immutable once
+// published, so entries never need to be invalidated, only evicted.
+type CachingL2Source struct {
+	L2Source
+	cache *diskcache.Cache
+}
+
+func NewCachingL2Source(src L2Source, cache *diskcache.Cache) *CachingL2Source {
+	return &CachingL2Source{
+		L2Source: src,
+		cache:    cache,
+	}
+}
+
+func rangeKey(fn string, start, end int64) string {
+	if start == 0 && end < 0 {
+		return fn
+	}
+	return fmt.Sprintf("%s@%d-%d", fn, start, end)
+}
+
+// cacheFillReader tees everything read from the source into the cache,
+// committing only if the source was read through to EOF
+type cacheFillReader struct {
+	src io.ReadCloser
+	w   *diskcache.Writer
+	err error
+	// drain reads whatever the consumer left unread on Close so the entry can still be
+	// committed. Only worth it for bounded ranges.
+	drain bool
+}
+
+func (r *cacheFillReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if n > 0 && r.err == nil {
+		_, r.err = r.w.Write(p[:n])
+	}
+	if err == io.EOF {
+		if r.err == nil {
+			r.w.Commit()
+		} else {
+			r.w.Abort()
+		}
+	}
+	return n, err
+}
+
+func (r *cacheFillReader) Close() error {
+	if r.drain && r.err == nil {
+		io.Copy(io.Discard, r)
+	}
+	// no-op if already committed
+	r.w.Abort()
+	return r.src.Close()
+}
+
+func (s *CachingL2Source) Open(ctx context.Context, fn string) (io.ReadCloser, error) {
+	return s.OpenRange(ctx, fn, 0, -1)
+}
+
+func (s *CachingL2Source) OpenRange(ctx context.Context, fn string, start, end int64) (io.ReadCloser, error) {
+	// If we have the whole volume, any range can be served from it
+	if f, ok := s.cache.Get(rangeKey(fn, 0, -1)); ok {
+		return sectionReadCloser(f, start, end)
+	}
+	key := rangeKey(fn, start, end)
+	if key != fn {
+		if f, ok := s.cache.Get(key); ok {
+			return f, nil
+		}
+	}
+
+	src, err := s.L2Source.OpenRange(ctx, fn, start, end)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.cache.NewWriter(key)
+	if err != nil {
+		// caching is best-effort
+		return src, nil
+	}
+	return &cacheFillReader{src: src, w: w, drain: end >= 0}, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestLocalL2Source returns a LocalL2Source over a temp dir holding files (path -> contents),
+// all written long enough ago to be indexed straight away
+func newTestLocalL2Source(t *testing.T, files map[string]string) *LocalL2Source {
+	t.Helper()
+	root := t.TempDir()
+	past := time.Now().Add(-time.Hour)
+	for path, data := range files {
+		full := filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(full, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := NewLocalL2Source(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.idx.Close()
+		delete(localIndexes, filepath.Clean(root))
+	})
+	return s
+}
+
+var testL2Files = map[string]string{
+	// the unidata bucket layout
+	"2024/05/20/KTLX/KTLX20240520_230512_V06": "0123456789",
+	"2024/05/20/KTLX/KTLX20240520_231015_V06": "abcdefghij",
+	// a flat pqact layout
+	"KOKX/KOKX20240520_120000_V06":     "kokx",
+	"KTLX/KTLX20240521_000133_V06.bz2": "next day",
+	// not volumes
+	"KTLX/README":                        "notes",
+	"KTLX/.KTLX20240520_000000_V06.part": "partial",
+}
+
+func TestLocalL2SourceList(t *testing.T) {
+	s := newTestLocalL2Source(t, testL2Files)
+	ctx := context.Background()
+	may20 := time.Date(2024, 5, 20, 0, 0, 0, 0, time.UTC)
+	may21 := may20.AddDate(0, 0, 1)
+
+	sites := []struct {
+		day  time.Time
+		want []string
+	}{
+		{may20, []string{"KOKX", "KTLX"}},
+		{may21, []string{"KTLX"}},
+		{may20.AddDate(0, 0, -1), []string{}},
+	}
+	for _, tt := range sites {
+		got, err := s.ListSites(ctx, tt.day)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ListSites(%s) = %v, %v; want %v", tt.day.Format("2006-01-02"), got, err, tt.want)
+		}
+	}
+
+	files := []struct {
+		site string
+		day  time.Time
+		want []string
+	}{
+		{"KTLX", may20, []string{"KTLX20240520_230512_V06", "KTLX20240520_231015_V06"}},
+		{"KTLX", may21, []string{"KTLX20240521_000133_V06.bz2"}},
+		{"KOKX", may21, []string{}},
+		{"KABX", may20, []string{}},
+	}
+	for _, tt := range files {
+		got, err := s.ListFiles(ctx, tt.site, tt.day)
+		if err != nil {
+			t.Errorf("ListFiles(%s, %s): %v", tt.site, tt.day.Format("2006-01-02"), err)
+			continue
+		}
+		names := []string{}
+		for _, f := range got {
+			names = append(names, f.Name)
+			if f.LastModified.IsZero() {
+				t.Errorf("ListFiles(%s): %s has no modification time", tt.site, f.Name)
+			}
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("ListFiles(%s, %s) = %v, want %v", tt.site, tt.day.Format("2006-01-02"), names, tt.want)
+		}
+	}
+
+	for _, site := range []string{"", "..", "KTLX/../KOKX"} {
+		if _, err := s.ListFiles(ctx, site, may20); err == nil {
+			t.Errorf("ListFiles(%q) succeeded, want an error", site)
+		}
+	}
+}
+
+func TestLocalL2SourceOpen(t *testing.T) {
+	s := newTestLocalL2Source(t, testL2Files)
+	ctx := context.Background()
+
+	tests := []struct {
+		fn         string
+		start, end int64
+		want       string
+	}{
+		{"KTLX20240520_230512_V06", 0, -1, "0123456789"},
+		{"KTLX20240520_230512_V06", 0, 3, "0123"},
+		{"KTLX20240520_230512_V06", 4, 4, "4"},
+		{"KTLX20240520_230512_V06", 6, -1, "6789"},
+		// past the end reads what there is
+		{"KTLX20240520_230512_V06", 8, 100, "89"},
+		{"KTLX20240520_231015_V06", 2, 5, "cdef"},
+		{"KOKX20240520_120000_V06", 0, -1, "kokx"},
+	}
+	for _, tt := range tests {
+		var r io.ReadCloser
+		var err error
+		if tt.start == 0 && tt.end == -1 {
+			r, err = s.Open(ctx, tt.fn)
+		} else {
+			r, err = s.OpenRange(ctx, tt.fn, tt.start, tt.end)
+		}
+		if err != nil {
+			t.Errorf("OpenRange(%s, %d, %d): %v", tt.fn, tt.start, tt.end, err)
+			continue
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(data) != tt.want {
+			t.Errorf("OpenRange(%s, %d, %d) = %q, %v; want %q", tt.fn, tt.start, tt.end, data, err, tt.want)
+		}
+	}
+
+	for _, fn := range []string{"KTLX20240520_000000_V06", "README", "KT"} {
+		if _, err := s.Open(ctx, fn); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Open(%q) = %v, want os.ErrNotExist", fn, err)
+		}
+	}
+}
+
+func TestKeyForL2File(t *testing.T) {
+	tests := []struct {
+		fn      string
+		want    string
+		wantErr bool
+	}{
+		{"KTLX20240520_230512_V06", "2024/05/20/KTLX/KTLX20240520_230512_V06", false},
+		{"KOKX20210902_000428_V06_MDM", "2021/09/02/KOKX/KOKX20210902_000428_V06_MDM", false},
+		{"KTLX2024", "", true},
+		{"2024/05/20/KTLX20240520_230512_V06", "", true},
+		{"KTLX20241340_230512_V06", "", true},
+	}
+	for _, tt := range tests {
+		got, err := keyForL2File(tt.fn)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("keyForL2File(%q) = %q, %v; want %q (error %v)", tt.fn, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kallsyms/radserv/render"
+)
+
+const (
+	// Cells used to estimate storm motion are regions of at least this reflectivity on the lowest tilt...
+	stormCellThreshold = 35.0
+	// ...covering at least this many square meters
+	stormCellMinArea = 20e6
+	// Don't track cells across volumes further apart than this
+	maxTrackingGap = 20 * time.Minute
+)
+
+var errNoStormMotion = errors.New("Could not estimate storm motion, pass u,v or dir,speed")
+
+// Estimated storm motion per L2 file
+var stormMotions = newLRUCache[string, render.Motion](4096, 0, nil)
+
+// stormMotionParams parses an explicit storm motion in m/s given as either u,v (the
+// eastward and northward components) or dir,speed (the direction it's coming from).
+// Returns nil if neither were given.
+func stormMotionParams(c *gin.Context) (*render.Motion, error) {
+	parse := func(a, b string) (float64, float64, bool, error) {
+		as, aok := c.GetQuery(a)
+		bs, bok := c.GetQuery(b)
+		if !aok && !bok {
+			return 0, 0, false, nil
+		}
+		x, err := strconv.ParseFloat(as, 64)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("Invalid %s", a)
+		}
+		y, err := strconv.ParseFloat(bs, 64)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("Invalid %s", b)
+		}
+		return x, y, true, nil
+	}
+
+	u, v, ok, err := parse("u", "v")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return &render.Motion{U: u, V: v}, nil
+	}
+	dir, speed, ok, err := parse("dir", "speed")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		m := render.MotionFromDirection(dir, speed)
+		return &m, nil
+	}
+	return nil, nil
+}
+
+// previousL2File finds the volume of site immediately before fn, returning it and how much earlier it started
+func previousL2File(ctx context.Context, site, fn string) (string, time.Duration, error) {
+	t, err := l2FileTime(fn)
+	if err != nil {
+		return "", 0, err
+	}
+
+	prev := ""
+	var prevTime time.Time
+	days := []time.Time{t}
+	// the previous volume may have been on the previous day
+	if earlier := t.Add(-maxTrackingGap); earlier.Day() != t.Day() {
+		days = append(days, earlier)
+	}
+	for _, day := range days {
+		files, err := L2Data.ListFiles(ctx, site, day)
+		if err != nil {
+			return "", 0, err
+		}
+		for _, f := range files {
+			if isMDMFile(f.Name) {
+				continue
+			}
+			ft, err := l2FileTime(f.Name)
+			if err != nil || !ft.Before(t) || t.Sub(ft) > maxTrackingGap {
+				continue
+			}
+			if prev == "" || ft.After(prevTime) {
+				prev = f.Name
+				prevTime = ft
+			}
+		}
+	}
+	if prev == "" {
+		return "", 0, errNoStormMotion
+	}
+	return prev, t.Sub(prevTime), nil
+}
+
+// lowestCells finds storm cells on the lowest tilt with reflectivity of fn
+func lowestCells(ctx context.Context, fn string) ([]render.Cell, error) {
+	meta, _, err := ChunkCache.GetMeta(ctx, fn)
+	if err != nil {
+		return nil, err
+	}
+	elv := 0
+	lowest := math.Inf(1)
+	for _, s := range meta.Sweeps {
+		for _, p := range s.Products {
+			if p == "ref" && s.ElevationAngle < lowest {
+				elv = s.ElevationNumber
+				lowest = s.ElevationAngle
+			}
+		}
+	}
+	if elv == 0 {
+		return nil, errNoStormMotion
+	}
+
+	rs, err := RadialCache.Get(ctx, fn, "ref", elv)
+	if err != nil {
+		return nil, err
+	}
+	return render.FindCells(rs, stormCellThreshold, stormCellMinArea), nil
+}
+
+// estimateStormMotion estimates the mean storm motion at the time of fn by tracking
+// cells between the previous volume and fn
+func estimateStormMotion(ctx context.Context, site, fn string) (render.Motion, error) {
+	if m, ok := stormMotions.Get(fn); ok {
+		return m, nil
+	}
+
+	prev, dt, err := previousL2File(ctx, site, fn)
+	if err != nil {
+		return render.Motion{}, err
+	}
+	prevCells, err := lowestCells(ctx, prev)
+	if err != nil {
+		return render.Motion{}, err
+	}
+	cells, err := lowestCells(ctx, fn)
+	if err != nil {
+		return render.Motion{}, err
+	}
+
+	m, ok := render.TrackCells(prevCells, cells, dt)
+	if !ok {
+		return render.Motion{}, errNoStormMotion
+	}
+	stormMotions.Put(fn, m)
+	return m, nil
+}
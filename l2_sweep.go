@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kallsyms/radserv/render"
+)
+
+var errNoSweep = errors.New("No matching sweep")
+
+// Sweeps further than this from the requested angle never match
+const maxAngleDifference = 0.5
+
+// sweepSelector picks the sweep(s) of a volume a request refers to, either by elevation
+// number (the :elv path parameter) or by elevation angle (?angle=&which=).
+// With ?altitude= it instead refers to a CAPPI made from every sweep.
+type sweepSelector struct {
+	// Elevation number, or 0 to select by Angle
+	Elevation int
+	Angle     float64
+	// "latest", "first" or "all" of the sweeps at Angle
+	Which string
+	// Whether this is a CAPPI at Altitude (meters above sea level)
+	CAPPI    bool
+	Altitude float64
+}
+
+func parseSweepSelector(c *gin.Context) (sweepSelector, error) {
+	if _, ok := l2VolumeProducts[render.CanonicalProduct(strings.ToLower(c.Param("product")))]; ok {
+		// made from every sweep, so there's nothing to select
+		return sweepSelector{Which: "latest"}, nil
+	}
+	if elvParam := c.Param("elv"); elvParam != "" {
+		elv, err := strconv.Atoi(elvParam)
+		if err != nil || elv < 1 {
+			return sweepSelector{}, errors.New("Invalid elv")
+		}
+		return sweepSelector{Elevation: elv}, nil
+	}
+
+	if s, ok := c.GetQuery("altitude"); ok {
+		alt, err := strconv.ParseFloat(s, 64)
+		if err != nil || alt < -500 || alt > 25000 {
+			return sweepSelector{}, errors.New("Invalid altitude, expected meters above sea level")
+		}
+		return sweepSelector{Which: "latest", CAPPI: true, Altitude: alt}, nil
+	}
+
+	angle, err := strconv.ParseFloat(c.Query("angle"), 64)
+	if err != nil {
+		return sweepSelector{}, errors.New("Invalid or missing angle")
+	}
+	which := c.DefaultQuery("which", "latest")
+	switch which {
+	case "latest", "first", "all":
+	default:
+		return sweepSelector{}, fmt.Errorf("Invalid which %q, expected latest, first or all", which)
+	}
+	return sweepSelector{Angle: angle, Which: which}, nil
+}
+
+// sweepHasProduct returns whether the sweep has the data needed for product
+func sweepHasProduct(s SweepInfo, product string) bool {
+	base := l2BaseProduct(product)
+	for _, p := range s.Products {
+		if p == base {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSweeps returns the elevation numbers of fn sel refers to which have product, in volume order
+func resolveSweeps(ctx context.Context, fn, product string, sel sweepSelector) ([]int, error) {
+	if sel.Elevation != 0 {
+		return []int{sel.Elevation}, nil
+	}
+
+	meta, _, err := ChunkCache.GetMeta(ctx, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Actual angles wobble a bit around the VCP's, so take the closest angle that's
+	// reasonably near and all the sweeps at it
+	closest := math.Inf(1)
+	for _, s := range meta.Sweeps {
+		if sweepHasProduct(s, product) {
+			closest = math.Min(closest, math.Abs(s.ElevationAngle-sel.Angle))
+		}
+	}
+	if closest > maxAngleDifference {
+		return nil, errNoSweep
+	}
+
+	elvs := []int{}
+	for _, s := range meta.Sweeps {
+		if sweepHasProduct(s, product) && math.Abs(s.ElevationAngle-sel.Angle) <= closest+0.1 {
+			elvs = append(elvs, s.ElevationNumber)
+		}
+	}
+
+	switch sel.Which {
+	case "first":
+		return elvs[:1], nil
+	case "latest":
+		return elvs[len(elvs)-1:], nil
+	}
+	return elvs, nil
+}
+
+// Frame is one low level scan of a volume: the one at the start of the volume, or one of the
+// supplemental ones inserted by SAILS/MESO-SAILS. Animating frames gives the true low level
+// update rate rather than the volume rate.
+type Frame struct {
+	Start          time.Time
+	End            time.Time
+	ElevationAngle float64
+	Supplemental   bool
+	// For each product, the elevation number holding it in this frame.
+	// Split cuts scan the lowest angle twice back to back (once for reflectivity, once for
+	// velocity), so a frame can span several elevation numbers.
+	Elevations map[string]int
+}
+
+// lowLevelFrames returns the low level frames of a volume in time order
+func lowLevelFrames(meta Archive2Metadata) []Frame {
+	if len(meta.Sweeps) == 0 {
+		return nil
+	}
+	lowest := meta.Sweeps[0].ElevationAngle
+	for _, s := range meta.Sweeps {
+		lowest = math.Min(lowest, s.ElevationAngle)
+	}
+
+	frames := []Frame{}
+	var cur *Frame
+	lastElv := 0
+	for _, s := range meta.Sweeps {
+		if s.ElevationAngle-lowest > sameAngleTolerance {
+			cur = nil
+			continue
+		}
+		// consecutive low sweeps are parts of the same split cut
+		if cur == nil || s.ElevationNumber != lastElv+1 {
+			frames = append(frames, Frame{
+				Start:          s.Time,
+				End:            s.EndTime,
+				ElevationAngle: s.ElevationAngle,
+				Supplemental:   s.Supplemental,
+				Elevations:     map[string]int{},
+			})
+			cur = &frames[len(frames)-1]
+		}
+		if s.Time.Before(cur.Start) {
+			cur.Start = s.Time
+		}
+		if s.EndTime.After(cur.End) {
+			cur.End = s.EndTime
+		}
+		for _, p := range s.Products {
+			// in a split cut the first (long PRT surveillance) sweep has the best reflectivity
+			if _, ok := cur.Elevations[p]; !ok {
+				cur.Elevations[p] = s.ElevationNumber
+			}
+		}
+		lastElv = s.ElevationNumber
+	}
+	return frames
+}
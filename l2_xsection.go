@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kallsyms/radserv/render"
+)
+
+const (
+	// Largest number of columns or levels in a cross section
+	maxXSectionSize = 4096
+	// Default top of a cross section in meters above sea level
+	defaultXSectionTop = 18000.0
+)
+
+// parseLatLon parses the lat,lon query param
+func parseLatLon(c *gin.Context, param string) ([2]float64, error) {
+	parts := strings.Split(c.Query(param), ",")
+	if len(parts) == 2 {
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		lon, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err1 == nil && err2 == nil && math.Abs(lat) <= 90 && math.Abs(lon) <= 180 {
+			return [2]float64{lat, lon}, nil
+		}
+	}
+	return [2]float64{}, fmt.Errorf("Invalid or missing %s, expected lat,lon", param)
+}
+
+// parseXSectionSize parses a cross section dimension param
+func parseXSectionSize(c *gin.Context, param string, def int) (int, error) {
+	s := c.Query(param)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 2 || n > maxXSectionSize {
+		return 0, fmt.Errorf("Invalid %s, expected 2-%d", param, maxXSectionSize)
+	}
+	return n, nil
+}
+
+// l2FileXSectionHandler serves /:product/xsection?start=lat,lon&end=lat,lon, a vertical cross
+// section through the volume as a PNG (distance along the line across, height up) or JSON
+func l2FileXSectionHandler(c *gin.Context) {
+	fn := c.Param("fn")
+	product := render.CanonicalProduct(strings.ToLower(c.Param("product")))
+	if !isLevel2Product(product) {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Product %q can't be cross sectioned", product))
+		return
+	}
+	start, err := parseLatLon(c, "start")
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	end, err := parseLatLon(c, "end")
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	columns, err := parseXSectionSize(c, "width", 800)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	levels, err := parseXSectionSize(c, "height", 400)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	bottom, top := 0.0, defaultXSectionTop
+	if s := c.Query("bottom"); s != "" {
+		if bottom, err = strconv.ParseFloat(s, 64); err != nil {
+			c.AbortWithError(http.StatusBadRequest, errors.New("Invalid bottom"))
+			return
+		}
+	}
+	if s := c.Query("top"); s != "" {
+		if top, err = strconv.ParseFloat(s, 64); err != nil {
+			c.AbortWithError(http.StatusBadRequest, errors.New("Invalid top"))
+			return
+		}
+	}
+	if top <= bottom {
+		c.AbortWithError(http.StatusBadRequest, errors.New("top must be above bottom"))
+		return
+	}
+	format := strings.ToLower(c.DefaultQuery("format", "png"))
+	if format != "png" && format != "json" {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Invalid format %q, expected png or json", format))
+		return
+	}
+	interp, err := parseInterp(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	// level centers, evenly spaced from bottom to top
+	heights := make([]float64, levels)
+	for i := range heights {
+		heights[i] = bottom + (float64(i)+0.5)*(top-bottom)/float64(levels)
+	}
+
+	elevations, err := RadialCache.GetVolume(c.Request.Context(), fn, product)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	x, err := render.NewCrossSection(c.Request.Context(), elevations, start, end, columns, heights, interp)
+	if err != nil {
+		if c.Request.Context().Err() == nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	setFileCacheHeaders(c)
+	if format == "json" {
+		c.JSON(http.StatusOK, x)
+		return
+	}
+	lut := render.DefaultLUT(product)
+	if _, ok := c.GetQuery("nolut"); ok {
+		lut = render.DefaultLUT("")
+	}
+	out, err := x.PNG(lut)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	data, _ := ioutil.ReadAll(out)
+	out.Close()
+	c.Data(http.StatusOK, "image/png", data)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const L3_BUCKET = "gcp-public-data-nexrad-l3-realtime"
+const L3_ARCHIVE_BUCKET = "gcp-public-data-nexrad-l3"
+
+// L3Source is anything that can list and serve Level 3 products.
+// "Realtime" methods cover the most recent products, "Archive" methods a given (UTC) day.
+type L3Source interface {
+	ListSites(ctx context.Context) ([]string, error)
+	ListProducts(ctx context.Context, site string) ([]string, error)
+	ListFiles(ctx context.Context, site, product string) ([]string, error)
+	Open(ctx context.Context, site, product, fn string) (io.ReadCloser, error)
+
+	ListArchiveFiles(ctx context.Context, site, product string, day time.Time) ([]string, error)
+	OpenArchive(ctx context.Context, site, product, fn string, day time.Time) (io.ReadCloser, error)
+}
+
+// L3Data is the configured Level 3 source, set up in main
+var L3Data L3Source
+
+type L3SourceConfig struct {
+	// Kind is one of "gcs" or "local"
+	Kind string
+	// Root of the SITE/PRODUCT tree, used when Kind is "local"
+	Dir string
+}
+
+func NewL3Source(cfg L3SourceConfig) (L3Source, error) {
+	switch cfg.Kind {
+	case "", "gcs":
+		return &GCSL3Source{}, nil
+	case "local":
+		return NewLocalL3Source(cfg.Dir)
+	default:
+		return nil, fmt.Errorf("Unknown L3 source %q", cfg.Kind)
+	}
+}
+
+// GCSL3Source reads from the public NEXRAD L3 buckets on GCS
+type GCSL3Source struct{}
+
+func newGCSClient(ctx context.Context) (*storage.Client, error) {
+	return storage.NewClient(ctx, option.WithCredentialsFile("service_account.json"))
+}
+
+func listGCS(ctx context.Context, bucket *storage.BucketHandle, prefix string) ([]string, []string) {
+	blobs := []string{}
+	dirs := []string{}
+
+	it := bucket.Objects(ctx, &storage.Query{
+		Prefix:    prefix,
+		Delimiter: "/",
+	})
+
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			logrus.Errorf("Bucket.Objects: %v", err)
+			break
+		}
+		if attrs.Prefix != "" {
+			dirs = append(dirs, filepath.Base(attrs.Prefix))
+		} else {
+			blobs = append(blobs, filepath.Base(attrs.Name))
+		}
+	}
+
+	return blobs, dirs
+}
+
+func (s *GCSL3Source) ListSites(ctx context.Context) ([]string, error) {
+	client, err := newGCSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	_, sites := listGCS(ctx, client.Bucket(L3_BUCKET), "NIDS/")
+	return sites, nil
+}
+
+func (s *GCSL3Source) ListProducts(ctx context.Context, site string) ([]string, error) {
+	client, err := newGCSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	_, products := listGCS(ctx, client.Bucket(L3_BUCKET), "NIDS/"+site+"/")
+	return products, nil
+}
+
+func (s *GCSL3Source) ListFiles(ctx context.Context, site, product string) ([]string, error) {
+	client, err := newGCSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	files, _ := listGCS(ctx, client.Bucket(L3_BUCKET), "NIDS/"+site+"/"+product+"/")
+	return files, nil
+}
+
+type gcsReadCloser struct {
+	*storage.Reader
+	client *storage.Client
+}
+
+func (r gcsReadCloser) Close() error {
+	r.Reader.Close()
+	return r.client.Close()
+}
+
+func (s *GCSL3Source) Open(ctx context.Context, site, product, fn string) (io.ReadCloser, error) {
+	client, err := newGCSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := client.Bucket(L3_BUCKET).Object("NIDS/" + site + "/" + product + "/" + fn).NewReader(ctx)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return gcsReadCloser{reader, client}, nil
+}
+
+// walkArchive calls fn for every regular file in the day's archive tarball for site,
+// stopping early if fn returns false
+func (s *GCSL3Source) walkArchive(ctx context.Context, site string, day time.Time, fn func(hdr *tar.Header, r io.Reader) bool) error {
+	client, err := newGCSClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Construct archive tarball path: YYYY/MM/DD/<SITE4>/NWS_NEXRAD_NXL3_<SITE4>_<YYYYMMDD>000000_<YYYYMMDD>235959.tar.gz
+	site4 := strings.ToUpper(site)
+	if len(site4) == 3 {
+		site4 = "K" + site4
+	}
+	tarObj := fmt.Sprintf("%04d/%02d/%02d/%s/NWS_NEXRAD_NXL3_%s_%s000000_%s235959.tar.gz",
+		day.Year(), day.Month(), day.Day(), site4, site4, day.Format("20060102"), day.Format("20060102"))
+
+	rc, err := client.Bucket(L3_ARCHIVE_BUCKET).Object(tarObj).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if !fn(hdr, tr) {
+			return nil
+		}
+	}
+}
+
+func (s *GCSL3Source) ListArchiveFiles(ctx context.Context, site, product string, day time.Time) ([]string, error) {
+	files := []string{}
+	err := s.walkArchive(ctx, site, day, func(hdr *tar.Header, _ io.Reader) bool {
+		base := filepath.Base(hdr.Name)
+		// Expect filenames like KOHX_SDUS84_N3HOHX_YYYYMMDDHHMM
+		parts := strings.Split(base, "_")
+		if len(parts) < 3 {
+			return true
+		}
+		prodSite := parts[2] // e.g., N3HOHX
+		if len(prodSite) < 3 {
+			return true
+		}
+		code := prodSite[0:3]
+		if strings.EqualFold(code, product) {
+			files = append(files, base)
+		}
+		return true
+	})
+	return files, err
+}
+
+func (s *GCSL3Source) OpenArchive(ctx context.Context, site, product, fn string, day time.Time) (io.ReadCloser, error) {
+	var data []byte
+	var readErr error
+	err := s.walkArchive(ctx, site, day, func(hdr *tar.Header, r io.Reader) bool {
+		if filepath.Base(hdr.Name) != fn {
+			return true
+		}
+		data, readErr = ioutil.ReadAll(r)
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%q: %w", fn, os.ErrNotExist)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// LocalL3Source serves products from a local SITE/PRODUCT/<file> tree (e.g. LDM pqact output),
+// picking up new files as soon as they are written.
+type LocalL3Source struct {
+	idx *LocalDirIndex
+}
+
+func NewLocalL3Source(root string) (*LocalL3Source, error) {
+	if root == "" {
+		return nil, errors.New("local L3 source requires a directory")
+	}
+	idx, err := localIndexFor(root)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalL3Source{idx: idx}, nil
+}
+
+// l3FileTime returns the product time encoded at the end of the filename
+// (e.g. KOHX_SDUS84_N3HOHX_202109020004 or N0Q_20210902_0004), falling back to the mtime.
+func l3FileTime(name string, f localFile) time.Time {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, name)
+	if len(digits) >= 12 {
+		if t, err := time.Parse("200601021504", digits[len(digits)-12:]); err == nil {
+			return t
+		}
+	}
+	return f.ModTime.UTC()
+}
+
+func (s *LocalL3Source) ListSites(ctx context.Context) ([]string, error) {
+	return s.idx.L3Sites(), nil
+}
+
+func (s *LocalL3Source) ListProducts(ctx context.Context, site string) ([]string, error) {
+	return s.idx.L3Products(site), nil
+}
+
+func (s *LocalL3Source) ListFiles(ctx context.Context, site, product string) ([]string, error) {
+	return s.idx.L3Files(site, product, func(string, localFile) bool { return true }), nil
+}
+
+func (s *LocalL3Source) Open(ctx context.Context, site, product, fn string) (io.ReadCloser, error) {
+	lf, ok := s.idx.L3File(site, product, fn)
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", fn, os.ErrNotExist)
+	}
+	return os.Open(lf.Path)
+}
+
+func (s *LocalL3Source) ListArchiveFiles(ctx context.Context, site, product string, day time.Time) ([]string, error) {
+	want := day.Format("20060102")
+	return s.idx.L3Files(site, product, func(name string, f localFile) bool {
+		return l3FileTime(name, f).Format("20060102") == want
+	}), nil
+}
+
+func (s *LocalL3Source) OpenArchive(ctx context.Context, site, product, fn string, day time.Time) (io.ReadCloser, error) {
+	return s.Open(ctx, site, product, fn)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// How long a file has to go unchanged before the indexes localIndexFor creates pick it up, so
+// volumes and products aren't served while they're still being written (set with -local-settle-time).
+// LDM appends each chunk of a Level 2 volume as it arrives, so a volume can sit unchanged for a
+// while between chunks. If it's indexed during a longer pause, the next write takes it back
+// out and drops anything cached from it until it settles again.
+var settleTime = 30 * time.Second
+
+// pendingFile is a file waiting to settle
+type pendingFile struct {
+	timer *time.Timer
+}
+
+type localFile struct {
+	Path    string
+	ModTime time.Time
+}
+
+// indexedFile identifies a file in the index. For L2 files, Product is empty.
+type indexedFile struct {
+	Site    string
+	Product string
+	Name    string
+}
+
+// localDirCaches are the caches data from indexed files is dropped from when they change.
+// Any of them may be nil.
+type localDirCaches struct {
+	chunks  *Archive2ChunkCacheManager
+	radials *RadialSetCacheManager
+	tiles   *lruCache[string, []byte]
+}
+
+// LocalDirIndex keeps an in-memory listing of the radar files under a directory tree
+// (e.g. an LDM pqact output tree), kept up to date with fsnotify.
+//
+// Level 2 volumes are recognized anywhere in the tree by their filename (SITEYYYYMMDD_HHMMSS...).
+// Level 3 products are expected to live at .../SITE/PRODUCT/<file>, the same as the NIDS
+// layout of the realtime GCS bucket.
+type LocalDirIndex struct {
+	root       string
+	settleTime time.Duration
+	caches     localDirCaches
+	watcher    *fsnotify.Watcher
+	// closed once watch returns
+	done chan struct{}
+
+	mtx sync.RWMutex
+	// site -> filename
+	l2 map[string]map[string]localFile
+	// site -> product -> filename
+	l3 map[string]map[string]map[string]localFile
+
+	pendingMtx sync.Mutex
+	// files waiting to settle before they're indexed
+	pending map[string]*pendingFile
+	// settle timers which haven't been stopped or finished running
+	settling sync.WaitGroup
+	closed   bool
+}
+
+var localIndexes = map[string]*LocalDirIndex{}
+
+// localIndexFor returns the (shared) index for root, creating and starting it if needed.
+// It waits settleTime for files to settle and drops changed files from the global caches.
+func localIndexFor(root string) (*LocalDirIndex, error) {
+	root = filepath.Clean(root)
+	if idx, ok := localIndexes[root]; ok {
+		return idx, nil
+	}
+	idx, err := NewLocalDirIndex(root, settleTime, localDirCaches{ChunkCache, RadialCache, TileCache})
+	if err != nil {
+		return nil, err
+	}
+	localIndexes[root] = idx
+	return idx, nil
+}
+
+// NewLocalDirIndex indexes root, only picking files up once they've gone settle without
+// changing, and dropping files from caches when they change after that
+func NewLocalDirIndex(root string, settle time.Duration, caches localDirCaches) (*LocalDirIndex, error) {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, &fs.PathError{Op: "index", Path: root, Err: fs.ErrInvalid}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &LocalDirIndex{
+		root:       root,
+		settleTime: settle,
+		caches:     caches,
+		watcher:    watcher,
+		done:       make(chan struct{}),
+		l2:         make(map[string]map[string]localFile),
+		l3:         make(map[string]map[string]map[string]localFile),
+		pending:    make(map[string]*pendingFile),
+	}
+	// Start watching before the initial scan so nothing created in between is missed
+	go idx.watch()
+	idx.scan(root)
+
+	return idx, nil
+}
+
+// Close stops watching, returning once nothing is left running in the background
+func (idx *LocalDirIndex) Close() error {
+	idx.pendingMtx.Lock()
+	idx.closed = true
+	for path, p := range idx.pending {
+		idx.stopLocked(p)
+		delete(idx.pending, path)
+	}
+	idx.pendingMtx.Unlock()
+	err := idx.watcher.Close()
+	<-idx.done
+	idx.settling.Wait()
+	return err
+}
+
+// scan walks dir, watching every directory and indexing every file in it
+func (idx *LocalDirIndex) scan(dir string) {
+	n := 0
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			logrus.Warnf("localdir: %v", err)
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if err := idx.watcher.Add(path); err != nil {
+				logrus.Warnf("localdir: watch %q: %v", path, err)
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if time.Since(info.ModTime()) < idx.settleTime {
+			// may still be being written
+			idx.settle(path, info)
+		} else if idx.add(path, info) {
+			n++
+		}
+		return nil
+	})
+	logrus.Debugf("localdir: indexed %d files under %q", n, dir)
+}
+
+func (idx *LocalDirIndex) watch() {
+	defer close(idx.done)
+	for {
+		select {
+		case ev, ok := <-idx.watcher.Events:
+			if !ok {
+				return
+			}
+			switch {
+			case ev.Has(fsnotify.Create), ev.Has(fsnotify.Write):
+				info, err := os.Stat(ev.Name)
+				if err != nil {
+					continue
+				}
+				if info.IsDir() {
+					// fsnotify isn't recursive, so pick up the new directory (and anything
+					// that was written into it before we started watching it)
+					idx.scan(ev.Name)
+				} else {
+					// being (re)written, so it isn't final until it settles again.
+					// Removed first, as with no settle time it may be re-added straight away.
+					idx.forgetCached(idx.remove(ev.Name))
+					idx.settle(ev.Name, info)
+				}
+			case ev.Has(fsnotify.Remove), ev.Has(fsnotify.Rename):
+				idx.unsettle(ev.Name)
+				idx.forgetCached(idx.remove(ev.Name))
+			}
+		case err, ok := <-idx.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("localdir: watcher error: %v", err)
+		}
+	}
+}
+
+// settle indexes path once it's gone settleTime without changing from info, restarting the
+// wait if it was already pending
+func (idx *LocalDirIndex) settle(path string, info fs.FileInfo) {
+	if !info.Mode().IsRegular() {
+		return
+	}
+	idx.pendingMtx.Lock()
+	defer idx.pendingMtx.Unlock()
+	idx.settleLocked(path, info)
+}
+
+// settleLocked is settle with pendingMtx held
+func (idx *LocalDirIndex) settleLocked(path string, info fs.FileInfo) {
+	if p, ok := idx.pending[path]; ok {
+		idx.stopLocked(p)
+	}
+	if idx.closed {
+		return
+	}
+	p := &pendingFile{}
+	idx.settling.Add(1)
+	p.timer = time.AfterFunc(idx.settleTime, func() {
+		defer idx.settling.Done()
+		idx.settled(path, info, p)
+	})
+	idx.pending[path] = p
+}
+
+// stopLocked stops p's timer, if it hasn't fired yet. pendingMtx must be held.
+func (idx *LocalDirIndex) stopLocked(p *pendingFile) {
+	if p.timer.Stop() {
+		idx.settling.Done()
+	}
+}
+
+// settled indexes path if it hasn't changed since info, as long as p is still its latest wait.
+// pendingMtx is held throughout so a write racing with this is always seen afterwards.
+func (idx *LocalDirIndex) settled(path string, info fs.FileInfo, p *pendingFile) {
+	now, err := os.Stat(path)
+
+	idx.pendingMtx.Lock()
+	defer idx.pendingMtx.Unlock()
+	if idx.pending[path] != p {
+		return
+	}
+	delete(idx.pending, path)
+
+	switch {
+	case err != nil:
+	case now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime()):
+		// changed without an event (e.g. one was dropped), so wait again
+		idx.settleLocked(path, now)
+	default:
+		idx.add(path, now)
+	}
+}
+
+// unsettle stops waiting on path, which may be a file or a whole directory
+func (idx *LocalDirIndex) unsettle(path string) {
+	prefix := path + string(filepath.Separator)
+	idx.pendingMtx.Lock()
+	defer idx.pendingMtx.Unlock()
+	for name, p := range idx.pending {
+		if name == path || strings.HasPrefix(name, prefix) {
+			idx.stopLocked(p)
+			delete(idx.pending, name)
+		}
+	}
+}
+
+// classify works out what kind of radar file path is.
+// For L2 files, product is empty.
+func (idx *LocalDirIndex) classify(path string) (site, product, name string, ok bool) {
+	name = filepath.Base(path)
+	if strings.HasPrefix(name, ".") {
+		return "", "", "", false
+	}
+	if _, err := keyForL2File(name); err == nil {
+		return name[:4], "", name, true
+	}
+	rel, err := filepath.Rel(idx.root, path)
+	if err != nil {
+		return "", "", "", false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) < 3 {
+		return "", "", "", false
+	}
+	return parts[len(parts)-3], parts[len(parts)-2], name, true
+}
+
+func (idx *LocalDirIndex) add(path string, info fs.FileInfo) bool {
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	site, product, name, ok := idx.classify(path)
+	if !ok {
+		return false
+	}
+	f := localFile{Path: path, ModTime: info.ModTime()}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	if product == "" {
+		if idx.l2[site] == nil {
+			idx.l2[site] = make(map[string]localFile)
+		}
+		idx.l2[site][name] = f
+	} else {
+		if idx.l3[site] == nil {
+			idx.l3[site] = make(map[string]map[string]localFile)
+		}
+		if idx.l3[site][product] == nil {
+			idx.l3[site][product] = make(map[string]localFile)
+		}
+		idx.l3[site][product][name] = f
+	}
+	return true
+}
+
+// remove drops path from the index, returning what was dropped. path may be a file or a
+// whole directory.
+func (idx *LocalDirIndex) remove(path string) []indexedFile {
+	prefix := path + string(filepath.Separator)
+	gone := func(f localFile) bool {
+		return f.Path == path || strings.HasPrefix(f.Path, prefix)
+	}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	var removed []indexedFile
+	for site, files := range idx.l2 {
+		for name, f := range files {
+			if gone(f) {
+				delete(files, name)
+				removed = append(removed, indexedFile{site, "", name})
+			}
+		}
+	}
+	for site, products := range idx.l3 {
+		for product, files := range products {
+			for name, f := range files {
+				if gone(f) {
+					delete(files, name)
+					removed = append(removed, indexedFile{site, product, name})
+				}
+			}
+		}
+	}
+	return removed
+}
+
+// forgetCached drops everything cached from files which have changed or gone away since they
+// were indexed, so nothing from a partially written file outlives it
+func (idx *LocalDirIndex) forgetCached(files []indexedFile) {
+	caches := idx.caches
+	for _, f := range files {
+		var isTile func(key string) bool
+		if f.Product == "" {
+			if caches.chunks != nil {
+				caches.chunks.Forget(f.Name)
+			}
+			if caches.radials != nil {
+				caches.radials.Forget(f.Name)
+			}
+			isTile = func(key string) bool {
+				return strings.HasPrefix(key, "/api/l2/") && strings.Contains(key, "/"+f.Name+"/")
+			}
+		} else {
+			prefix := "/api/l3/" + f.Site + "/" + f.Product + "/" + f.Name + "/"
+			isTile = func(key string) bool { return strings.HasPrefix(key, prefix) }
+		}
+		if caches.tiles != nil {
+			caches.tiles.RemoveFunc(isTile)
+		}
+	}
+}
+
+func (idx *LocalDirIndex) L2Sites(match func(name string, f localFile) bool) []string {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+	sites := make([]string, 0, len(idx.l2))
+	for site, files := range idx.l2 {
+		for name, f := range files {
+			if match(name, f) {
+				sites = append(sites, site)
+				break
+			}
+		}
+	}
+	sort.Strings(sites)
+	return sites
+}
+
+func (idx *LocalDirIndex) L2Files(site string, match func(name string, f localFile) bool) []L2FileInfo {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+	files := make([]L2FileInfo, 0, len(idx.l2[site]))
+	for name, f := range idx.l2[site] {
+		if match(name, f) {
+			files = append(files, L2FileInfo{Name: name, LastModified: f.ModTime})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files
+}
+
+func (idx *LocalDirIndex) L2File(fn string) (localFile, bool) {
+	if len(fn) < 4 {
+		return localFile{}, false
+	}
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+	f, ok := idx.l2[fn[:4]][fn]
+	return f, ok
+}
+
+func (idx *LocalDirIndex) L3Sites() []string {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+	sites := make([]string, 0, len(idx.l3))
+	for site := range idx.l3 {
+		sites = append(sites, site)
+	}
+	sort.Strings(sites)
+	return sites
+}
+
+func (idx *LocalDirIndex) L3Products(site string) []string {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+	products := make([]string, 0, len(idx.l3[site]))
+	for product := range idx.l3[site] {
+		products = append(products, product)
+	}
+	sort.Strings(products)
+	return products
+}
+
+func (idx *LocalDirIndex) L3Files(site, product string, match func(name string, f localFile) bool) []string {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+	files := make([]string, 0, len(idx.l3[site][product]))
+	for name, f := range idx.l3[site][product] {
+		if match(name, f) {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (idx *LocalDirIndex) L3File(site, product, fn string) (localFile, bool) {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+	f, ok := idx.l3[site][product][fn]
+	return f, ok
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kallsyms/radserv/render"
+)
+
+// waitFor polls cond until it's true or timeout passes
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestLocalDirIndexWaitsForWritesToSettle(t *testing.T) {
+	const settleTime = 300 * time.Millisecond
+
+	root := t.TempDir()
+	old := filepath.Join(root, "KTLX", "KTLX20240101_000000_V06")
+	if err := os.MkdirAll(filepath.Dir(old), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(old, []byte("old volume"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := NewLocalDirIndex(root, settleTime, localDirCaches{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if _, ok := idx.L2File("KTLX20240101_000000_V06"); !ok {
+		t.Fatal("file which finished writing long ago wasn't indexed by the initial scan")
+	}
+
+	// a volume written a chunk at a time
+	fn := "KTLX20240101_000500_V06"
+	f, err := os.Create(filepath.Join(root, "KTLX", fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		f.Write([]byte("chunk"))
+		time.Sleep(settleTime / 3)
+		if _, ok := idx.L2File(fn); ok {
+			t.Fatalf("volume indexed after %d chunks while still being written", i+1)
+		}
+	}
+	f.Close()
+
+	if !waitFor(5*settleTime, func() bool { _, ok := idx.L2File(fn); return ok }) {
+		t.Fatal("volume wasn't indexed once it stopped changing")
+	}
+
+	// rewriting it takes it back out until it settles again
+	if err := os.WriteFile(filepath.Join(root, "KTLX", fn), []byte("rewritten"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(settleTime/2, func() bool { _, ok := idx.L2File(fn); return !ok }) {
+		t.Fatal("rewritten volume stayed indexed")
+	}
+	if !waitFor(5*settleTime, func() bool { _, ok := idx.L2File(fn); return ok }) {
+		t.Fatal("rewritten volume wasn't indexed once it stopped changing")
+	}
+}
+
+func TestLocalDirIndexForgetsCachedDataOfChangedFiles(t *testing.T) {
+	chunks := NewArchive2ChunkCacheManager(100, 0)
+	radials := NewRadialSetCacheManager(1 << 20)
+	tiles := NewTileCache(1 << 20)
+
+	root := t.TempDir()
+	fn, other := "KTLX20240101_000000_V06", "KTLX20240101_000500_V06"
+	l3 := filepath.Join(root, "TLX", "N0Q", "N0Q_20240101_0000")
+	for _, path := range []string{filepath.Join(root, fn), filepath.Join(root, other), l3} {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		past := time.Now().Add(-time.Hour)
+		os.Chtimes(path, past, past)
+	}
+	idx, err := NewLocalDirIndex(root, 100*time.Millisecond, localDirCaches{chunks, radials, tiles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for _, f := range []string{fn, other} {
+		chunks.meta.Put(f, Archive2Metadata{})
+		radials.sets.Put(radialSetKey{f, "ref", 1}, &render.RadialSet{})
+		radials.sets.Put(radialSetKey{f, "cref", 0}, &render.RadialSet{})
+		tiles.Put("/api/l2/KTLX/"+f+"/ref/1/tiles/7/29/50?", []byte("png"))
+	}
+	l3Tile := "/api/l3/TLX/N0Q/N0Q_20240101_0000/tiles/7/29/50?"
+	tiles.Put(l3Tile, []byte("png"))
+
+	// a partial volume that was indexed while LDM paused, then written to again
+	if err := os.WriteFile(filepath.Join(root, fn), []byte("more data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(time.Second, func() bool { _, ok := chunks.meta.Get(fn); return !ok }) {
+		t.Fatal("metadata of rewritten volume stayed cached")
+	}
+	if _, ok := radials.sets.Get(radialSetKey{fn, "ref", 1}); ok {
+		t.Error("radials of rewritten volume stayed cached")
+	}
+	if _, ok := radials.sets.Get(radialSetKey{fn, "cref", 0}); ok {
+		t.Error("volume product of rewritten volume stayed cached")
+	}
+	if _, ok := tiles.Get("/api/l2/KTLX/" + fn + "/ref/1/tiles/7/29/50?"); ok {
+		t.Error("tile of rewritten volume stayed cached")
+	}
+
+	if _, ok := chunks.meta.Get(other); !ok {
+		t.Error("metadata of unchanged volume was dropped")
+	}
+	if _, ok := radials.sets.Get(radialSetKey{other, "ref", 1}); !ok {
+		t.Error("radials of unchanged volume were dropped")
+	}
+	if _, ok := tiles.Get("/api/l2/KTLX/" + other + "/ref/1/tiles/7/29/50?"); !ok {
+		t.Error("tile of unchanged volume was dropped")
+	}
+
+	if err := os.Remove(l3); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(time.Second, func() bool { _, ok := tiles.Get(l3Tile); return !ok }) {
+		t.Error("tile of removed product stayed cached")
+	}
+}
+
+func TestLocalDirIndexWithoutSettleTime(t *testing.T) {
+	root := t.TempDir()
+	idx, err := NewLocalDirIndex(root, 0, localDirCaches{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	fn := "KTLX20240101_000000_V06"
+	path := filepath.Join(root, fn)
+	for i := 0; i < 20; i++ {
+		if err := os.WriteFile(path, []byte("chunk"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitFor(time.Second, func() bool { _, ok := idx.L2File(fn); return ok }) {
+		t.Fatal("rewritten volume wasn't indexed")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache is an in-memory LRU cache bounded by total cost, with an optional TTL.
+// Cost is whatever unit the cost function returns (1 per entry, bytes, ...).
+type lruCache[K comparable, V any] struct {
+	mtx     sync.Mutex
+	maxCost int64
+	ttl     time.Duration
+	cost    func(V) int64
+
+	ll      *list.List // front is most recently used
+	items   map[K]*list.Element
+	curCost int64
+
+	hits        int64
+	misses      int64
+	evictions   int64
+	expirations int64
+}
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	cost    int64
+	expires time.Time
+}
+
+type CacheStats struct {
+	Entries     int
+	Cost        int64
+	MaxCost     int64
+	Hits        int64
+	Misses      int64
+	Evictions   int64
+	Expirations int64
+}
+
+// newLRUCache creates a cache holding at most maxCost worth of entries.
+// A ttl of 0 means entries never expire; a nil cost counts each entry as 1.
+func newLRUCache[K comparable, V any](maxCost int64, ttl time.Duration, cost func(V) int64) *lruCache[K, V] {
+	if cost == nil {
+		cost = func(V) int64 { return 1 }
+	}
+	return &lruCache[K, V]{
+		maxCost: maxCost,
+		ttl:     ttl,
+		cost:    cost,
+		ll:      list.New(),
+		items:   make(map[K]*list.Element),
+	}
+}
+
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		var zero V
+		return zero, false
+	}
+	e := el.Value.(*lruEntry[K, V])
+	if c.ttl > 0 && time.Now().After(e.expires) {
+		c.remove(el)
+		c.expirations++
+		c.misses++
+		var zero V
+		return zero, false
+	}
+	c.ll.MoveToFront(el)
+	c.hits++
+	return e.value, true
+}
+
+func (c *lruCache[K, V]) Put(key K, value V) {
+	cost := c.cost(value)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	// even if value is too big to keep, the old one mustn't be served in its place
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	if cost > c.maxCost {
+		return
+	}
+	e := &lruEntry[K, V]{
+		key:   key,
+		value: value,
+		cost:  cost,
+	}
+	if c.ttl > 0 {
+		e.expires = time.Now().Add(c.ttl)
+	}
+	c.items[key] = c.ll.PushFront(e)
+	c.curCost += cost
+
+	for c.curCost > c.maxCost {
+		c.remove(c.ll.Back())
+		c.evictions++
+	}
+}
+
+// Remove drops key from the cache, if present
+func (c *lruCache[K, V]) Remove(key K) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+// RemoveFunc drops every entry whose key matches
+func (c *lruCache[K, V]) RemoveFunc(match func(K) bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for key, el := range c.items {
+		if match(key) {
+			c.remove(el)
+		}
+	}
+}
+
+// remove drops el from the cache. c.mtx must be held.
+func (c *lruCache[K, V]) remove(el *list.Element) {
+	e := el.Value.(*lruEntry[K, V])
+	c.ll.Remove(el)
+	delete(c.items, e.key)
+	c.curCost -= e.cost
+}
+
+func (c *lruCache[K, V]) Stats() CacheStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return CacheStats{
+		Entries:     len(c.items),
+		Cost:        c.curCost,
+		MaxCost:     c.maxCost,
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Evictions:   c.evictions,
+		Expirations: c.expirations,
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestLRUCachePutTooBigDropsOldValue(t *testing.T) {
+	c := newLRUCache[string, []byte](10, 0, func(b []byte) int64 { return int64(len(b)) })
+	c.Put("a", []byte("old"))
+	c.Put("b", []byte("bb"))
+
+	c.Put("a", []byte("much too big for the cache"))
+	if v, ok := c.Get("a"); ok {
+		t.Errorf("Get(a) = %q after replacing it with a value too big to cache, want a miss", v)
+	}
+	if v, ok := c.Get("b"); !ok || string(v) != "bb" {
+		t.Errorf("Get(b) = %q, %v, want bb", v, ok)
+	}
+	if st := c.Stats(); st.Entries != 1 || st.Cost != 2 {
+		t.Errorf("stats = %+v, want 1 entry costing 2", st)
+	}
+}
@@ -5,16 +5,25 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cache"
 	"github.com/gin-contrib/cache/persistence"
 	"github.com/gin-gonic/gin"
+	"github.com/kallsyms/radserv/diskcache"
 	"github.com/sirupsen/logrus"
 )
 
-// Wrap cache.CachePage and also emit client-side Cache-Control/Expires headers
+// Wrap cache.CachePage and also emit client-side Cache-Control/Expires headers.
+// An expiration of 0 disables caching entirely.
 func cachePageWithClientHeaders(store persistence.CacheStore, expiration time.Duration, h gin.HandlerFunc) gin.HandlerFunc {
+	if expiration <= 0 {
+		return func(c *gin.Context) {
+			c.Header("Cache-Control", "no-cache")
+			h(c)
+		}
+	}
 	ch := cache.CachePage(store, expiration, h)
 	return func(c *gin.Context) {
 		// Add headers before invoking cached handler
@@ -24,36 +33,129 @@ func cachePageWithClientHeaders(store persistence.CacheStore, expiration time.Du
 	}
 }
 
+// localFileMaxAge is how long clients may cache output derived from a file under -l2-dir or
+// -l3-dir, which may still be rewritten after it's first served
+const localFileMaxAge = time.Minute
+
+// setFileCacheHeaders lets clients cache output derived from the single volume or product the
+// request is for. Archived files never change, so that's for good; local ones only briefly.
+func setFileCacheHeaders(c *gin.Context) {
+	local := false
+	if strings.HasPrefix(c.FullPath(), "/api/l3/") {
+		_, local = L3Data.(*LocalL3Source)
+	} else {
+		_, local = L2Data.(*LocalL2Source)
+	}
+	if local {
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(localFileMaxAge.Seconds())))
+		c.Header("Expires", time.Now().UTC().Add(localFileMaxAge).Format(http.TimeFormat))
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("Expires", time.Now().UTC().AddDate(1, 0, 0).Format(http.TimeFormat))
+}
+
 func main() {
 	verbose := flag.Bool("verbose", false, "Verbose mode")
+	l2Cfg := L2SourceConfig{}
+	flag.StringVar(&l2Cfg.Kind, "l2-source", "unidata", "Where to read Level 2 volumes from: unidata, s3 or local")
+	flag.StringVar(&l2Cfg.S3Endpoint, "l2-s3-endpoint", "", "S3-compatible endpoint URL for -l2-source=s3 (e.g. a MinIO server)")
+	flag.StringVar(&l2Cfg.S3Region, "l2-s3-region", "us-east-1", "Region for -l2-source=s3")
+	flag.StringVar(&l2Cfg.S3Bucket, "l2-s3-bucket", "", "Bucket for -l2-source=s3")
+	flag.BoolVar(&l2Cfg.S3PathStyle, "l2-s3-path-style", true, "Use path-style addressing for -l2-source=s3")
+	flag.BoolVar(&l2Cfg.S3Anonymous, "l2-s3-anonymous", false, "Don't send credentials for -l2-source=s3")
+	cacheDir := flag.String("cache-dir", "", "Directory to cache fetched L2 volumes in across restarts (disabled if empty)")
+	cacheSizeMB := flag.Int64("cache-size", 10*1024, "Maximum size of -cache-dir in MB")
+	metaCacheEntries := flag.Int("meta-cache-entries", 4096, "Maximum number of L2 files to keep chunk metadata for in memory")
+	metaCacheTTL := flag.Duration("meta-cache-ttl", 6*time.Hour, "How long to keep L2 chunk metadata in memory (0 for forever)")
+	radialCacheMB := flag.Int64("radial-cache-size", 1024, "Maximum memory in MB for decoded L2 radial data")
+	tileCacheMB := flag.Int64("tile-cache-size", 256, "Maximum memory in MB for rendered map tiles")
+	flag.StringVar(&l2Cfg.Dir, "l2-dir", "", "Directory tree to serve volumes from for -l2-source=local")
+	l3Cfg := L3SourceConfig{}
+	flag.StringVar(&l3Cfg.Kind, "l3-source", "gcs", "Where to read Level 3 products from: gcs or local")
+	flag.StringVar(&l3Cfg.Dir, "l3-dir", "", "Directory tree (.../SITE/PRODUCT/<file>) to serve products from for -l3-source=local")
+	flag.DurationVar(&settleTime, "local-settle-time", settleTime, "How long a file under -l2-dir or -l3-dir must go unchanged before it's served (0 to serve files as soon as they appear)")
 	flag.Parse()
 
 	if *verbose {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
+	// Before the sources, as local ones drop changed files from them
+	ChunkCache = NewArchive2ChunkCacheManager(*metaCacheEntries, *metaCacheTTL)
+	RadialCache = NewRadialSetCacheManager(*radialCacheMB * 1024 * 1024)
+	TileCache = NewTileCache(*tileCacheMB * 1024 * 1024)
+
+	var err error
+	L2Data, err = NewL2Source(l2Cfg)
+	if err != nil {
+		logrus.Fatalf("Failed to set up L2 source: %v", err)
+	}
+	// No point caching files which are already on local disk
+	if *cacheDir != "" && l2Cfg.Kind != "local" {
+		dc, err := diskcache.New(*cacheDir, *cacheSizeMB*1024*1024)
+		if err != nil {
+			logrus.Fatalf("Failed to open cache dir: %v", err)
+		}
+		L2Data = NewCachingL2Source(L2Data, dc)
+		DiskCache = dc
+	}
+	Sites, err = LoadSites("./nexrad.kml")
+	if err != nil {
+		logrus.Warnf("Failed to load site locations: %v", err)
+	}
+	L3Data, err = NewL3Source(l3Cfg)
+	if err != nil {
+		logrus.Fatalf("Failed to set up L3 source: %v", err)
+	}
+
+	// Local sources are watched, so listings are always current and shouldn't be cached
+	l2ListTTL, l3ListTTL := 1*time.Minute, 1*time.Minute
+	if l2Cfg.Kind == "local" {
+		l2ListTTL = 0
+	}
+	if l3Cfg.Kind == "local" {
+		l3ListTTL = 0
+	}
+
 	r := gin.Default()
 	store := persistence.NewInMemoryStore(time.Minute)
 
 	// API routes
+	r.GET("/api/stats", statsHandler)
+
 	r.GET("/api/l2", cachePageWithClientHeaders(store, 24*time.Hour, l2ListSitesHandler))
-	r.GET("/api/l2/:site", cachePageWithClientHeaders(store, 1*time.Minute, l2ListFilesHandler))
-	r.GET("/api/l2/:site/date/:date", cachePageWithClientHeaders(store, 1*time.Minute, l2ListFilesHandler))
+	r.GET("/api/l2/:site", cachePageWithClientHeaders(store, l2ListTTL, l2ListFilesHandler))
+	r.GET("/api/l2/:site/date/:date", cachePageWithClientHeaders(store, l2ListTTL, l2ListFilesHandler))
 	r.GET("/api/l2/:site/:fn", cachePageWithClientHeaders(store, 1*time.Hour, l2FileMetaHandler))
+	r.GET("/api/l2/:site/:fn/frames", cachePageWithClientHeaders(store, 1*time.Hour, l2FileFramesHandler))
+	r.GET("/api/l2/:site/:fn/:product/isosurface", cachePageWithClientHeaders(store, 1*time.Hour, l2FileIsosurfaceHandler))
 	r.GET("/api/l2/:site/:fn/:product/isosurface/:threshold", cachePageWithClientHeaders(store, 1*time.Hour, l2FileIsosurfaceHandler))
+	r.GET("/api/l2/:site/:fn/:product/grid", l2FileGridHandler)
+	r.GET("/api/l2/:site/:fn/:product/xsection", l2FileXSectionHandler)
 	r.GET("/api/l2/:site/:fn/:product/:elv/radial", l2FileRadialHandler)
 	r.GET("/api/l2/:site/:fn/:product/:elv/render", l2FileRenderHandler)
+	// by elevation angle (?angle=&which=) rather than elevation number
+	r.GET("/api/l2/:site/:fn/:product/radial", l2FileRadialHandler)
+	r.GET("/api/l2/:site/:fn/:product/render", l2FileRenderHandler)
+	r.GET("/api/l2/:site/:fn/:product/:elv/tiles/:z/:x/:y", l2FileTileHandler)
+	r.GET("/api/l2/:site/:fn/:product/tiles/:z/:x/:y", l2FileTileHandler)
 
 	r.GET("/api/l2-realtime/:site/:volume", realtimeMetaHandler)
 	r.GET("/api/l2-realtime/:site/:volume/:elv/:product/render", realtimeRenderHandler)
 
+	r.GET("/wms", wmsHandler)
+
+	r.GET("/api/mosaic/:product/render", cachePageWithClientHeaders(store, l2ListTTL, mosaicRenderHandler))
+
 	r.GET("/api/l3", cachePageWithClientHeaders(store, 24*time.Hour, l3ListSitesHandler))
 	r.GET("/api/l3/:site", cachePageWithClientHeaders(store, 24*time.Hour, l3ListProductsHandler))
-	r.GET("/api/l3/:site/:product", cachePageWithClientHeaders(store, 1*time.Minute, l3ListFilesHandler))
-	r.GET("/api/l3/:site/:product/date/:date", cachePageWithClientHeaders(store, 1*time.Minute, l3ListFilesByDateHandler))
+	r.GET("/api/l3/:site/:product", cachePageWithClientHeaders(store, l3ListTTL, l3ListFilesHandler))
+	r.GET("/api/l3/:site/:product/date/:date", cachePageWithClientHeaders(store, l3ListTTL, l3ListFilesByDateHandler))
 	r.GET("/api/l3/:site/:product/:fn", cachePageWithClientHeaders(store, 1*time.Hour, l3FileMetaHandler))
 	r.GET("/api/l3/:site/:product/:fn/radial", l3FileRadialHandler)
 	r.GET("/api/l3/:site/:product/:fn/render", l3FileRenderHandler)
+	r.GET("/api/l3/:site/:product/:fn/tiles/:z/:x/:y", l3FileTileHandler)
 
 	// Static files - specific routes first, then fallback
 	r.Static("/assets", "./web/dist/assets")
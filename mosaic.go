@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kallsyms/radserv/render"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Sites are considered for a mosaic if the target is within this many meters of them
+	mosaicSiteRange = 460e3
+	// Sites whose latest low level scan ended longer than this before the mosaic time are left out
+	defaultMosaicMaxAge = 15 * time.Minute
+	// How many sites to load at once
+	mosaicConcurrency = 16
+)
+
+var errStaleSite = errors.New("Site has no recent data")
+
+// Products which can be mosaicked
+var mosaicProducts = map[string]bool{
+	"ref":  true,
+	"cref": true,
+}
+
+func parseOverlap(c *gin.Context) (render.Overlap, error) {
+	switch overlap := strings.ToLower(c.DefaultQuery("overlap", "nearest")); overlap {
+	case "nearest":
+		return render.NearestRadar, nil
+	case "max":
+		return render.MaxValue, nil
+	default:
+		return render.NearestRadar, fmt.Errorf("Invalid overlap %q, expected nearest or max", overlap)
+	}
+}
+
+// mosaicTarget is parseTarget, but defaults to the CONUS extent rather than one around a site
+func mosaicTarget(c *gin.Context) (render.Target, error) {
+	p, err := parseTargetParams(c)
+	if err != nil {
+		return render.Target{}, err
+	}
+	if p.BBox == nil {
+		b := render.CONUS.Extent
+		if p.SRS == render.CONUS.SRS {
+			if p.Width == 0 && p.Height == 0 {
+				p.Width, p.Height = render.CONUS.Width, render.CONUS.Height
+			}
+		} else {
+			b, err = render.TransformExtent(b, render.CONUS.SRS, p.SRS)
+			if err != nil {
+				return render.Target{}, err
+			}
+		}
+		p.BBox = &b
+	}
+	return buildTarget(nil, p.SRS, p.BBox, p.Width, p.Height)
+}
+
+// mosaicSites returns the IDs of the sites which could cover part of t, sorted
+func mosaicSites(t render.Target) []string {
+	bounds, err := render.TransformExtent(t.Extent, t.SRS, "EPSG:4326")
+	if err != nil {
+		// can't tell, so try all of them
+		bounds = [4]float64{-180, -90, 180, 90}
+	}
+
+	ids := []string{}
+	for id, s := range Sites {
+		b := render.LatLonBoundsAround(s.Lat, s.Lon, mosaicSiteRange)
+		if b[0] <= bounds[2] && bounds[0] <= b[2] && b[1] <= bounds[3] && bounds[1] <= b[3] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// mosaicRadialSet loads product from the latest low level scan (or for volume products, the
+// latest volume) of site at or before at, or errStaleSite if that ended before cutoff
+func mosaicRadialSet(ctx context.Context, site, product string, at, cutoff time.Time) (*render.RadialSet, error) {
+	fn, err := l2FileAt(ctx, site, at)
+	if err != nil {
+		return nil, err
+	}
+	meta, _, err := ChunkCache.GetMeta(ctx, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := l2VolumeProducts[product]; ok {
+		if len(meta.Sweeps) == 0 || meta.Sweeps[len(meta.Sweeps)-1].EndTime.Before(cutoff) {
+			return nil, errStaleSite
+		}
+		return RadialCache.GetVolumeProduct(ctx, fn, product, l2RadialOptions{})
+	}
+
+	// the last SAILS supplemental scan is the freshest
+	frames := lowLevelFrames(meta)
+	for i := len(frames) - 1; i >= 0; i-- {
+		f := frames[i]
+		elv, ok := f.Elevations[product]
+		if !ok || f.Start.After(at) {
+			continue
+		}
+		if f.End.Before(cutoff) {
+			return nil, errStaleSite
+		}
+		return RadialCache.Get(ctx, fn, product, elv)
+	}
+	return nil, errNoSweep
+}
+
+// mosaicRenderHandler serves /api/mosaic/:product/render, compositing the latest lowest tilt of
+// every site in the target into one image
+func mosaicRenderHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	product := render.CanonicalProduct(strings.ToLower(c.Param("product")))
+	if !mosaicProducts[product] {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("Product %q can't be mosaicked", product))
+		return
+	}
+	overlap, err := parseOverlap(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	maxAge := defaultMosaicMaxAge
+	if s := c.Query("max_age"); s != "" {
+		maxAge, err = time.ParseDuration(s)
+		if err != nil || maxAge <= 0 {
+			c.AbortWithError(http.StatusBadRequest, errors.New("Invalid max_age, expected a duration like 10m"))
+			return
+		}
+	}
+	at := time.Now().UTC()
+	if s := c.Query("time"); s != "" {
+		at, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, errors.New("Invalid time, expected RFC 3339"))
+			return
+		}
+	}
+	target, err := mosaicTarget(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	format, err := parseRenderFormat(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	interp, err := parseInterp(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	lut := render.DefaultLUT(product)
+	if _, ok := c.GetQuery("nolut"); ok {
+		lut = render.DefaultLUT("")
+	}
+
+	sites := mosaicSites(target)
+	sets := make([]*render.RadialSet, len(sites))
+	sem := make(chan struct{}, mosaicConcurrency)
+	wg := sync.WaitGroup{}
+	for i, site := range sites {
+		wg.Add(1)
+		go func(i int, site string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			rs, err := mosaicRadialSet(ctx, site, product, at, at.Add(-maxAge))
+			if err != nil {
+				if !errors.Is(err, errNoVolume) && !errors.Is(err, errNoSweep) && !errors.Is(err, errStaleSite) && ctx.Err() == nil {
+					logrus.Warnf("mosaic: %s: %v", site, err)
+				}
+				return
+			}
+			sets[i] = rs
+		}(i, site)
+	}
+	wg.Wait()
+
+	included := []string{}
+	loaded := []*render.RadialSet{}
+	for i, rs := range sets {
+		if rs != nil {
+			included = append(included, sites[i])
+			loaded = append(loaded, rs)
+		}
+	}
+
+	r, err := render.Mosaic(ctx, loaded, target, interp, overlap)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+	out, contentType, err := encodeRaster(r, lut, format)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	data, _ := ioutil.ReadAll(out)
+	out.Close()
+
+	select {
+	case <-ctx.Done():
+		return
+	default:
+	}
+	// Which sites made it in, so clients can point out missing or stale ones
+	c.Header("X-Mosaic-Sites", strings.Join(included, ","))
+	c.Data(http.StatusOK, contentType, data)
+}
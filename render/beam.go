@@ -0,0 +1,37 @@
+package render
+
+import "math"
+
+// Beam geometry under the standard 4/3 earth radius model: refraction bends the beam down
+// about as much as it would have to be bent to follow an earth 4/3 as large, so the beam is
+// treated as a straight line over that earth instead.
+
+const (
+	earthRadius          = 6371000.0
+	effectiveEarthRadius = earthRadius * 4 / 3
+)
+
+// beamHeight returns the height in meters above the antenna of the center of the beam at slant
+// range rng (meters) and elevation angle elev (degrees)
+func beamHeight(rng, elev float64) float64 {
+	e := elev * math.Pi / 180
+	return math.Sqrt(rng*rng+effectiveEarthRadius*effectiveEarthRadius+2*rng*effectiveEarthRadius*math.Sin(e)) - effectiveEarthRadius
+}
+
+// slantRange returns the slant range at which the center of the beam at elevation angle elev
+// is above ground range gr (meters along the ground from the radar), or +Inf if it never is
+func slantRange(gr, elev float64) float64 {
+	g := gr / effectiveEarthRadius
+	c := math.Cos(elev*math.Pi/180 + g)
+	if c <= 0 {
+		return math.Inf(1)
+	}
+	return effectiveEarthRadius * math.Sin(g) / c
+}
+
+// groundRange returns the distance in meters along the ground from the radar to the point below
+// the center of the beam at slant range rng (meters) and elevation angle elev (degrees)
+func groundRange(rng, elev float64) float64 {
+	e := elev * math.Pi / 180
+	return effectiveEarthRadius * math.Asin(rng*math.Cos(e)/(effectiveEarthRadius+beamHeight(rng, elev)))
+}
@@ -0,0 +1,175 @@
+package render
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Cell is a contiguous region of a RadialSet at or above some threshold, e.g. a storm cell
+type Cell struct {
+	// Centroid in meters east and north of the radar
+	X float64
+	Y float64
+	// Area in square meters
+	Area     float64
+	MaxValue float64
+}
+
+// Motion is a horizontal motion vector in m/s
+type Motion struct {
+	// Eastward component
+	U float64
+	// Northward component
+	V float64
+}
+
+// MotionFromDirection converts a meteorological direction (degrees the motion is coming from,
+// clockwise from north) and speed in m/s to a Motion
+func MotionFromDirection(dir, speed float64) Motion {
+	rad := dir * math.Pi / 180
+	return Motion{
+		U: -speed * math.Sin(rad),
+		V: -speed * math.Cos(rad),
+	}
+}
+
+// FindCells finds regions of at least minArea square meters where rs is at or above threshold.
+// Gates are connected to their neighbors along the radial and to the same gate on adjacent radials.
+func FindCells(rs *RadialSet, threshold, minArea float64) []Cell {
+	radials := append(RadialSlice(nil), rs.Radials...)
+	sort.Sort(radials)
+	n := len(radials)
+	if n == 0 {
+		return nil
+	}
+
+	visited := make([][]bool, n)
+	for i, r := range radials {
+		visited[i] = make([]bool, len(r.Gates))
+	}
+	above := func(ri, g int) bool {
+		gates := radials[ri].Gates
+		return g >= 0 && g < len(gates) && !visited[ri][g] && gates[g] != GateEmptyValue && gates[g] >= threshold
+	}
+
+	type gate struct{ r, g int }
+	cells := []Cell{}
+	var stack []gate
+	for ri, r := range radials {
+		for g := range r.Gates {
+			if !above(ri, g) {
+				continue
+			}
+
+			var sumX, sumY, area float64
+			c := Cell{MaxValue: GateEmptyValue}
+			visited[ri][g] = true
+			stack = append(stack[:0], gate{ri, g})
+			for len(stack) > 0 {
+				cur := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+
+				rad := radials[cur.r]
+				rng := rad.StartRange + float64(cur.g)*rad.GateInterval
+				az := rad.AzimuthAngle * math.Pi / 180
+				a := rng * rad.AzimuthResolution * math.Pi / 180 * rad.GateInterval
+				sumX += a * rng * math.Sin(az)
+				sumY += a * rng * math.Cos(az)
+				area += a
+				c.MaxValue = math.Max(c.MaxValue, rad.Gates[cur.g])
+
+				for _, next := range []gate{
+					{cur.r, cur.g - 1},
+					{cur.r, cur.g + 1},
+					{(cur.r + 1) % n, cur.g},
+					{(cur.r - 1 + n) % n, cur.g},
+				} {
+					if above(next.r, next.g) {
+						visited[next.r][next.g] = true
+						stack = append(stack, next)
+					}
+				}
+			}
+
+			if area < minArea || area == 0 {
+				continue
+			}
+			c.X = sumX / area
+			c.Y = sumY / area
+			c.Area = area
+			cells = append(cells, c)
+		}
+	}
+	return cells
+}
+
+// TrackCells estimates the mean motion of cells between two scans dt apart.
+// Each cell in cur is matched to the nearest unclaimed cell in prev it could have plausibly
+// moved from, largest cells first, and the area-weighted mean displacement of the matches
+// (after dropping outliers) is returned. ok is false if nothing could be matched.
+func TrackCells(prev, cur []Cell, dt time.Duration) (m Motion, ok bool) {
+	const maxSpeed = 50.0     // m/s
+	const maxDeviation = 15.0 // m/s from the first-pass mean
+
+	secs := dt.Seconds()
+	if secs <= 0 {
+		return Motion{}, false
+	}
+
+	cur = append([]Cell(nil), cur...)
+	sort.Slice(cur, func(i, j int) bool { return cur[i].Area > cur[j].Area })
+
+	type match struct {
+		m      Motion
+		weight float64
+	}
+	matches := []match{}
+	claimed := make([]bool, len(prev))
+	for _, c := range cur {
+		best := -1
+		bestDist := maxSpeed * secs
+		for i, p := range prev {
+			if claimed[i] {
+				continue
+			}
+			if d := math.Hypot(c.X-p.X, c.Y-p.Y); d <= bestDist {
+				best = i
+				bestDist = d
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		claimed[best] = true
+		matches = append(matches, match{
+			m:      Motion{U: (c.X - prev[best].X) / secs, V: (c.Y - prev[best].Y) / secs},
+			weight: math.Min(c.Area, prev[best].Area),
+		})
+	}
+
+	mean := func(accept func(Motion) bool) (Motion, bool) {
+		var sum Motion
+		var total float64
+		for _, mt := range matches {
+			if !accept(mt.m) {
+				continue
+			}
+			sum.U += mt.m.U * mt.weight
+			sum.V += mt.m.V * mt.weight
+			total += mt.weight
+		}
+		if total == 0 {
+			return Motion{}, false
+		}
+		return Motion{U: sum.U / total, V: sum.V / total}, true
+	}
+
+	first, ok := mean(func(Motion) bool { return true })
+	if !ok {
+		return Motion{}, false
+	}
+	return mean(func(m Motion) bool {
+		return math.Hypot(m.U-first.U, m.V-first.V) <= maxDeviation
+	})
+}
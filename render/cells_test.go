@@ -0,0 +1,128 @@
+package render
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFindCells(t *testing.T) {
+	rs := &RadialSet{Radius: 100000}
+	for az := 0; az < 360; az++ {
+		r := &Radial{AzimuthAngle: float64(az), AzimuthResolution: 1, GateInterval: 250, Gates: make([]float64, 400)}
+		for g := range r.Gates {
+			r.Gates[g] = GateEmptyValue
+		}
+		switch {
+		// 50-55km east
+		case az >= 88 && az <= 92:
+			for g := 200; g < 220; g++ {
+				r.Gates[g] = 50
+			}
+		// 30-32.5km north, across 0
+		case az >= 358 || az <= 1:
+			for g := 120; g < 130; g++ {
+				r.Gates[g] = 45
+			}
+			if az == 0 {
+				r.Gates[125] = 60
+			}
+		// a single gate, too small
+		case az == 200:
+			r.Gates[100] = 55
+		}
+		// below threshold
+		r.Gates[300] = 20
+		rs.Radials = append(rs.Radials, r)
+	}
+	// out of order, as they may be
+	rs.Radials[10], rs.Radials[90] = rs.Radials[90], rs.Radials[10]
+
+	cells := FindCells(rs, 30, 1e6)
+	if len(cells) != 2 {
+		t.Fatalf("found %d cells, want 2: %+v", len(cells), cells)
+	}
+	// area of a gate at r meters
+	gateArea := func(r float64) float64 { return r * math.Pi / 180 * 250 }
+	var east, north float64
+	for g := 200; g < 220; g++ {
+		east += 5 * gateArea(float64(g)*250)
+	}
+	for g := 120; g < 130; g++ {
+		north += 4 * gateArea(float64(g)*250)
+	}
+	tests := []struct {
+		name       string
+		x, y, area float64
+		max        float64
+	}{
+		{"east", 52400, 0, east, 50},
+		{"north", -270, 31150, north, 60},
+	}
+	for _, tt := range tests {
+		var c *Cell
+		for i := range cells {
+			if math.Hypot(cells[i].X-tt.x, cells[i].Y-tt.y) < 300 {
+				c = &cells[i]
+			}
+		}
+		if c == nil {
+			t.Errorf("%s: no cell near %g, %g in %+v", tt.name, tt.x, tt.y, cells)
+			continue
+		}
+		if math.Abs(c.Area-tt.area) > 1 || c.MaxValue != tt.max {
+			t.Errorf("%s: area %g, max %g, want %g, %g", tt.name, c.Area, c.MaxValue, tt.area, tt.max)
+		}
+	}
+
+	if cells := FindCells(&RadialSet{}, 30, 0); len(cells) != 0 {
+		t.Errorf("found %d cells in an empty sweep", len(cells))
+	}
+}
+
+func TestTrackCells(t *testing.T) {
+	// 100km apart, far further than anything could move between scans
+	prev := []Cell{
+		{X: 0, Y: 0, Area: 4e7},
+		{X: 100000, Y: 0, Area: 2e7},
+		{X: 0, Y: 100000, Area: 1e7},
+		{X: -100000, Y: 0, Area: 1e6},
+	}
+	moved := func(cells []Cell, secs float64, m ...Motion) []Cell {
+		out := make([]Cell, len(cells))
+		for i, c := range cells {
+			mi := m[len(m)-1]
+			if i < len(m) {
+				mi = m[i]
+			}
+			c.X += mi.U * secs
+			c.Y += mi.V * secs
+			out[i] = c
+		}
+		return out
+	}
+	storm := Motion{U: 10, V: 5}
+
+	tests := []struct {
+		name   string
+		prev   []Cell
+		cur    []Cell
+		dt     time.Duration
+		want   Motion
+		wantOK bool
+	}{
+		{"uniform", prev, moved(prev, 60, storm), time.Minute, storm, true},
+		// the weighted mean of 10 and 20 m/s east, 2:1
+		{"weighted by area", prev[:2], moved(prev[:2], 60, Motion{U: 10}, Motion{U: 20}), time.Minute, Motion{U: 40.0 / 3}, true},
+		{"outlier dropped", prev, moved(prev, 60, storm, storm, storm, Motion{U: -30}), time.Minute, storm, true},
+		{"too fast to match", prev, moved(prev, 60, Motion{U: 60}), time.Minute, Motion{}, false},
+		{"nothing before", nil, prev, time.Minute, Motion{}, false},
+		{"no time between", prev, prev, 0, Motion{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := TrackCells(tt.prev, tt.cur, tt.dt)
+		if ok != tt.wantOK || math.Abs(got.U-tt.want.U) > 1e-9 || math.Abs(got.V-tt.want.V) > 1e-9 {
+			t.Errorf("%s: TrackCells = %+v, %v, want %+v, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
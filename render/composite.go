@@ -0,0 +1,112 @@
+package render
+
+import (
+	"math"
+	"runtime"
+	"sync"
+)
+
+// columnSample is the value of one elevation above a point on the ground
+type columnSample struct {
+	ElevationAngle float64
+	// Slant range in meters
+	Range float64
+	// Height in meters above the antenna of the center of the beam
+	Height float64
+	// GateEmptyValue if there's nothing there
+	Value float64
+}
+
+// reduceColumns builds a RadialSet on the ground from the volume elvs by calling reduce with
+// the column of samples above each gate (lowest elevation first).
+// Ranges of the result are ground ranges, and its radials and gates are those of the lowest elevation.
+func reduceColumns(elvs ElevationSet, reduce func(col []columnSample) float64) *RadialSet {
+	if len(elvs) == 0 {
+		return nil
+	}
+	elvs = elvs.sorted()
+	lowest := elvs[0]
+	idxs := make([]*polarIndex, len(elvs))
+	for i, rs := range elvs {
+		idxs[i] = newPolarIndex(rs)
+	}
+
+	out := &RadialSet{
+		Lat:     lowest.Lat,
+		Lon:     lowest.Lon,
+		Radius:  lowest.Radius,
+		Height:  lowest.Height,
+		Radials: make(RadialSlice, len(lowest.Radials)),
+	}
+
+	radials := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			col := make([]columnSample, 0, len(elvs))
+			// Beam geometry only depends on the gate layout, which radials almost always share,
+			// so it's computed once per layout: slant range and height of each elevation at each gate
+			var layout [2]float64
+			var ranges, heights [][]float64
+			for i := range radials {
+				r := lowest.Radials[i]
+				if ranges == nil || layout != [2]float64{r.StartRange, r.GateInterval} || len(ranges[0]) < len(r.Gates) {
+					layout = [2]float64{r.StartRange, r.GateInterval}
+					ranges = make([][]float64, len(elvs))
+					heights = make([][]float64, len(elvs))
+					for e, rs := range elvs {
+						ranges[e] = make([]float64, len(r.Gates))
+						heights[e] = make([]float64, len(r.Gates))
+						for g := range r.Gates {
+							rng := slantRange(r.StartRange+float64(g)*r.GateInterval, rs.ElevationAngle)
+							ranges[e][g] = rng
+							heights[e][g] = beamHeight(rng, rs.ElevationAngle)
+						}
+					}
+				}
+
+				az := r.AzimuthAngle + r.AzimuthResolution/2
+				gates := make([]float64, len(r.Gates))
+				for g := range gates {
+					col = col[:0]
+					for e, idx := range idxs {
+						if math.IsInf(ranges[e][g], 1) {
+							continue
+						}
+						col = append(col, columnSample{elvs[e].ElevationAngle, ranges[e][g], heights[e][g], idx.valueAt(az, ranges[e][g])})
+					}
+					gates[g] = reduce(col)
+				}
+				out.Radials[i] = &Radial{
+					AzimuthAngle:      r.AzimuthAngle,
+					AzimuthResolution: r.AzimuthResolution,
+					StartRange:        r.StartRange,
+					GateInterval:      r.GateInterval,
+					Gates:             gates,
+				}
+			}
+		}()
+	}
+	for i := range lowest.Radials {
+		radials <- i
+	}
+	close(radials)
+	wg.Wait()
+	return out
+}
+
+// Composite returns the composite reflectivity of a volume: the maximum over every elevation
+// of elvs above each point on the ground
+func Composite(elvs ElevationSet) *RadialSet {
+	return reduceColumns(elvs, func(col []columnSample) float64 {
+		max := GateEmptyValue
+		for _, s := range col {
+			if s.Value != GateEmptyValue && (max == GateEmptyValue || s.Value > max) {
+				max = s.Value
+			}
+		}
+		return max
+	})
+}
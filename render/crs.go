@@ -0,0 +1,100 @@
+package render
+
+import (
+	"math"
+
+	"github.com/fogleman/mc"
+)
+
+// CRS is a coordinate system for mesh vertices
+type CRS int
+
+const (
+	// Local is meters east and north of the radar along the ground (the azimuthal equidistant
+	// projection centered on it, as Grid uses) and meters above sea level
+	Local CRS = iota
+	// ENU is meters east, north and up from the radar at sea level, in the plane tangent to the earth there
+	ENU
+	// LLA is longitude and latitude in degrees and meters above sea level
+	LLA
+	// ECEF is WGS84 earth centered, earth fixed meters
+	ECEF
+)
+
+// WGS84 ellipsoid
+const (
+	wgs84A = 6378137.0
+	wgs84F = 1 / 298.257223563
+)
+
+// geodeticToECEF returns the ECEF position of lat, lon (degrees) at height h meters
+func geodeticToECEF(lat, lon, h float64) mc.Vector {
+	e2 := wgs84F * (2 - wgs84F)
+	p, l := lat*math.Pi/180, lon*math.Pi/180
+	n := wgs84A / math.Sqrt(1-e2*math.Sin(p)*math.Sin(p))
+	return mc.Vector{
+		X: (n + h) * math.Cos(p) * math.Cos(l),
+		Y: (n + h) * math.Cos(p) * math.Sin(l),
+		Z: (n*(1-e2) + h) * math.Sin(p),
+	}
+}
+
+// enuBasis returns the ECEF unit vectors pointing east, north and up at lat, lon (degrees)
+func enuBasis(lat, lon float64) (e, n, u mc.Vector) {
+	p, l := lat*math.Pi/180, lon*math.Pi/180
+	e = mc.Vector{X: -math.Sin(l), Y: math.Cos(l)}
+	n = mc.Vector{X: -math.Sin(p) * math.Cos(l), Y: -math.Sin(p) * math.Sin(l), Z: math.Cos(p)}
+	u = mc.Vector{X: math.Cos(p) * math.Cos(l), Y: math.Cos(p) * math.Sin(l), Z: math.Sin(p)}
+	return e, n, u
+}
+
+// toCRS converts m from Local coordinates around the radar at lat, lon to crs. Normals of LLA
+// meshes are east, north and up at each vertex.
+func (m *Mesh) toCRS(lat, lon float64, crs CRS) {
+	if crs == Local {
+		return
+	}
+	origin := geodeticToECEF(lat, lon, 0)
+	oe, on, ou := enuBasis(lat, lon)
+	if crs == ECEF {
+		// float32 is only good to about a meter thousands of kilometers from the center of the
+		// earth, so vertices are kept relative to the radar
+		m.Origin = [3]float64{origin.X, origin.Y, origin.Z}
+	}
+
+	for i := 0; i < m.Vertices(); i++ {
+		p, n := m.Positions[3*i:3*i+3], m.Normals[3*i:3*i+3]
+		x, y, alt := float64(p[0]), float64(p[1]), float64(p[2])
+		gr, az := math.Hypot(x, y), math.Atan2(x, y)*180/math.Pi
+		vlat, vlon := destination(lat, lon, az, gr)
+
+		// Local's east and north are only true at the radar. Elsewhere its axes are turned by
+		// however much the bearing away from the radar has changed along the way there.
+		turn := 0.0
+		if gr > 0 {
+			_, back := greatCircle(vlat, vlon, lat, lon)
+			turn = (back + 180 - az) * math.Pi / 180
+		}
+		normal := mc.Vector{
+			X: float64(n[0])*math.Cos(turn) + float64(n[1])*math.Sin(turn),
+			Y: -float64(n[0])*math.Sin(turn) + float64(n[1])*math.Cos(turn),
+			Z: float64(n[2]),
+		}
+
+		var pos mc.Vector
+		switch crs {
+		case LLA:
+			pos = mc.Vector{X: vlon, Y: vlat, Z: alt}
+		case ENU, ECEF:
+			pos = sub(geodeticToECEF(vlat, vlon, alt), origin)
+			e, nn, u := enuBasis(vlat, vlon)
+			normal = add(add(scale(e, normal.X), scale(nn, normal.Y)), scale(u, normal.Z))
+			if crs == ENU {
+				pos = mc.Vector{X: dot(pos, oe), Y: dot(pos, on), Z: dot(pos, ou)}
+				normal = mc.Vector{X: dot(normal, oe), Y: dot(normal, on), Z: dot(normal, ou)}
+			}
+		}
+		p[0], p[1], p[2] = float32(pos.X), float32(pos.Y), float32(pos.Z)
+		n[0], n[1], n[2] = float32(normal.X), float32(normal.Y), float32(normal.Z)
+	}
+}
@@ -0,0 +1,118 @@
+package render
+
+import (
+	"math"
+	"testing"
+
+	"github.com/fogleman/mc"
+)
+
+func TestToCRS(t *testing.T) {
+	// KTLX
+	const lat, lon = 35.333, -97.278
+	radar := geodeticToECEF(lat, lon, 0)
+	oe, on, ou := enuBasis(lat, lon)
+
+	// one vertex pointing up and one pointing away from the radar (east above it) at each point
+	points := [][3]float64{{0, 0, 1000}, {30000, 40000, 3000}, {-100000, 0, 5000}, {300000, 200000, 12000}}
+	newMesh := func() *Mesh {
+		m := &Mesh{}
+		for _, p := range points {
+			away := [3]float32{1, 0, 0}
+			if gr := math.Hypot(p[0], p[1]); gr > 0 {
+				away = [3]float32{float32(p[0] / gr), float32(p[1] / gr), 0}
+			}
+			for _, n := range [][3]float32{{0, 0, 1}, away} {
+				m.Positions = append(m.Positions, float32(p[0]), float32(p[1]), float32(p[2]))
+				m.Normals = append(m.Normals, n[:]...)
+			}
+		}
+		return m
+	}
+
+	local := newMesh()
+	local.toCRS(lat, lon, Local)
+	if want := newMesh(); !equalFloat32s(local.Positions, want.Positions) || !equalFloat32s(local.Normals, want.Normals) {
+		t.Errorf("Local mesh changed converting to Local")
+	}
+
+	for _, crs := range []CRS{ENU, LLA, ECEF} {
+		m := newMesh()
+		m.toCRS(lat, lon, crs)
+		wantOrigin := [3]float64{}
+		if crs == ECEF {
+			wantOrigin = [3]float64{radar.X, radar.Y, radar.Z}
+		}
+		if m.Origin != wantOrigin {
+			t.Errorf("CRS %d: origin %v, want %v", crs, m.Origin, wantOrigin)
+		}
+
+		for i := 0; i < m.Vertices(); i++ {
+			p := points[i/2]
+			vlat, vlon := destination(lat, lon, math.Atan2(p[0], p[1])*180/math.Pi, math.Hypot(p[0], p[1]))
+			vert := geodeticToECEF(vlat, vlon, p[2])
+			ve, vn, vu := enuBasis(vlat, vlon)
+
+			pos := m.position(i)
+			nf := m.Normals[3*i : 3*i+3]
+			n := mc.Vector{X: float64(nf[0]), Y: float64(nf[1]), Z: float64(nf[2])}
+			var want [3]float64
+			var tol float64
+			switch crs {
+			case ENU:
+				d := sub(vert, radar)
+				want, tol = [3]float64{dot(d, oe), dot(d, on), dot(d, ou)}, 0.05
+				n = add(add(scale(oe, n.X), scale(on, n.Y)), scale(ou, n.Z))
+			case LLA:
+				want, tol = [3]float64{vlon, vlat, p[2]}, 1e-5
+				n = add(add(scale(ve, n.X), scale(vn, n.Y)), scale(vu, n.Z))
+			case ECEF:
+				want, tol = [3]float64{vert.X, vert.Y, vert.Z}, 0.05
+			}
+			for k := range want {
+				if math.Abs(pos[k]-want[k]) > tol {
+					t.Errorf("CRS %d: vertex %d at %v, want %v", crs, i, pos, want)
+					break
+				}
+			}
+
+			if l := math.Sqrt(dot(n, n)); math.Abs(l-1) > 1e-5 {
+				t.Errorf("CRS %d: normal %d has length %g", crs, i, l)
+			}
+			// in ECEF, up is the ellipsoid normal at the vertex and away is level along the great
+			// circle from the radar, the component of the vertex's direction from the center of
+			// the earth square to the radar's
+			wantDir := vu
+			if i%2 == 1 {
+				wantDir = oe
+				if math.Hypot(p[0], p[1]) > 0 {
+					a, b := unitSphere(lat, lon), unitSphere(vlat, vlon)
+					away := sub(b, scale(a, dot(a, b)))
+					bearing := math.Atan2(dot(away, ve), dot(away, vn))
+					wantDir = add(scale(ve, math.Sin(bearing)), scale(vn, math.Cos(bearing)))
+				}
+			}
+			if c := dot(n, wantDir); c < math.Cos(0.1*math.Pi/180) {
+				t.Errorf("CRS %d: normal %d is %v, %g off the expected direction", crs, i, n, math.Acos(c)*180/math.Pi)
+			}
+		}
+	}
+}
+
+// unitSphere returns the direction of lat, lon (degrees) from the center of a spherical earth
+func unitSphere(lat, lon float64) mc.Vector {
+	p, l := lat*math.Pi/180, lon*math.Pi/180
+	return mc.Vector{X: math.Cos(p) * math.Cos(l), Y: math.Cos(p) * math.Sin(l), Z: math.Sin(p)}
+}
+
+func equalFloat32s(a, b []float32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
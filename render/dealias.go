@@ -0,0 +1,113 @@
+package render
+
+import (
+	"math"
+	"sort"
+)
+
+// unfold shifts v by the multiple of 2*nyquist that brings it closest to ref
+func unfold(v, ref, nyquist float64) float64 {
+	interval := 2 * nyquist
+	return v + interval*math.Round((ref-v)/interval)
+}
+
+// Dealias returns a copy of the velocity RadialSet rs with aliased (folded) velocities corrected.
+//
+// This is a simple continuity-based scheme in the spirit of 4DD: each gate is unfolded towards a
+// reference built from its already-corrected neighbors (the previous gate along the radial and the
+// same gate on the previous radial), seeded from the least-aliased-looking radial and, if given,
+// from prev, an already dealiased sweep (e.g. the next lowest tilt of the same volume).
+//
+// rs is not modified. If rs has no Nyquist velocity, an unmodified copy is returned.
+func Dealias(rs *RadialSet, prev *RadialSet) *RadialSet {
+	out := *rs
+	out.Radials = make(RadialSlice, len(rs.Radials))
+	for i, r := range rs.Radials {
+		nr := *r
+		nr.Gates = append([]float64(nil), r.Gates...)
+		out.Radials[i] = &nr
+	}
+	sort.Sort(out.Radials)
+
+	nyquist := rs.NyquistVelocity
+	if nyquist <= 0 || len(out.Radials) == 0 {
+		return &out
+	}
+
+	var prevLookup *polarIndex
+	if prev != nil {
+		prevLookup = newPolarIndex(prev)
+	}
+	// reference value from the previous sweep, or GateEmptyValue
+	prevRef := func(r *Radial, gate int) float64 {
+		if prevLookup == nil {
+			return GateEmptyValue
+		}
+		return prevLookup.valueAt(r.AzimuthAngle, r.StartRange+float64(gate)*r.GateInterval)
+	}
+
+	// Seed from the radial whose gate-to-gate shear is smallest, as it's the least likely to be aliased
+	seed := 0
+	bestShear := math.Inf(1)
+	for i, r := range out.Radials {
+		shear, n := 0.0, 0
+		last := GateEmptyValue
+		for _, v := range r.Gates {
+			if v == GateEmptyValue {
+				continue
+			}
+			if last != GateEmptyValue {
+				shear += math.Abs(v - last)
+				n++
+			}
+			last = v
+		}
+		if n > 10 && shear/float64(n) < bestShear {
+			bestShear = shear / float64(n)
+			seed = i
+		}
+	}
+
+	// Correct one radial given the (already corrected) radial next to it, which may be nil
+	correct := func(r, neighbor *Radial) {
+		last := GateEmptyValue
+		lastIdx := -1
+		for g, v := range r.Gates {
+			if v == GateEmptyValue {
+				continue
+			}
+			sum, n := 0.0, 0
+			if neighbor != nil && g < len(neighbor.Gates) && neighbor.Gates[g] != GateEmptyValue {
+				sum += neighbor.Gates[g]
+				n++
+			}
+			// only trust the previous gate along the radial if it's close by
+			if last != GateEmptyValue && g-lastIdx <= 8 {
+				sum += last
+				n++
+			}
+			if p := prevRef(r, g); p != GateEmptyValue {
+				sum += p
+				n++
+			}
+			if n > 0 {
+				v = unfold(v, sum/float64(n), nyquist)
+				r.Gates[g] = v
+			}
+			last = v
+			lastIdx = g
+		}
+	}
+
+	correct(out.Radials[seed], nil)
+	n := len(out.Radials)
+	// walk clockwise and counter-clockwise from the seed, each halfway around
+	for i := 1; i <= n/2; i++ {
+		correct(out.Radials[(seed+i)%n], out.Radials[(seed+i-1)%n])
+	}
+	for i := 1; i < n-n/2; i++ {
+		correct(out.Radials[(seed-i+n)%n], out.Radials[(seed-i+1+n)%n])
+	}
+
+	return &out
+}
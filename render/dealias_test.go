@@ -0,0 +1,99 @@
+package render
+
+import (
+	"math"
+	"testing"
+)
+
+func TestUnfold(t *testing.T) {
+	tests := []struct {
+		v, ref, nyquist float64
+		want            float64
+	}{
+		{10, 0, 30, 10},
+		// folded once either way
+		{-25, 25, 30, 35},
+		{25, -25, 30, -35},
+		// folded twice
+		{10, 125, 30, 130},
+		// right at the Nyquist velocity, the reference picks which side it's on
+		{30, -1, 30, -30},
+		{30, 1, 30, 30},
+		{-30, 1, 30, 30},
+		{-30, -1, 30, -30},
+		// less than half an interval from the reference stays put
+		{-29, 30, 30, 31},
+		{-29, 0, 30, -29},
+	}
+	for _, tt := range tests {
+		if got := unfold(tt.v, tt.ref, tt.nyquist); got != tt.want {
+			t.Errorf("unfold(%g, %g, %g) = %g, want %g", tt.v, tt.ref, tt.nyquist, got, tt.want)
+		}
+	}
+}
+
+// velocitySweep returns a sweep of 1 degree radials with gates from f, folded into ±nyquist
+func velocitySweep(nyquist float64, gates int, f func(az float64, g int) float64) *RadialSet {
+	rs := &RadialSet{Radius: 100000, NyquistVelocity: nyquist}
+	for az := 0; az < 360; az++ {
+		r := &Radial{AzimuthAngle: float64(az), AzimuthResolution: 1, GateInterval: 250, Gates: make([]float64, gates)}
+		for g := range r.Gates {
+			v := f(float64(az), g)
+			if v != GateEmptyValue && nyquist > 0 {
+				v -= 2 * nyquist * math.Round(v/(2*nyquist))
+			}
+			r.Gates[g] = v
+		}
+		rs.Radials = append(rs.Radials, r)
+	}
+	return rs
+}
+
+func TestDealias(t *testing.T) {
+	// a smooth field peaking at 1.5x the Nyquist velocity, with a gap in every radial
+	truth := func(az float64, g int) float64 {
+		if g >= 40 && g < 45 {
+			return GateEmptyValue
+		}
+		return 45*math.Sin(az*math.Pi/180) + 0.05*float64(g)
+	}
+	uniform45 := func(float64, int) float64 { return 45 }
+	const nyquist = 30.0
+
+	tests := []struct {
+		name    string
+		nyquist float64
+		prev    *RadialSet
+		// folded into ±nyquist, this is what should come back
+		field func(az float64, g int) float64
+	}{
+		{"folded", nyquist, nil, truth},
+		{"no nyquist", 0, nil, truth},
+		// folded everywhere (to -15), so only the previous sweep can tell
+		{"with previous sweep", nyquist, velocitySweep(0, 100, uniform45), uniform45},
+	}
+	for _, tt := range tests {
+		rs := velocitySweep(tt.nyquist, 100, tt.field)
+		before := rs.Radials[90].Gates[0]
+
+		out := Dealias(rs, tt.prev)
+		if rs.Radials[90].Gates[0] != before {
+			t.Errorf("%s: input was modified", tt.name)
+		}
+		if len(out.Radials) != 360 {
+			t.Fatalf("%s: %d radials, want 360", tt.name, len(out.Radials))
+		}
+		bad := 0
+		for _, r := range out.Radials {
+			for g, v := range r.Gates {
+				want := tt.field(r.AzimuthAngle, g)
+				if math.Abs(v-want) > 1e-9 {
+					if bad < 5 {
+						t.Errorf("%s: azimuth %g gate %d = %g, want %g", tt.name, r.AzimuthAngle, g, v, want)
+					}
+					bad++
+				}
+			}
+		}
+	}
+}
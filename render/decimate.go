@@ -0,0 +1,364 @@
+package render
+
+import (
+	"container/heap"
+	"context"
+	"math"
+
+	"github.com/fogleman/mc"
+)
+
+// Quadric error mesh decimation (Garland & Heckbert, "Surface Simplification Using Quadric
+// Error Metrics"). Each vertex carries the sum of the squared distance to the planes of the
+// faces around it, and edges are collapsed cheapest first into the point minimizing that sum
+// for both ends.
+
+// Boundary edges (where surfaces are cut off by the end of the data or clipping) are held in
+// place by planes perpendicular to their face, weighted this many times more than faces
+const boundaryWeight = 1000
+
+// quadric is the upper triangle of the symmetric 4x4 matrix of a sum of squared plane
+// distances: a², ab, ac, ad, b², bc, bd, c², cd, d²
+type quadric [10]float64
+
+// planeQuadric returns the quadric of the plane n·p + d = 0 (n unit length) weighted by w
+func planeQuadric(n mc.Vector, d, w float64) quadric {
+	a, b, c := n.X, n.Y, n.Z
+	return quadric{w * a * a, w * a * b, w * a * c, w * a * d, w * b * b, w * b * c, w * b * d, w * c * c, w * c * d, w * d * d}
+}
+
+func (q quadric) add(o quadric) quadric {
+	for i := range q {
+		q[i] += o[i]
+	}
+	return q
+}
+
+// error returns the weighted sum of the squared distances from p to the planes of q
+func (q quadric) error(p mc.Vector) float64 {
+	x, y, z := p.X, p.Y, p.Z
+	e := q[0]*x*x + 2*q[1]*x*y + 2*q[2]*x*z + 2*q[3]*x + q[4]*y*y + 2*q[5]*y*z + 2*q[6]*y + q[7]*z*z + 2*q[8]*z + q[9]
+	return math.Max(e, 0)
+}
+
+// optimum returns the point minimizing q's error, or false if there isn't a single one (the
+// planes are all parallel, or all meet in a line)
+func (q quadric) optimum() (mc.Vector, bool) {
+	r0, r1, r2 := mc.Vector{X: q[0], Y: q[1], Z: q[2]}, mc.Vector{X: q[1], Y: q[4], Z: q[5]}, mc.Vector{X: q[2], Y: q[5], Z: q[7]}
+	b := mc.Vector{X: -q[3], Y: -q[6], Z: -q[8]}
+	det := dot(r0, cross(r1, r2))
+	trace := q[0] + q[4] + q[7]
+	if trace == 0 || math.Abs(det) < 1e-9*trace*trace*trace {
+		return mc.Vector{}, false
+	}
+	// Cramer's rule, with the matrix being symmetric so its rows are its columns
+	return mc.Vector{
+		X: dot(b, cross(r1, r2)) / det,
+		Y: dot(r0, cross(b, r2)) / det,
+		Z: dot(r0, cross(r1, b)) / det,
+	}, true
+}
+
+// length returns the length of a
+func length(a mc.Vector) float64 {
+	return math.Sqrt(dot(a, a))
+}
+
+// collapse is a candidate edge collapse of b into a, valid as long as neither has changed since
+type collapse struct {
+	cost   float64
+	a, b   uint32
+	va, vb uint32
+}
+
+type collapseHeap []collapse
+
+func (h collapseHeap) Len() int            { return len(h) }
+func (h collapseHeap) Less(i, j int) bool  { return h[i].cost < h[j].cost }
+func (h collapseHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *collapseHeap) Push(x interface{}) { *h = append(*h, x.(collapse)) }
+func (h *collapseHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+type decimator struct {
+	pos     []mc.Vector
+	normals []mc.Vector
+	// nil if the mesh is uncolored
+	colors  [][4]uint8
+	q       []quadric
+	version []uint32
+	removed []bool
+	faces   [][3]uint32
+	dead    []bool
+	// faces around each vertex, including ones which have since died
+	around [][]uint32
+	alive  int
+	heap   collapseHeap
+}
+
+func newDecimator(m *Mesh) *decimator {
+	n := m.Vertices()
+	d := &decimator{
+		pos:     make([]mc.Vector, n),
+		normals: make([]mc.Vector, n),
+		q:       make([]quadric, n),
+		version: make([]uint32, n),
+		removed: make([]bool, n),
+		faces:   make([][3]uint32, m.Triangles()),
+		dead:    make([]bool, m.Triangles()),
+		around:  make([][]uint32, n),
+		alive:   m.Triangles(),
+	}
+	for i := range d.pos {
+		d.pos[i] = mc.Vector{X: float64(m.Positions[3*i]), Y: float64(m.Positions[3*i+1]), Z: float64(m.Positions[3*i+2])}
+		d.normals[i] = mc.Vector{X: float64(m.Normals[3*i]), Y: float64(m.Normals[3*i+1]), Z: float64(m.Normals[3*i+2])}
+	}
+	if m.Colors != nil {
+		d.colors = make([][4]uint8, n)
+		for i := range d.colors {
+			copy(d.colors[i][:], m.Colors[4*i:4*i+4])
+		}
+	}
+	for f := range d.faces {
+		copy(d.faces[f][:], m.Indices[3*f:3*f+3])
+		for _, v := range d.faces[f] {
+			d.around[v] = append(d.around[v], uint32(f))
+		}
+	}
+
+	for _, face := range d.faces {
+		normal := cross(sub(d.pos[face[1]], d.pos[face[0]]), sub(d.pos[face[2]], d.pos[face[0]]))
+		area := length(normal) / 2
+		if area == 0 {
+			continue
+		}
+		normal = scale(normal, 1/(2*area))
+		plane := planeQuadric(normal, -dot(normal, d.pos[face[0]]), area)
+		for k, v := range face {
+			d.q[v] = d.q[v].add(plane)
+
+			a, b := v, face[(k+1)%3]
+			boundary := d.shared(a, b) == 1
+			if boundary {
+				e := sub(d.pos[b], d.pos[a])
+				if l := length(e); l > 0 {
+					side := scale(cross(e, normal), 1/l)
+					q := planeQuadric(side, -dot(side, d.pos[a]), boundaryWeight*l*l)
+					d.q[a], d.q[b] = d.q[a].add(q), d.q[b].add(q)
+				}
+			}
+			// interior edges show up in two faces, once each way
+			if a < b || boundary {
+				d.push(a, b)
+			}
+		}
+	}
+	return d
+}
+
+// shared returns how many live faces have both a and b
+func (d *decimator) shared(a, b uint32) int {
+	n := 0
+	for _, f := range d.around[a] {
+		face := d.faces[f]
+		if !d.dead[f] && (face[0] == b || face[1] == b || face[2] == b) {
+			n++
+		}
+	}
+	return n
+}
+
+// neighbors returns the vertices sharing a live face with v
+func (d *decimator) neighbors(v uint32) []uint32 {
+	var out []uint32
+	for _, f := range d.around[v] {
+		if d.dead[f] {
+			continue
+		}
+		for _, n := range d.faces[f] {
+			if n == v {
+				continue
+			}
+			seen := false
+			for _, o := range out {
+				seen = seen || o == n
+			}
+			if !seen {
+				out = append(out, n)
+			}
+		}
+	}
+	return out
+}
+
+// target returns where collapsing a and b should put the result, and the error of doing so
+func (d *decimator) target(a, b uint32) (mc.Vector, float64) {
+	q := d.q[a].add(d.q[b])
+	mid := scale(add(d.pos[a], d.pos[b]), 0.5)
+	// ill conditioned quadrics can put the optimum far off, so it has to stay near the edge
+	if p, ok := q.optimum(); ok && length(sub(p, mid)) <= length(sub(d.pos[b], d.pos[a])) {
+		return p, q.error(p)
+	}
+	best, cost := mid, q.error(mid)
+	for _, p := range []mc.Vector{d.pos[a], d.pos[b]} {
+		if e := q.error(p); e < cost {
+			best, cost = p, e
+		}
+	}
+	return best, cost
+}
+
+func (d *decimator) push(a, b uint32) {
+	_, cost := d.target(a, b)
+	heap.Push(&d.heap, collapse{cost, a, b, d.version[a], d.version[b]})
+}
+
+// collapse merges b into a, unless that would fold the surface over or leave it non-manifold
+func (d *decimator) collapse(a, b uint32) {
+	p, _ := d.target(a, b)
+
+	// Link condition: the vertices next to both a and b must only be the far corners of the
+	// faces on the edge, or collapsing it pinches the surface
+	common := 0
+	nb := d.neighbors(b)
+	for _, n := range d.neighbors(a) {
+		for _, o := range nb {
+			if n == o {
+				common++
+			}
+		}
+	}
+	if common != d.shared(a, b) {
+		return
+	}
+
+	// No face left may flip over
+	for _, v := range [2]uint32{a, b} {
+		for _, f := range d.around[v] {
+			if d.dead[f] {
+				continue
+			}
+			face := d.faces[f]
+			moved := face
+			for k := range moved {
+				if moved[k] == a || moved[k] == b {
+					moved[k] = a
+				}
+			}
+			if moved[0] == moved[1] || moved[1] == moved[2] || moved[0] == moved[2] {
+				// on the edge, so it goes away
+				continue
+			}
+			before := cross(sub(d.pos[face[1]], d.pos[face[0]]), sub(d.pos[face[2]], d.pos[face[0]]))
+			corner := func(k int) mc.Vector {
+				if moved[k] == a {
+					return p
+				}
+				return d.pos[moved[k]]
+			}
+			after := cross(sub(corner(1), corner(0)), sub(corner(2), corner(0)))
+			if dot(after, before) <= 0 {
+				return
+			}
+		}
+	}
+
+	var around []uint32
+	for _, v := range [2]uint32{a, b} {
+		for _, f := range d.around[v] {
+			if d.dead[f] {
+				continue
+			}
+			face := &d.faces[f]
+			hasA := face[0] == a || face[1] == a || face[2] == a
+			hasB := face[0] == b || face[1] == b || face[2] == b
+			if hasA && hasB {
+				d.dead[f] = true
+				d.alive--
+				continue
+			}
+			for k := range face {
+				if face[k] == b {
+					face[k] = a
+				}
+			}
+			around = append(around, f)
+		}
+	}
+	if d.colors != nil && length(sub(p, d.pos[b])) < length(sub(p, d.pos[a])) {
+		d.colors[a] = d.colors[b]
+	}
+	if n := normalize(add(d.normals[a], d.normals[b])); n != (mc.Vector{}) {
+		d.normals[a] = n
+	}
+	d.pos[a] = p
+	d.q[a] = d.q[a].add(d.q[b])
+	d.around[a], d.around[b] = around, nil
+	d.removed[b] = true
+	d.version[a]++
+	for _, n := range d.neighbors(a) {
+		d.push(a, n)
+	}
+}
+
+// How many collapses to make between checks for cancellation
+const collapsesPerCheck = 4096
+
+// Decimate collapses edges of m, cheapest first, until it has at most maxTriangles triangles
+// (or nothing more can be collapsed without folding the surface over). m is left as it was if
+// ctx is canceled first.
+func (m *Mesh) Decimate(ctx context.Context, maxTriangles int) error {
+	if m.Triangles() <= maxTriangles {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d := newDecimator(m)
+	for n := 0; d.alive > maxTriangles && d.heap.Len() > 0; n++ {
+		if n%collapsesPerCheck == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		c := heap.Pop(&d.heap).(collapse)
+		if d.removed[c.a] || d.removed[c.b] || d.version[c.a] != c.va || d.version[c.b] != c.vb {
+			continue
+		}
+		d.collapse(c.a, c.b)
+	}
+
+	// compact what's left
+	const unused = math.MaxUint32
+	remap := make([]uint32, len(d.pos))
+	for i := range remap {
+		remap[i] = unused
+	}
+	out := Mesh{Name: m.Name}
+	if d.colors != nil {
+		out.Colors = []uint8{}
+	}
+	for f, face := range d.faces {
+		if d.dead[f] {
+			continue
+		}
+		for _, v := range face {
+			if remap[v] == unused {
+				remap[v] = uint32(out.Vertices())
+				p, n := d.pos[v], d.normals[v]
+				out.Positions = append(out.Positions, float32(p.X), float32(p.Y), float32(p.Z))
+				out.Normals = append(out.Normals, float32(n.X), float32(n.Y), float32(n.Z))
+				if d.colors != nil {
+					out.Colors = append(out.Colors, d.colors[v][:]...)
+				}
+			}
+			out.Indices = append(out.Indices, remap[v])
+		}
+	}
+	*m = out
+	return nil
+}
@@ -0,0 +1,80 @@
+package render
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+// planeMesh returns a unit square in the z=0 plane split into n*n quads, facing +z
+func planeMesh(n int) *Mesh {
+	m := &Mesh{}
+	for y := 0; y <= n; y++ {
+		for x := 0; x <= n; x++ {
+			m.Positions = append(m.Positions, float32(x)/float32(n), float32(y)/float32(n), 0)
+			m.Normals = append(m.Normals, 0, 0, 1)
+		}
+	}
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			i := uint32(y*(n+1) + x)
+			j := i + uint32(n+1)
+			m.Indices = append(m.Indices, i, i+1, j+1, i, j+1, j)
+		}
+	}
+	return m
+}
+
+func TestDecimatePlane(t *testing.T) {
+	for _, max := range []int{200, 50, 8, 2} {
+		m := planeMesh(10)
+		if err := m.Decimate(context.Background(), max); err != nil {
+			t.Fatal(err)
+		}
+		if m.Triangles() > max {
+			t.Errorf("max %d: %d triangles left", max, m.Triangles())
+		}
+
+		// a plane can be simplified without error, and its boundary is held in place, so the
+		// result must still exactly cover the unit square
+		area := 0.0
+		for f := 0; f < m.Triangles(); f++ {
+			n := m.faceNormal(f)
+			if n[2] < 0.999 {
+				t.Errorf("max %d: face %d faces %v, want +z", max, f, n)
+			}
+			p := [3][3]float64{m.position(int(m.Indices[3*f])), m.position(int(m.Indices[3*f+1])), m.position(int(m.Indices[3*f+2]))}
+			area += ((p[1][0]-p[0][0])*(p[2][1]-p[0][1]) - (p[2][0]-p[0][0])*(p[1][1]-p[0][1])) / 2
+		}
+		if math.Abs(area-1) > 1e-5 {
+			t.Errorf("max %d: area %g, want 1", max, area)
+		}
+		for i := 0; i < m.Vertices(); i++ {
+			p := m.position(i)
+			if p[2] != 0 || p[0] < -1e-6 || p[0] > 1+1e-6 || p[1] < -1e-6 || p[1] > 1+1e-6 {
+				t.Errorf("max %d: vertex %d at %v left the unit square", max, i, p)
+			}
+		}
+	}
+}
+
+func TestDecimateNothingToDo(t *testing.T) {
+	m := planeMesh(2)
+	before := len(m.Indices)
+	if err := m.Decimate(context.Background(), 100); err != nil || len(m.Indices) != before {
+		t.Errorf("decimating under the limit changed the mesh (%v)", err)
+	}
+}
+
+func TestDecimateCanceled(t *testing.T) {
+	m := planeMesh(50)
+	before := m.Triangles()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Decimate(ctx, 10); err != context.Canceled {
+		t.Errorf("Decimate with a canceled context = %v, want context.Canceled", err)
+	}
+	if m.Triangles() != before {
+		t.Errorf("canceled Decimate changed the mesh from %d to %d triangles", before, m.Triangles())
+	}
+}
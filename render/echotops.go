@@ -0,0 +1,104 @@
+package render
+
+import "math"
+
+const (
+	// Echo tops threshold (dBZ) if none is given, and the one used for VIL density
+	DefaultEchoTopsThreshold = 18.0
+	// Reflectivity is capped here when computing VIL, so hail doesn't count as a huge amount of water
+	vilMaxDBZ = 56.0
+	// Sweeps closer than this are treated as the same angle (e.g. SAILS repeats)
+	sameElevationTolerance = 0.1
+	feetPerMeter           = 3.28084
+)
+
+// echoTopHeight returns the height in meters above the antenna of the highest reflectivity of
+// at least threshold in col, or -1 if there isn't any.
+// Rather than the center of the highest beam reaching threshold, the height is interpolated
+// toward the next beam up according to how far above threshold the value is.
+func echoTopHeight(col []columnSample, threshold float64) float64 {
+	top := -1
+	for i, s := range col {
+		if s.Value != GateEmptyValue && s.Value >= threshold {
+			top = i
+		}
+	}
+	if top < 0 {
+		return -1
+	}
+
+	t := col[top]
+	for _, s := range col[top+1:] {
+		if s.ElevationAngle-t.ElevationAngle < sameElevationTolerance {
+			continue
+		}
+		// nothing there at all, so there's no telling where it dropped off
+		if s.Value == GateEmptyValue {
+			break
+		}
+		return t.Height + (t.Value-threshold)/(t.Value-s.Value)*(s.Height-t.Height)
+	}
+	return t.Height
+}
+
+// EchoTops returns the height (in thousands of feet above sea level) of the highest
+// reflectivity of at least threshold dBZ above each point on the ground
+func EchoTops(elvs ElevationSet, threshold float64) *RadialSet {
+	height := 0.0
+	if len(elvs) > 0 {
+		height = elvs[0].Height
+	}
+	return reduceColumns(elvs, func(col []columnSample) float64 {
+		h := echoTopHeight(col, threshold)
+		if h < 0 {
+			return GateEmptyValue
+		}
+		return (h + height) * feetPerMeter / 1000
+	})
+}
+
+// columnVIL returns the vertically integrated liquid of col in kg/m², integrating the
+// Marshall-Palmer liquid water content between each pair of beams
+func columnVIL(col []columnSample) float64 {
+	z := func(dbz float64) float64 {
+		if dbz == GateEmptyValue {
+			return 0
+		}
+		return math.Pow(10, math.Min(dbz, vilMaxDBZ)/10)
+	}
+
+	vil := 0.0
+	for i := 1; i < len(col); i++ {
+		lo, hi := col[i-1], col[i]
+		dh := hi.Height - lo.Height
+		if dh <= 0 {
+			continue
+		}
+		vil += 3.44e-6 * math.Pow((z(lo.Value)+z(hi.Value))/2, 4.0/7) * dh
+	}
+	return vil
+}
+
+// VIL returns the vertically integrated liquid (kg/m²) above each point on the ground
+func VIL(elvs ElevationSet) *RadialSet {
+	return reduceColumns(elvs, func(col []columnSample) float64 {
+		vil := columnVIL(col)
+		if vil <= 0 {
+			return GateEmptyValue
+		}
+		return vil
+	})
+}
+
+// VILDensity returns VIL divided by the 18 dBZ echo top height (g/m³) above each point on the
+// ground, which normalizes away storm depth and so better flags hail
+func VILDensity(elvs ElevationSet) *RadialSet {
+	return reduceColumns(elvs, func(col []columnSample) float64 {
+		vil := columnVIL(col)
+		top := echoTopHeight(col, DefaultEchoTopsThreshold)
+		if vil <= 0 || top <= 0 {
+			return GateEmptyValue
+		}
+		return vil / top * 1000
+	})
+}
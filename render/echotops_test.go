@@ -0,0 +1,112 @@
+package render
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEchoTopHeight(t *testing.T) {
+	s := func(elev, height, value float64) columnSample {
+		return columnSample{ElevationAngle: elev, Height: height, Value: value}
+	}
+	const empty = GateEmptyValue
+	tests := []struct {
+		name string
+		col  []columnSample
+		want float64
+	}{
+		{"empty column", nil, -1},
+		{"nothing reaches threshold", []columnSample{s(0.5, 1000, 17.9), s(1.5, 3000, 10)}, -1},
+		{"all empty", []columnSample{s(0.5, 1000, empty), s(1.5, 3000, empty)}, -1},
+		// 12 of the 20 dB drop to the next beam is above threshold
+		{"interpolated", []columnSample{s(0.5, 1000, 30), s(1.5, 3000, 10)}, 2200},
+		{"exactly at threshold", []columnSample{s(0.5, 1000, 18), s(1.5, 3000, 8)}, 1000},
+		{"top beam", []columnSample{s(0.5, 1000, 30), s(1.5, 3000, 25)}, 3000},
+		{"next beam empty", []columnSample{s(0.5, 1000, 30), s(1.5, 3000, empty)}, 1000},
+		{"highest of several", []columnSample{s(0.5, 1000, 30), s(1.5, 2000, 5), s(2.4, 3000, 28), s(3.4, 4000, 8)}, 3500},
+		// a SAILS repeat of the same tilt isn't a beam above it
+		{"same angle skipped", []columnSample{s(0.5, 1000, 30), s(0.52, 1020, 10), s(1.5, 3000, 10)}, 2200},
+	}
+	for _, tt := range tests {
+		if got := echoTopHeight(tt.col, DefaultEchoTopsThreshold); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: echoTopHeight = %g, want %g", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestColumnVIL(t *testing.T) {
+	s := func(height, value float64) columnSample {
+		return columnSample{Height: height, Value: value}
+	}
+	tests := []struct {
+		name string
+		col  []columnSample
+		want float64
+	}{
+		{"single beam", []columnSample{s(1000, 40)}, 0},
+		{"uniform 40 dBZ", []columnSample{s(1000, 40), s(2000, 40)}, 0.66416},
+		{"empty counts as nothing", []columnSample{s(1000, GateEmptyValue), s(2000, 40)}, 0.44695},
+		{"capped at 56 dBZ", []columnSample{s(1000, 56), s(2000, 56)}, 5.45203},
+		{"hail capped", []columnSample{s(1000, 70), s(2000, 65)}, 5.45203},
+		{"layers add up", []columnSample{s(1000, 40), s(2000, 30), s(4000, GateEmptyValue)}, 0.71177},
+		// no layer between the first two, but the second still counts (capped) with the third
+		{"repeated height skipped", []columnSample{s(1000, 40), s(1000, 70), s(2000, 40)}, 3.72133},
+	}
+	for _, tt := range tests {
+		if got := columnVIL(tt.col); math.Abs(got-tt.want) > 1e-4 {
+			t.Errorf("%s: columnVIL = %g, want %g", tt.name, got, tt.want)
+		}
+	}
+}
+
+// uniformSweep returns a sweep at elev with every gate within 40km set to value
+func uniformSweep(elev, value float64) *RadialSet {
+	rs := &RadialSet{Radius: 50000, Height: 400, ElevationAngle: elev}
+	for az := 0; az < 360; az++ {
+		r := &Radial{AzimuthAngle: float64(az), AzimuthResolution: 1, GateInterval: 250, Gates: make([]float64, 200)}
+		for g := range r.Gates {
+			r.Gates[g] = GateEmptyValue
+			if g < 160 {
+				r.Gates[g] = value
+			}
+		}
+		rs.Radials = append(rs.Radials, r)
+	}
+	return rs
+}
+
+func TestVolumeColumnProducts(t *testing.T) {
+	// out of order, as volumes may be
+	elvs := ElevationSet{uniformSweep(1.5, 30), uniformSweep(0.5, 40), uniformSweep(3.0, 10)}
+
+	// heights of each beam above 20km along the ground
+	const gr = 20000.0
+	h := func(elev float64) float64 { return beamHeight(slantRange(gr, elev), elev) }
+	top := h(1.5) + 12.0/20*(h(3.0)-h(1.5))
+	col := []columnSample{{0.5, 0, h(0.5), 40}, {1.5, 0, h(1.5), 30}, {3.0, 0, h(3.0), 10}}
+	vil := columnVIL(col)
+
+	tests := []struct {
+		name string
+		rs   *RadialSet
+		want float64
+	}{
+		{"echo tops", EchoTops(elvs, DefaultEchoTopsThreshold), (top + 400) * feetPerMeter / 1000},
+		{"echo tops above the 1.5 beam", EchoTops(elvs, 35), (h(0.5) + 5.0/10*(h(1.5)-h(0.5)) + 400) * feetPerMeter / 1000},
+		{"echo tops above everything", EchoTops(elvs, 45), GateEmptyValue},
+		{"vil", VIL(elvs), vil},
+		{"vil density", VILDensity(elvs), vil / top * 1000},
+	}
+	for _, tt := range tests {
+		for _, az := range []int{0, 123} {
+			r := tt.rs.Radials[az]
+			if got := r.Gates[int(gr/r.GateInterval)]; math.Abs(got-tt.want) > 1e-6 {
+				t.Errorf("%s: azimuth %d at %gm = %g, want %g", tt.name, az, gr, got, tt.want)
+			}
+			// beyond the data, everything's empty
+			if got := r.Gates[180]; got != GateEmptyValue {
+				t.Errorf("%s: azimuth %d at 45km = %g, want empty", tt.name, az, got)
+			}
+		}
+	}
+}
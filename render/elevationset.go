@@ -1,7 +1,17 @@
 package render
 
+import "sort"
+
 type ElevationSet []*RadialSet
 
 func (es ElevationSet) Len() int           { return len(es) }
 func (es ElevationSet) Less(i, j int) bool { return es[i].ElevationAngle < es[j].ElevationAngle }
 func (es ElevationSet) Swap(i, j int)      { es[i], es[j] = es[j], es[i] }
+
+// sorted returns a copy of es in ascending elevation angle order, keeping the order of sweeps
+// at the same angle. ElevationSets are often shared (e.g. cached), so they're never sorted in place.
+func (es ElevationSet) sorted() ElevationSet {
+	out := append(ElevationSet(nil), es...)
+	sort.Stable(out)
+	return out
+}
@@ -0,0 +1,70 @@
+package render
+
+import (
+	"io"
+	"os"
+
+	"github.com/airbusgeo/godal"
+)
+
+// GeoTIFF writes r into a single band float32 GeoTIFF, with GateEmptyValue as nodata
+func (r *Raster) GeoTIFF() (io.ReadCloser, error) {
+	return r.translate([]string{"-of", "GTiff", "-co", "COMPRESS=DEFLATE", "-co", "PREDICTOR=3"})
+}
+
+// COG is GeoTIFF, but produces a Cloud Optimized GeoTIFF (tiled, with overviews)
+func (r *Raster) COG() (io.ReadCloser, error) {
+	return r.translate([]string{"-of", "COG", "-co", "COMPRESS=DEFLATE", "-co", "PREDICTOR=YES", "-co", "RESAMPLING=NEAREST"})
+}
+
+// translate writes r to a file with translateSwitches
+func (r *Raster) translate(translateSwitches []string) (io.ReadCloser, error) {
+	godal.RegisterAll()
+	t := r.Target
+
+	ds, err := godal.Create(godal.DriverName("MEM"), "", 1, godal.Float32, t.Width, t.Height)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+
+	sr, err := godal.NewSpatialRef(t.SRS)
+	if err != nil {
+		return nil, err
+	}
+	defer sr.Close()
+	if err := ds.SetSpatialRef(sr); err != nil {
+		return nil, err
+	}
+	resX := (t.Extent[2] - t.Extent[0]) / float64(t.Width)
+	resY := (t.Extent[3] - t.Extent[1]) / float64(t.Height)
+	if err := ds.SetGeoTransform([6]float64{t.Extent[0], resX, 0, t.Extent[3], 0, -resY}); err != nil {
+		return nil, err
+	}
+	band := ds.Bands()[0]
+	if err := band.SetNoData(GateEmptyValue); err != nil {
+		return nil, err
+	}
+	if err := band.Write(0, 0, r.Values, t.Width, t.Height); err != nil {
+		return nil, err
+	}
+
+	tmpf, err := os.CreateTemp("", "*.tif")
+	if err != nil {
+		return nil, err
+	}
+	tmpname := tmpf.Name()
+	tmpf.Close()
+	outDS, err := ds.Translate(tmpname, translateSwitches)
+	if err != nil {
+		os.Remove(tmpname)
+		return nil, err
+	}
+	outDS.Close()
+
+	f, err := os.Open(tmpname)
+	if err != nil {
+		return nil, err
+	}
+	return removeOnClose{f}, nil
+}
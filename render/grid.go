@@ -0,0 +1,193 @@
+package render
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Half power beam width of the WSR-88D in degrees
+const beamWidth = 0.95
+
+// interpolateColumn returns the value at height h (meters above the antenna) in col, linearly
+// interpolated between the beams above and below it. Where there's only a beam on one side
+// (or the other is empty), h has to be within that beam for its value to be used.
+func interpolateColumn(col []columnSample, h float64) float64 {
+	// whether h is within the beam of s
+	within := func(s columnSample) bool {
+		return math.Abs(h-s.Height) <= s.Range*math.Tan(beamWidth/2*math.Pi/180)
+	}
+	nearest := func(s columnSample) float64 {
+		if s.Value == GateEmptyValue || !within(s) {
+			return GateEmptyValue
+		}
+		return s.Value
+	}
+
+	if len(col) == 0 {
+		return GateEmptyValue
+	}
+	if h < col[0].Height {
+		return nearest(col[0])
+	}
+	for i := 1; i < len(col); i++ {
+		lo, hi := col[i-1], col[i]
+		if h >= hi.Height {
+			continue
+		}
+		switch {
+		case lo.Value == GateEmptyValue && hi.Value == GateEmptyValue:
+			return GateEmptyValue
+		case lo.Value == GateEmptyValue:
+			return nearest(hi)
+		case hi.Value == GateEmptyValue:
+			return nearest(lo)
+		}
+		t := (h - lo.Height) / (hi.Height - lo.Height)
+		return lo.Value + t*(hi.Value-lo.Value)
+	}
+	return nearest(col[len(col)-1])
+}
+
+// CAPPI returns the constant altitude PPI of a volume: its values at altitude (meters above
+// sea level) above each point on the ground
+func CAPPI(elvs ElevationSet, altitude float64) *RadialSet {
+	height := 0.0
+	if len(elvs) > 0 {
+		height = elvs[0].Height
+	}
+	return reduceColumns(elvs, func(col []columnSample) float64 {
+		return interpolateColumn(col, altitude-height)
+	})
+}
+
+// GridSpec describes a Cartesian grid centered on a radar
+type GridSpec struct {
+	// Horizontal distance between columns in meters
+	Spacing float64
+	// How far the grid extends from the radar along each axis in meters
+	Radius float64
+	// Height of each level in meters above sea level, ascending
+	Heights []float64
+}
+
+// Grid is a volume interpolated onto a regular grid in the azimuthal equidistant projection
+// centered on the radar (X east, Y north, both in meters from the radar)
+type Grid struct {
+	Lat float64
+	Lon float64
+	// Height of the antenna in meters above sea level
+	Height  float64
+	Spacing float64
+	// Columns along X and Y
+	NX int
+	NY int
+	// Coordinates of the southwest-most column
+	X0 float64
+	Y0 float64
+	// Height of each level in meters above sea level
+	Heights []float64
+	// Indexed by (level*NY + y)*NX + x, GateEmptyValue where there's no data
+	Values []float32
+}
+
+// volumeSampler builds the columns of a volume above arbitrary points on the ground
+type volumeSampler struct {
+	// Sorted by elevation angle
+	elvs    ElevationSet
+	lookups []func(az, rng float64) float64
+}
+
+func newVolumeSampler(elvs ElevationSet, interp Interpolation) *volumeSampler {
+	elvs = elvs.sorted()
+	v := &volumeSampler{elvs: elvs, lookups: make([]func(az, rng float64) float64, len(elvs))}
+	for i, rs := range elvs {
+		idx := newPolarIndex(rs)
+		v.lookups[i] = idx.valueAt
+		if interp == Bilinear {
+			v.lookups[i] = idx.bilinearAt
+		}
+	}
+	return v
+}
+
+// column appends the samples of every elevation reaching ground range gr (meters) at azimuth az to col
+func (v *volumeSampler) column(col []columnSample, gr, az float64) []columnSample {
+	for e, rs := range v.elvs {
+		rng := slantRange(gr, rs.ElevationAngle)
+		if math.IsInf(rng, 1) || rng > float64(rs.Radius) {
+			continue
+		}
+		col = append(col, columnSample{rs.ElevationAngle, rng, beamHeight(rng, rs.ElevationAngle), v.lookups[e](az, rng)})
+	}
+	return col
+}
+
+// NewGrid interpolates the volume elvs onto the grid spec describes. Horizontally each
+// elevation is sampled with interp; vertically values are linearly interpolated between beams.
+func NewGrid(ctx context.Context, elvs ElevationSet, spec GridSpec, interp Interpolation) (*Grid, error) {
+	vs := newVolumeSampler(elvs, interp)
+
+	n := int(spec.Radius / spec.Spacing)
+	g := &Grid{
+		Spacing: spec.Spacing,
+		NX:      2*n + 1,
+		NY:      2*n + 1,
+		X0:      -float64(n) * spec.Spacing,
+		Y0:      -float64(n) * spec.Spacing,
+		Heights: spec.Heights,
+	}
+	if len(elvs) > 0 {
+		g.Lat, g.Lon, g.Height = elvs[0].Lat, elvs[0].Lon, elvs[0].Height
+	}
+	g.Values = make([]float32, g.NX*g.NY*len(g.Heights))
+	for i := range g.Values {
+		g.Values[i] = rasterEmptyValue
+	}
+
+	rows := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			col := make([]columnSample, 0, len(elvs))
+			for y := range rows {
+				fy := g.Y0 + float64(y)*g.Spacing
+				for x := 0; x < g.NX; x++ {
+					fx := g.X0 + float64(x)*g.Spacing
+					// distances in the azimuthal equidistant projection are ground distances from the radar
+					az := math.Atan2(fx, fy) * 180 / math.Pi
+					if az < 0 {
+						az += 360
+					}
+					col = vs.column(col[:0], math.Hypot(fx, fy), az)
+					if len(col) == 0 {
+						continue
+					}
+					for z, h := range g.Heights {
+						if v := interpolateColumn(col, h-g.Height); v != GateEmptyValue {
+							g.Values[(z*g.NY+y)*g.NX+x] = float32(v)
+						}
+					}
+				}
+			}
+		}()
+	}
+
+	var canceled error
+	for y := 0; y < g.NY; y++ {
+		if err := ctx.Err(); err != nil {
+			canceled = err
+			break
+		}
+		rows <- y
+	}
+	close(rows)
+	wg.Wait()
+	if canceled != nil {
+		return nil, canceled
+	}
+	return g, nil
+}
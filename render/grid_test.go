@@ -0,0 +1,44 @@
+package render
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInterpolateColumn(t *testing.T) {
+	const empty = GateEmptyValue
+	// the beam is about 414m either side of its center at 50km, 497m at 60km
+	lo := columnSample{ElevationAngle: 0.5, Range: 50000, Height: 1000, Value: 20}
+	hi := columnSample{ElevationAngle: 2.4, Range: 60000, Height: 3000, Value: 40}
+	loEmpty, hiEmpty := lo, hi
+	loEmpty.Value, hiEmpty.Value = empty, empty
+
+	tests := []struct {
+		name string
+		col  []columnSample
+		h    float64
+		want float64
+	}{
+		{"empty column", nil, 1000, empty},
+		{"between beams", []columnSample{lo, hi}, 2000, 30},
+		{"quarter way", []columnSample{lo, hi}, 1500, 25},
+		{"at lowest beam", []columnSample{lo, hi}, 1000, 20},
+		{"at highest beam", []columnSample{lo, hi}, 3000, 40},
+		{"below lowest within beam", []columnSample{lo, hi}, 600, 20},
+		{"below lowest beyond beam", []columnSample{lo, hi}, 580, empty},
+		{"above highest within beam", []columnSample{lo, hi}, 3490, 40},
+		{"above highest beyond beam", []columnSample{lo, hi}, 3510, empty},
+		{"upper empty within lower beam", []columnSample{lo, hiEmpty}, 1400, 20},
+		{"upper empty beyond lower beam", []columnSample{lo, hiEmpty}, 1420, empty},
+		{"lower empty within upper beam", []columnSample{loEmpty, hi}, 2510, 40},
+		{"lower empty beyond upper beam", []columnSample{loEmpty, hi}, 2500, empty},
+		{"both empty", []columnSample{loEmpty, hiEmpty}, 2000, empty},
+		{"single beam", []columnSample{lo}, 1200, 20},
+		{"below empty lowest", []columnSample{loEmpty, hi}, 900, empty},
+	}
+	for _, tt := range tests {
+		if got := interpolateColumn(tt.col, tt.h); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: interpolateColumn(%g) = %g, want %g", tt.name, tt.h, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package render
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+)
+
+// GridEncoding is how WriteGrid stores grid values
+type GridEncoding int
+
+const (
+	// Uint8 quantizes values linearly from the smallest to the largest in the grid onto 1-255,
+	// with 0 where there's no data
+	Uint8 GridEncoding = iota
+	// Float16 stores IEEE 754 half precision values, NaN where there's no data
+	Float16
+)
+
+// GridHeader describes the values following it in a binary grid
+type GridHeader struct {
+	Lat float64
+	Lon float64
+	// Height of the antenna in meters above sea level
+	Height  float64
+	Spacing float64
+	// Columns along X and Y
+	NX int
+	NY int
+	// Coordinates of the southwest-most column, in meters east and north of the radar
+	X0 float64
+	Y0 float64
+	// Height of each level in meters above sea level
+	Heights []float64
+	// "uint8" or "float16"
+	Encoding string
+	// Non-zero uint8 values v are Offset + v*Scale
+	Scale  float64 `json:",omitempty"`
+	Offset float64 `json:",omitempty"`
+}
+
+// float16 returns the nearest half precision float to f
+func float16(f float32) uint16 {
+	b := math.Float32bits(f)
+	sign := uint16(b>>16) & 0x8000
+	exp := int(b>>23&0xff) - 127 + 15
+	mant := b & 0x7fffff
+	switch {
+	case f != f:
+		return sign | 0x7e00
+	case exp >= 0x1f:
+		// too large (or already infinite)
+		return sign | 0x7c00
+	case exp <= 0:
+		if exp < -10 {
+			return sign
+		}
+		// subnormal: shift the implicit leading 1 down into the mantissa
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		half := uint32(1) << (shift - 1)
+		v := mant >> shift
+		if r := mant & (1<<shift - 1); r > half || (r == half && v&1 == 1) {
+			v++
+		}
+		return sign | uint16(v)
+	}
+	// round to nearest even, carrying into the exponent (and up to infinity) if need be
+	v := uint32(exp)<<10 | mant>>13
+	if r := mant & 0x1fff; r > 0x1000 || (r == 0x1000 && v&1 == 1) {
+		v++
+	}
+	return sign | uint16(v)
+}
+
+// WriteGrid writes g as a little endian binary grid: "RGRD", the format version (1) and the
+// length of the header as uint32s, the JSON GridHeader (padded with spaces so the values are
+// 4 byte aligned), then NX*NY*len(Heights) values in enc indexed like Grid.Values.
+func WriteGrid(g *Grid, enc GridEncoding, w io.Writer) error {
+	hdr := GridHeader{
+		Lat:     g.Lat,
+		Lon:     g.Lon,
+		Height:  g.Height,
+		Spacing: g.Spacing,
+		NX:      g.NX,
+		NY:      g.NY,
+		X0:      g.X0,
+		Y0:      g.Y0,
+		Heights: g.Heights,
+	}
+
+	var values []byte
+	switch enc {
+	case Uint8:
+		hdr.Encoding = "uint8"
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, v := range g.Values {
+			if v != rasterEmptyValue {
+				lo, hi = math.Min(lo, float64(v)), math.Max(hi, float64(v))
+			}
+		}
+		hdr.Scale = 1
+		if hi > lo {
+			hdr.Scale = (hi - lo) / 254
+		}
+		if !math.IsInf(lo, 1) {
+			// so the smallest value is 1
+			hdr.Offset = lo - hdr.Scale
+		}
+		values = make([]byte, len(g.Values))
+		for i, v := range g.Values {
+			if v != rasterEmptyValue {
+				values[i] = uint8(math.Max(1, math.Min(255, math.Round((float64(v)-hdr.Offset)/hdr.Scale))))
+			}
+		}
+	case Float16:
+		hdr.Encoding = "float16"
+		values = make([]byte, 2*len(g.Values))
+		for i, v := range g.Values {
+			h := uint16(0x7e00)
+			if v != rasterEmptyValue {
+				h = float16(v)
+			}
+			values[2*i], values[2*i+1] = byte(h), byte(h>>8)
+		}
+	}
+
+	doc, err := json.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+	for (12+len(doc))%4 != 0 {
+		doc = append(doc, ' ')
+	}
+
+	lw := &leWriter{Writer: bufio.NewWriter(w)}
+	lw.uint32(0x44524752) // "RGRD"
+	lw.uint32(1)
+	lw.uint32(uint32(len(doc)))
+	lw.Write(doc)
+	lw.Write(values)
+	return lw.Flush()
+}
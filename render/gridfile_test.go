@@ -0,0 +1,107 @@
+package render
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestFloat16(t *testing.T) {
+	tests := []struct {
+		f    float32
+		want uint16
+	}{
+		{0, 0x0000},
+		{1, 0x3c00},
+		{-2, 0xc000},
+		{0.333333343, 0x3555},
+		// largest normal, and just past it rounding up to infinity
+		{65504, 0x7bff},
+		{65520, 0x7c00},
+		{1e9, 0x7c00},
+		{float32(math.Inf(-1)), 0xfc00},
+		// smallest normal and subnormal, and half the smallest subnormal rounding to even (0)
+		{6.103515625e-05, 0x0400},
+		{5.960464477539063e-08, 0x0001},
+		{2.98023223876953125e-08, 0x0000},
+		// ties round to even
+		{1.00048828125, 0x3c00},
+		{1.00146484375, 0x3c02},
+		{1.0009765625, 0x3c01},
+	}
+	for _, tt := range tests {
+		if got := float16(tt.f); got != tt.want {
+			t.Errorf("float16(%g) = %04x, want %04x", tt.f, got, tt.want)
+		}
+	}
+	if got := float16(float32(math.NaN())); got&0x7c00 != 0x7c00 || got&0x3ff == 0 {
+		t.Errorf("float16(NaN) = %04x, want a NaN", got)
+	}
+}
+
+// readGrid splits a binary grid into its header and values
+func readGrid(t *testing.T, b []byte) (GridHeader, []byte) {
+	t.Helper()
+	if string(b[:4]) != "RGRD" || binary.LittleEndian.Uint32(b[4:]) != 1 {
+		t.Fatalf("bad magic or version: % x", b[:8])
+	}
+	n := binary.LittleEndian.Uint32(b[8:])
+	if (12+n)%4 != 0 {
+		t.Errorf("values start at %d, not 4 byte aligned", 12+n)
+	}
+	var hdr GridHeader
+	if err := json.Unmarshal(b[12:12+n], &hdr); err != nil {
+		t.Fatal(err)
+	}
+	return hdr, b[12+n:]
+}
+
+func TestWriteGrid(t *testing.T) {
+	g := &Grid{
+		Lat: 35.333, Lon: -97.278, Height: 390, Spacing: 1000,
+		NX: 3, NY: 2, X0: -1000, Y0: -500,
+		Heights: []float64{1000},
+		Values:  []float32{rasterEmptyValue, 10, 20, 42.5, 75, rasterEmptyValue},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteGrid(g, Uint8, &buf); err != nil {
+		t.Fatal(err)
+	}
+	hdr, values := readGrid(t, buf.Bytes())
+	if hdr.Encoding != "uint8" || hdr.NX != 3 || hdr.NY != 2 || hdr.X0 != -1000 || hdr.Y0 != -500 || hdr.Spacing != 1000 || len(hdr.Heights) != 1 || hdr.Lat != g.Lat {
+		t.Errorf("header = %+v", hdr)
+	}
+	if len(values) != len(g.Values) {
+		t.Fatalf("%d uint8 values, want %d", len(values), len(g.Values))
+	}
+	for i, v := range g.Values {
+		switch {
+		case v == rasterEmptyValue && values[i] != 0:
+			t.Errorf("value %d is %d, want 0 for no data", i, values[i])
+		case v != rasterEmptyValue && math.Abs(hdr.Offset+float64(values[i])*hdr.Scale-float64(v)) > hdr.Scale/2+1e-9:
+			t.Errorf("value %d decodes to %g, want %g", i, hdr.Offset+float64(values[i])*hdr.Scale, v)
+		}
+	}
+	// the range is spread over all of 1-255
+	if values[1] != 1 || values[4] != 255 {
+		t.Errorf("smallest and largest values quantized to %d and %d, want 1 and 255", values[1], values[4])
+	}
+
+	buf.Reset()
+	if err := WriteGrid(g, Float16, &buf); err != nil {
+		t.Fatal(err)
+	}
+	hdr, values = readGrid(t, buf.Bytes())
+	if hdr.Encoding != "float16" {
+		t.Errorf("encoding = %q", hdr.Encoding)
+	}
+	want := []uint16{0x7e00, 0x4900, 0x4d00, 0x5150, 0x54b0, 0x7e00}
+	for i, w := range want {
+		if got := binary.LittleEndian.Uint16(values[2*i:]); got != w {
+			t.Errorf("float16 value %d = %04x, want %04x", i, got, w)
+		}
+	}
+}
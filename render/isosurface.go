@@ -2,10 +2,10 @@ package render
 
 import (
 	"context"
-	"fmt"
-	"io"
+	"image/color"
 	"math"
 	"sort"
+	"sync"
 
 	"github.com/fogleman/mc"
 )
@@ -13,147 +13,536 @@ import (
 // http://opengmsteam.com/articles/3D%20modelling%20strategy%20for%20weather%20radar%20data%20analysis.pdf
 // tl;dr
 //   - subsample data to have a consistent number of (and consistent placement of) radials
-//   - but we don't have to because NEXRAD is consistent
 //   - construct hexahedrons between sectors (adjacent elevations)
 //   - do marching cubes on the hexahedrons
 //
-// Resulting tris are Z up
-func CreateIsosurface(ctx context.Context, elvs ElevationSet, threshold float64) []mc.Triangle {
-	sort.Sort(elvs)
-
-	for _, elv := range elvs {
-		sort.Sort(elv.Radials)
-	}
-
-	// MarchingCubesGrid uses dimensions: width (gates), height (radials), depth (elevations)
-	// Determine grid dimensions robustly across varying gate counts and azimuth resolutions.
-	// width (nGates): use the maximum gate count across all radials/elevations so we never overflow.
-	nGates := 0
-	for _, elv := range elvs {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
+// Resulting meshes are Z up, in Local coordinates unless asked for another CRS
+
+// Marching cubes vertices are deduplicated on a grid this many times finer than the volume's.
+// Vertices on an edge shared by two cubes are interpolated from either end, so they can differ
+// in the last few bits.
+const vertexQuantum = 1 << 20
+
+// Color of vertices where the coloring moment has no data
+var noDataColor = color.NRGBA{0x80, 0x80, 0x80, 0xff}
+
+// IsoVolume is a volume resampled onto a regular grid of gates (X), radials (Y) and elevations (Z)
+// for marching cubes
+type IsoVolume struct {
+	// Sorted by elevation angle, one per angle
+	elvs ElevationSet
+	// Range of the first gate and distance between gates in meters
+	startRange   float64
+	gateInterval float64
+	// Degrees between radials. Radial y is centered on (y+0.5)*azimuthResolution, and the first
+	// is repeated at the end so surfaces close across north.
+	azimuthResolution float64
+	nGates            int
+	nRadials          int
+	nElvs             int
+	// Whether surfaces enclose values below their thresholds, in which case data is negated
+	// (marching cubes' inside is at or above the threshold) and empty gates stay outside
+	below bool
+	// Indexed by (z*nRadials + y)*nGates + x
+	data []float64
+}
+
+// IsosurfaceOptions are the optional parts of an isosurface
+type IsosurfaceOptions struct {
+	// Volume of another moment to color vertices by through ColorLUT, nil for an uncolored mesh
+	Color    ElevationSet
+	ColorLUT func(float64) color.Color
+	// Lon/lat extent (minLon, minLat, maxLon, maxLat) to clip surfaces to, nil for no clipping
+	BBox *[4]float64
+	// Most triangles across every surface, which are decimated to fit. 0 for no limit.
+	MaxTriangles int
+	// Coordinate system of the vertices
+	CRS CRS
+}
+
+// dedupElevations returns elvs sorted by elevation angle, without empty sweeps and with only the
+// lowest numbered sweep at each angle (split cuts and SAILS scan the same angle more than once)
+func dedupElevations(elvs ElevationSet) ElevationSet {
+	sorted := elvs.sorted()
+	out := ElevationSet{}
+	for _, rs := range sorted {
+		if len(rs.Radials) == 0 {
+			continue
 		}
-		for _, rad := range elv.Radials {
-			if len(rad.Gates) > nGates {
-				nGates = len(rad.Gates)
+		if n := len(out); n > 0 && rs.ElevationAngle-out[n-1].ElevationAngle < sameElevationTolerance {
+			continue
+		}
+		out = append(out, rs)
+	}
+	return out
+}
+
+// NewIsoVolume resamples elvs onto the finest azimuth resolution and the gate spacing of its
+// lowest elevation. Isosurfaces of the result enclose values above their thresholds, or with
+// below, values under them (e.g. the low correlation coefficient of a debris ball).
+func NewIsoVolume(ctx context.Context, elvs ElevationSet, below bool) (*IsoVolume, error) {
+	v := &IsoVolume{elvs: dedupElevations(elvs), azimuthResolution: 360, below: below}
+	if len(v.elvs) == 0 {
+		return v, nil
+	}
+	for _, r := range v.elvs[0].Radials {
+		if r.GateInterval > 0 {
+			v.startRange, v.gateInterval = r.StartRange, r.GateInterval
+			break
+		}
+	}
+	if v.gateInterval == 0 {
+		return v, nil
+	}
+
+	end := v.startRange
+	for _, rs := range v.elvs {
+		for _, r := range rs.Radials {
+			if r.AzimuthResolution > 0 && r.AzimuthResolution < v.azimuthResolution {
+				v.azimuthResolution = r.AzimuthResolution
+			}
+			end = math.Max(end, r.StartRange+float64(len(r.Gates)-1)*r.GateInterval)
+		}
+	}
+	nAz := int(math.Round(360 / v.azimuthResolution))
+	v.azimuthResolution = 360 / float64(nAz)
+	v.nGates = int(math.Floor((end-v.startRange)/v.gateInterval)) + 1
+	v.nRadials = nAz + 1
+	v.nElvs = len(v.elvs)
+	v.data = make([]float64, v.nGates*v.nRadials*v.nElvs)
+
+	for z, rs := range v.elvs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		idx := newPolarIndex(rs)
+		for y := 0; y < nAz; y++ {
+			r := idx.radialAt(v.azimuth(float64(y)))
+			row := v.data[(z*v.nRadials+y)*v.nGates : (z*v.nRadials+y+1)*v.nGates]
+			for x := range row {
+				row[x] = GateEmptyValue
+				if r == nil || r.GateInterval <= 0 {
+					continue
+				}
+				g := int(math.Round((v.startRange + float64(x)*v.gateInterval - r.StartRange) / r.GateInterval))
+				if g < 0 || g >= len(r.Gates) {
+					continue
+				}
+				row[x] = r.Gates[g]
+				if below && row[x] != GateEmptyValue {
+					row[x] = -row[x]
+				}
 			}
 		}
+		first := (z * v.nRadials) * v.nGates
+		last := (z*v.nRadials + nAz) * v.nGates
+		copy(v.data[last:last+v.nGates], v.data[first:first+v.nGates])
 	}
-	if nGates == 0 {
-		return nil
+	return v, nil
+}
+
+// Downsample returns v with each block of factor gates by factor radials merged into one cell.
+// Blocks take their largest value (which below makes the smallest), the one furthest inside
+// surfaces, so small cores still show up.
+func (v *IsoVolume) Downsample(factor int) *IsoVolume {
+	if factor <= 1 || v.nGates == 0 {
+		return v
+	}
+	nAz := v.nRadials - 1
+	out := *v
+	outAz := (nAz + factor - 1) / factor
+	out.nGates = (v.nGates + factor - 1) / factor
+	out.nRadials = outAz + 1
+	out.startRange = v.startRange + float64(factor-1)/2*v.gateInterval
+	out.gateInterval = v.gateInterval * float64(factor)
+	out.azimuthResolution = 360 / float64(outAz)
+	out.data = make([]float64, out.nGates*out.nRadials*out.nElvs)
+	for i := range out.data {
+		out.data[i] = GateEmptyValue
 	}
 
-	// target azimuth resolution: use the minimum (finest) resolution across the first elevation
-	// and compute how many repeated radials that implies
-	azimuthResolution := elvs[0].Radials[0].AzimuthResolution
-	for _, rad := range elvs[0].Radials {
-		if rad.AzimuthResolution < azimuthResolution {
-			azimuthResolution = rad.AzimuthResolution
+	for z := 0; z < v.nElvs; z++ {
+		for y := 0; y < nAz; y++ {
+			for x := 0; x < v.nGates; x++ {
+				d := v.data[(z*v.nRadials+y)*v.nGates+x]
+				o := &out.data[(z*out.nRadials+y/factor)*out.nGates+x/factor]
+				if d != GateEmptyValue && (*o == GateEmptyValue || d > *o) {
+					*o = d
+				}
+			}
 		}
+		first := (z * out.nRadials) * out.nGates
+		last := (z*out.nRadials + outAz) * out.nGates
+		copy(out.data[last:last+out.nGates], out.data[first:first+out.nGates])
+	}
+	return &out
+}
+
+// azimuth returns the azimuth (degrees clockwise from north) of grid radial y, which may be fractional
+func (v *IsoVolume) azimuth(y float64) float64 {
+	return math.Mod((y+0.5)*v.azimuthResolution, 360)
+}
+
+// polar returns the elevation angle, azimuth and slant range of point p on the grid
+func (v *IsoVolume) polar(p mc.Vector) (elev, az, rng float64) {
+	// Elevation varies enough it's worth it to lerp here
+	z := math.Max(0, math.Min(p.Z, float64(v.nElvs-1)))
+	lo, hi := v.elvs[int(math.Floor(z))].ElevationAngle, v.elvs[int(math.Ceil(z))].ElevationAngle
+	elev = lo + (hi-lo)*(z-math.Floor(z))
+	return elev, v.azimuth(p.Y), v.startRange + p.X*v.gateInterval
+}
+
+// position returns the Local position of point p on the grid, following the beam under the 4/3
+// earth model
+func (v *IsoVolume) position(p mc.Vector) mc.Vector {
+	elev, az, rng := v.polar(p)
+	gr, a := groundRange(rng, elev), az*math.Pi/180
+	return mc.Vector{
+		X: gr * math.Sin(a),
+		Y: gr * math.Cos(a),
+		Z: v.elvs[0].Height + beamHeight(rng, elev),
 	}
-	// height (nRadials): sum of repeats over the first elevation's radials
-	nRadials := 0
-	for _, rad := range elvs[0].Radials {
-		repeat := int(math.Round(rad.AzimuthResolution / azimuthResolution))
-		if repeat < 1 {
-			repeat = 1
+}
+
+// at returns the value at grid point x, y, z, or empty if that gate is empty
+func (v *IsoVolume) at(x, y, z int, empty float64) float64 {
+	d := v.data[(z*v.nRadials+y)*v.nGates+x]
+	if d == GateEmptyValue {
+		return empty
+	}
+	return d
+}
+
+// gradient returns the gradient of the data at grid point x, y, z per grid step, by central
+// differences (one sided at the edges of the grid, except across north)
+func (v *IsoVolume) gradient(x, y, z int, empty float64) mc.Vector {
+	nAz := v.nRadials - 1
+	diff := func(lo, hi [3]int, n int, i int) float64 {
+		if i == 1 {
+			lo[1], hi[1] = (lo[1]+nAz)%nAz, hi[1]%nAz
+			return (v.at(hi[0], hi[1], hi[2], empty) - v.at(lo[0], lo[1], lo[2], empty)) / 2
+		}
+		if lo[i] < 0 {
+			lo[i] = 0
+		}
+		if hi[i] > n-1 {
+			hi[i] = n - 1
+		}
+		if lo[i] == hi[i] {
+			return 0
 		}
-		nRadials += repeat
+		return (v.at(hi[0], hi[1], hi[2], empty) - v.at(lo[0], lo[1], lo[2], empty)) / float64(hi[i]-lo[i])
 	}
-	// depth (nElvs): number of elevations
-	nElvs := len(elvs)
+	return mc.Vector{
+		X: diff([3]int{x - 1, y, z}, [3]int{x + 1, y, z}, v.nGates, 0),
+		Y: diff([3]int{x, y - 1, z}, [3]int{x, y + 1, z}, v.nRadials, 1),
+		Z: diff([3]int{x, y, z - 1}, [3]int{x, y, z + 1}, v.nElvs, 2),
+	}
+}
 
-	data := make([]float64, nElvs*nRadials*nGates)
-	idx := 0
+// normal returns the outward (towards lower values) unit normal at point p on the grid: the
+// trilinearly interpolated gradient of the data, taken from grid steps to meters through the
+// Jacobian of position. It's the zero vector where the gradient vanishes.
+func (v *IsoVolume) normal(p mc.Vector, empty float64) mc.Vector {
+	// gradient per grid step
+	x0, y0, z0 := int(math.Floor(p.X)), int(math.Floor(p.Y)), int(math.Floor(p.Z))
+	fx, fy, fz := p.X-float64(x0), p.Y-float64(y0), p.Z-float64(z0)
+	g := mc.Vector{}
+	for _, c := range [8][3]int{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}, {1, 1, 0}, {0, 0, 1}, {1, 0, 1}, {0, 1, 1}, {1, 1, 1}} {
+		x, y, z := x0+c[0], y0+c[1], z0+c[2]
+		w := (fx*float64(c[0]) + (1-fx)*float64(1-c[0])) * (fy*float64(c[1]) + (1-fy)*float64(1-c[1])) * (fz*float64(c[2]) + (1-fz)*float64(1-c[2]))
+		if w == 0 || x >= v.nGates || y >= v.nRadials || z >= v.nElvs {
+			continue
+		}
+		g = add(g, scale(v.gradient(x, y, z, empty), w))
+	}
 
-	for _, elv := range elvs {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
+	// columns of the Jacobian: how far position moves per grid step along each axis
+	step := func(axis int) mc.Vector {
+		i, n := [3]float64{p.X, p.Y, p.Z}[axis], [3]int{v.nGates, v.nRadials, v.nElvs}[axis]
+		lo, hi := i-0.5, i+0.5
+		if axis != 1 {
+			// azimuth wraps around, but the others end
+			lo, hi = math.Max(0, lo), math.Min(float64(n-1), hi)
 		}
-		for _, rad := range elv.Radials {
-			// ex: azimuthResolution = 0.5, this radial is 1 so repeat = 2
-			repeat := int(math.Round(rad.AzimuthResolution / azimuthResolution))
-			if repeat < 1 {
-				repeat = 1
-			}
-			for i := 0; i < repeat; i++ {
-				// Copy up to nGates values, then pad the rest with GateEmptyValue
-				copyLen := len(rad.Gates)
-				if copyLen > nGates {
-					copyLen = nGates
-				}
-				copied := copy(data[idx:idx+copyLen], rad.Gates[:copyLen])
-				// pad out to nGates for this radial slot
-				for j := copied; j < nGates; j++ {
-					data[idx+j] = GateEmptyValue
-				}
-				idx += nGates
+		at := func(t float64) mc.Vector {
+			q := p
+			switch axis {
+			case 0:
+				q.X = t
+			case 1:
+				q.Y = t
+			default:
+				q.Z = t
 			}
+			return v.position(q)
 		}
+		return scale(sub(at(hi), at(lo)), 1/(hi-lo))
+	}
+	a, b, c := step(0), step(1), step(2)
+
+	// the gradient in meters is J^-T g, and J^-T is the cofactor matrix over the determinant
+	bc, ca, ab := cross(b, c), cross(c, a), cross(a, b)
+	n := mc.Vector{
+		X: g.X*bc.X + g.Y*ca.X + g.Z*ab.X,
+		Y: g.X*bc.Y + g.Y*ca.Y + g.Z*ab.Y,
+		Z: g.X*bc.Z + g.Y*ca.Z + g.Z*ab.Z,
+	}
+	if dot(a, bc) > 0 {
+		n = scale(n, -1)
 	}
+	return normalize(n)
+}
+
+// colorSampler looks up the color of a second moment at arbitrary points in a volume
+type colorSampler struct {
+	elvs    ElevationSet
+	lookups []*polarIndex
+	lut     func(float64) color.Color
+}
 
-	// If due to any rounding issues we didn't fill the buffer exactly, clamp idx
-	// (mc.MarchingCubesGrid will only read based on provided dimensions)
-	if idx != len(data) {
-		// no panic: allow minor mismatches
+func newColorSampler(elvs ElevationSet, lut func(float64) color.Color) *colorSampler {
+	s := &colorSampler{elvs: dedupElevations(elvs), lut: lut}
+	for _, rs := range s.elvs {
+		s.lookups = append(s.lookups, newPolarIndex(rs))
 	}
+	return s
+}
 
-	// Abort before heavy marching cubes
-	select {
-	case <-ctx.Done():
-		return nil
+// at returns the color at elevation angle elev, azimuth az and slant range rng, interpolating
+// linearly between the elevations above and below
+func (s *colorSampler) at(elev, az, rng float64) color.NRGBA {
+	i := sort.Search(len(s.elvs), func(i int) bool { return s.elvs[i].ElevationAngle >= elev })
+	value := GateEmptyValue
+	switch {
+	case len(s.elvs) == 0:
+	case i == 0:
+		value = s.lookups[0].valueAt(az, rng)
+	case i == len(s.elvs):
+		value = s.lookups[i-1].valueAt(az, rng)
 	default:
+		lo, hi := s.lookups[i-1].valueAt(az, rng), s.lookups[i].valueAt(az, rng)
+		t := (elev - s.elvs[i-1].ElevationAngle) / (s.elvs[i].ElevationAngle - s.elvs[i-1].ElevationAngle)
+		switch {
+		case lo == GateEmptyValue:
+			value = hi
+		case hi == GateEmptyValue:
+			value = lo
+		default:
+			value = lo + t*(hi-lo)
+		}
+	}
+	if value == GateEmptyValue {
+		return noDataColor
+	}
+	return color.NRGBAModel.Convert(s.lut(value)).(color.NRGBA)
+}
+
+// Isosurface returns the surface where the volume crosses threshold
+func (v *IsoVolume) Isosurface(ctx context.Context, threshold float64, opts IsosurfaceOptions) (*Mesh, error) {
+	meshes, err := v.Isosurfaces(ctx, []float64{threshold}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return meshes[0], nil
+}
+
+// Isosurfaces returns the surfaces where the volume crosses each of thresholds, meshed in parallel.
+// With opts.MaxTriangles, each is decimated to its share of the limit by how many triangles it has.
+func (v *IsoVolume) Isosurfaces(ctx context.Context, thresholds []float64, opts IsosurfaceOptions) ([]*Mesh, error) {
+	var colors *colorSampler
+	if opts.Color != nil && opts.ColorLUT != nil {
+		colors = newColorSampler(opts.Color, opts.ColorLUT)
 	}
-	tris := mc.MarchingCubesGrid(nGates, nRadials, nElvs, data, threshold)
-	for i, tri := range tris {
-		tris[i] = mc.Triangle{
-			V1: radialToCartesian(tri.V1, elvs),
-			V2: radialToCartesian(tri.V2, elvs),
-			V3: radialToCartesian(tri.V3, elvs),
+
+	meshes := make([]*Mesh, len(thresholds))
+	errs := make([]error, len(thresholds))
+	wg := sync.WaitGroup{}
+	for i, threshold := range thresholds {
+		wg.Add(1)
+		go func(i int, threshold float64) {
+			defer wg.Done()
+			meshes[i], errs[i] = v.isosurface(ctx, threshold, colors, opts.BBox)
+		}(i, threshold)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return tris
+	total := 0
+	for _, m := range meshes {
+		total += m.Triangles()
+	}
+	// decimation measures error in meters, so it has to happen before any change of CRS
+	for i, m := range meshes {
+		wg.Add(1)
+		go func(i int, m *Mesh) {
+			defer wg.Done()
+			if opts.MaxTriangles > 0 && total > opts.MaxTriangles {
+				if errs[i] = m.Decimate(ctx, int(int64(opts.MaxTriangles)*int64(m.Triangles())/int64(total))); errs[i] != nil {
+					return
+				}
+			}
+			if len(v.elvs) > 0 {
+				m.toCRS(v.elvs[0].Lat, v.elvs[0].Lon, opts.CRS)
+			}
+		}(i, m)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return meshes, nil
 }
 
-func radialToCartesian(v mc.Vector, elvs ElevationSet) mc.Vector {
-	// v.X is gate index
-	// v.Y is radial index
-	// v.Z is elevation index
-	// all can be interpolated (so non-integer indices)
+// clip drops the faces with a vertex outside bbox (minLon, minLat, maxLon, maxLat) and the
+// points no face uses any more
+func (v *IsoVolume) clip(points []mc.Vector, indices []uint32, bbox [4]float64) ([]mc.Vector, []uint32) {
+	if len(v.elvs) == 0 || len(points) == 0 {
+		return nil, nil
+	}
+	site := v.elvs[0]
+	inside := make([]bool, len(points))
+	for i, p := range points {
+		elev, az, rng := v.polar(p)
+		lat, lon := destination(site.Lat, site.Lon, az, groundRange(rng, elev))
+		inside[i] = lon >= bbox[0] && lat >= bbox[1] && lon <= bbox[2] && lat <= bbox[3]
+	}
 
-	// Elevation varies enough it's worth it to lerp here
-	elvLow := elvs[int(math.Floor(v.Z))].ElevationAngle
-	elvHigh := elvs[int(math.Ceil(v.Z))].ElevationAngle
-	elvAngle := elvLow + ((elvHigh - elvLow) * (v.Z - math.Floor(v.Z)))
+	const unused = math.MaxUint32
+	remap := make([]uint32, len(points))
+	for i := range remap {
+		remap[i] = unused
+	}
+	var kept []mc.Vector
+	clipped := indices[:0]
+	for t := 0; t < len(indices); t += 3 {
+		face := [3]uint32{indices[t], indices[t+1], indices[t+2]}
+		if !inside[face[0]] || !inside[face[1]] || !inside[face[2]] {
+			continue
+		}
+		for _, i := range face {
+			if remap[i] == unused {
+				remap[i] = uint32(len(kept))
+				kept = append(kept, points[i])
+			}
+			clipped = append(clipped, remap[i])
+		}
+	}
+	return kept, clipped
+}
 
-	// Assumes all elevations share the same radial distribution
-	// also assumes azimuth resolution is small enough that we don't need to care about
-	// interpolating between angles for the floor/ceil indices
-	radial := elvs[0].Radials[int(math.Round(v.Y))]
-	// Convert NEXRAD azimuth (degrees clockwise from North) to math angle (radians CCW from East)
-	// angle_math = 90 - azimuth
-	angle := (90.0 - radial.AzimuthAngle) * (math.Pi / 180.0)
+func (v *IsoVolume) isosurface(ctx context.Context, threshold float64, colors *colorSampler, bbox *[4]float64) (*Mesh, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if v.below {
+		threshold = -threshold
+	}
+	tris := mc.MarchingCubesGrid(v.nGates, v.nRadials, v.nElvs, v.data, threshold)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	gateIdx := v.X
-	gateDist := radial.StartRange + (gateIdx * radial.GateInterval)
+	m := &Mesh{}
+	ids := make(map[[3]int64]uint32)
+	var points []mc.Vector
+	// the last radial repeats the first, so vertices on it are the same as those on the first
+	wrap := int64(v.nRadials-1) * vertexQuantum
+	for _, tri := range tris {
+		var face [3]uint32
+		for i, p := range [3]mc.Vector{tri.V1, tri.V2, tri.V3} {
+			k := [3]int64{int64(math.Round(p.X * vertexQuantum)), int64(math.Round(p.Y*vertexQuantum)) % wrap, int64(math.Round(p.Z * vertexQuantum))}
+			id, ok := ids[k]
+			if !ok {
+				id = uint32(len(points))
+				ids[k] = id
+				points = append(points, p)
+			}
+			face[i] = id
+		}
+		// cubes with a corner right on the threshold produce slivers
+		if face[0] == face[1] || face[1] == face[2] || face[0] == face[2] {
+			continue
+		}
+		m.Indices = append(m.Indices, face[:]...)
+	}
+	if bbox != nil {
+		points, m.Indices = v.clip(points, m.Indices, *bbox)
+	}
 
-	return mc.Vector{
-		X: math.Cos(angle) * gateDist,
-		Y: math.Sin(angle) * gateDist,
-		Z: math.Sin(elvAngle*(math.Pi/180.0)) * gateDist,
+	if colors != nil {
+		m.Colors = make([]uint8, 0, 4*len(points))
 	}
+	positions := make([]mc.Vector, len(points))
+	normals := make([]mc.Vector, len(points))
+	for i, p := range points {
+		if i%65536 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		positions[i] = v.position(p)
+		// empty gates count as right at the threshold, so they pull normals outward without swamping them
+		normals[i] = v.normal(p, threshold)
+		if colors != nil {
+			c := colors.at(v.polar(p))
+			m.Colors = append(m.Colors, c.R, c.G, c.B, c.A)
+		}
+	}
+
+	// Marching cubes winding depends on the case, and the grid to position mapping mirrors
+	// (azimuth runs clockwise), so faces are turned to agree with the normals instead.
+	// Vertices with no gradient take the normals of their faces.
+	fallback := make([]mc.Vector, len(points))
+	for t := 0; t < len(m.Indices); t += 3 {
+		i, j, k := m.Indices[t], m.Indices[t+1], m.Indices[t+2]
+		face := cross(sub(positions[j], positions[i]), sub(positions[k], positions[i]))
+		if dot(face, add(add(normals[i], normals[j]), normals[k])) < 0 {
+			m.Indices[t+1], m.Indices[t+2] = k, j
+			face = scale(face, -1)
+		}
+		for _, n := range [3]uint32{i, j, k} {
+			fallback[n] = add(fallback[n], face)
+		}
+	}
+
+	m.Positions = make([]float32, 0, 3*len(points))
+	m.Normals = make([]float32, 0, 3*len(points))
+	for i, p := range positions {
+		n := normals[i]
+		if n == (mc.Vector{}) {
+			n = normalize(fallback[i])
+		}
+		m.Positions = append(m.Positions, float32(p.X), float32(p.Y), float32(p.Z))
+		m.Normals = append(m.Normals, float32(n.X), float32(n.Y), float32(n.Z))
+	}
+	return m, nil
+}
+
+func add(a, b mc.Vector) mc.Vector { return mc.Vector{X: a.X + b.X, Y: a.Y + b.Y, Z: a.Z + b.Z} }
+func sub(a, b mc.Vector) mc.Vector { return mc.Vector{X: a.X - b.X, Y: a.Y - b.Y, Z: a.Z - b.Z} }
+func scale(a mc.Vector, s float64) mc.Vector {
+	return mc.Vector{X: a.X * s, Y: a.Y * s, Z: a.Z * s}
+}
+func dot(a, b mc.Vector) float64 { return a.X*b.X + a.Y*b.Y + a.Z*b.Z }
+func cross(a, b mc.Vector) mc.Vector {
+	return mc.Vector{X: a.Y*b.Z - a.Z*b.Y, Y: a.Z*b.X - a.X*b.Z, Z: a.X*b.Y - a.Y*b.X}
 }
 
-func WriteOBJ(tris []mc.Triangle, w io.Writer) {
-	for i, tri := range tris {
-		w.Write([]byte(fmt.Sprintf("v %v %v %v\n", tri.V1.X, tri.V1.Y, tri.V1.Z)))
-		w.Write([]byte(fmt.Sprintf("v %v %v %v\n", tri.V2.X, tri.V2.Y, tri.V2.Z)))
-		w.Write([]byte(fmt.Sprintf("v %v %v %v\n", tri.V3.X, tri.V3.Y, tri.V3.Z)))
-		w.Write([]byte(fmt.Sprintf("f %d %d %d\n", i*3+1, i*3+2, i*3+3)))
+// normalize returns a scaled to unit length, or the zero vector if a is
+func normalize(a mc.Vector) mc.Vector {
+	l := math.Sqrt(dot(a, a))
+	if l == 0 || math.IsNaN(l) {
+		return mc.Vector{}
 	}
+	return scale(a, 1/l)
 }
@@ -0,0 +1,25 @@
+package render
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIsosurfacesOfEmptyVolume(t *testing.T) {
+	// e.g. a truncated file with no complete sweeps
+	ctx := context.Background()
+	v, err := NewIsoVolume(ctx, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bbox := [4]float64{-98, 35, -97, 36}
+	meshes, err := v.Isosurfaces(ctx, []float64{20, 40}, IsosurfaceOptions{BBox: &bbox, MaxTriangles: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range meshes {
+		if m.Triangles() != 0 || m.Vertices() != 0 {
+			t.Errorf("surface %d of an empty volume has %d triangles, %d vertices", i, m.Triangles(), m.Vertices())
+		}
+	}
+}
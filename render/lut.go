@@ -105,12 +105,143 @@ func scaleInt(value, oldMax, oldMin, newMax, newMin int32) int32 {
 	return (((value - oldMin) * newRange) / oldRange) + newMin
 }
 
+type colorStop struct {
+	Value float64
+	Color color.NRGBA
+}
+
+// gradient returns a LUT which linearly interpolates between the given stops (sorted by value),
+// clamping to the first/last color outside of them
+func gradient(stops []colorStop) func(float64) color.Color {
+	return func(v float64) color.Color {
+		if v <= stops[0].Value {
+			return stops[0].Color
+		}
+		for i := 1; i < len(stops); i++ {
+			if v < stops[i].Value {
+				lo, hi := stops[i-1], stops[i]
+				t := (v - lo.Value) / (hi.Value - lo.Value)
+				lerp := func(a, b uint8) uint8 { return uint8(float64(a) + t*(float64(b)-float64(a)) + 0.5) }
+				return color.NRGBA{
+					lerp(lo.Color.R, hi.Color.R),
+					lerp(lo.Color.G, hi.Color.G),
+					lerp(lo.Color.B, hi.Color.B),
+					lerp(lo.Color.A, hi.Color.A),
+				}
+			}
+		}
+		return stops[len(stops)-1].Color
+	}
+}
+
+// differential reflectivity, dB
+var zdrColor = gradient([]colorStop{
+	{-4, color.NRGBA{0x5b, 0x1f, 0x8c, 0xff}},
+	{-1, color.NRGBA{0x9e, 0x9e, 0x9e, 0xff}},
+	{0, color.NRGBA{0xc8, 0xc8, 0xc8, 0xff}},
+	{0.5, color.NRGBA{0x2c, 0x5d, 0xd9, 0xff}},
+	{1.5, color.NRGBA{0x3d, 0xd6, 0xe0, 0xff}},
+	{2.5, color.NRGBA{0x4b, 0xe0, 0x3d, 0xff}},
+	{3.5, color.NRGBA{0xf5, 0xf5, 0x3b, 0xff}},
+	{5, color.NRGBA{0xf5, 0x8a, 0x2a, 0xff}},
+	{6.5, color.NRGBA{0xe0, 0x1b, 0x1b, 0xff}},
+	{8, color.NRGBA{0xf2, 0x8c, 0xd9, 0xff}},
+})
+
+// correlation coefficient, unitless
+var rhoColor = gradient([]colorStop{
+	{0.2, color.NRGBA{0x14, 0x14, 0x8c, 0xff}},
+	{0.45, color.NRGBA{0x77, 0x77, 0xdd, 0xff}},
+	{0.65, color.NRGBA{0x2f, 0xb5, 0xe0, 0xff}},
+	{0.75, color.NRGBA{0x3b, 0xd1, 0x4a, 0xff}},
+	{0.85, color.NRGBA{0x7d, 0xe0, 0x2d, 0xff}},
+	{0.9, color.NRGBA{0xf0, 0xe6, 0x2a, 0xff}},
+	{0.93, color.NRGBA{0xf2, 0x9b, 0x25, 0xff}},
+	{0.96, color.NRGBA{0xd9, 0x1a, 0x1a, 0xff}},
+	{0.98, color.NRGBA{0x8c, 0x0b, 0x2a, 0xff}},
+	{1.0, color.NRGBA{0xe8, 0x9b, 0xd6, 0xff}},
+	{1.05, color.NRGBA{0xff, 0xff, 0xff, 0xff}},
+})
+
+// differential phase, degrees
+var phiColor = gradient([]colorStop{
+	{0, color.NRGBA{0x4b, 0x00, 0x82, 0xff}},
+	{60, color.NRGBA{0x1e, 0x3c, 0xff, 0xff}},
+	{120, color.NRGBA{0x00, 0xc8, 0xc8, 0xff}},
+	{180, color.NRGBA{0x28, 0xc8, 0x28, 0xff}},
+	{240, color.NRGBA{0xff, 0xe6, 0x00, 0xff}},
+	{300, color.NRGBA{0xff, 0x5a, 0x00, 0xff}},
+	{360, color.NRGBA{0xc8, 0x00, 0x00, 0xff}},
+})
+
+// spectrum width, m/s
+var swColor = gradient([]colorStop{
+	{0, color.NRGBA{0x50, 0x50, 0x50, 0xff}},
+	{4, color.NRGBA{0x9c, 0x9c, 0x9c, 0xff}},
+	{8, color.NRGBA{0x3c, 0xc8, 0x3c, 0xff}},
+	{12, color.NRGBA{0xf0, 0xdc, 0x28, 0xff}},
+	{18, color.NRGBA{0xf0, 0x50, 0x28, 0xff}},
+	{24, color.NRGBA{0xc8, 0x00, 0xc8, 0xff}},
+	{30, color.NRGBA{0xff, 0xff, 0xff, 0xff}},
+})
+
+// echo tops, thousands of feet
+var etColor = gradient([]colorStop{
+	{0, color.NRGBA{0x46, 0x46, 0x46, 0xff}},
+	{10, color.NRGBA{0x1e, 0x5a, 0xc8, 0xff}},
+	{20, color.NRGBA{0x00, 0xb4, 0xdc, 0xff}},
+	{30, color.NRGBA{0x28, 0xc8, 0x28, 0xff}},
+	{40, color.NRGBA{0xf0, 0xe6, 0x28, 0xff}},
+	{50, color.NRGBA{0xf0, 0x82, 0x1e, 0xff}},
+	{60, color.NRGBA{0xdc, 0x14, 0x14, 0xff}},
+	{70, color.NRGBA{0xdc, 0x3c, 0xdc, 0xff}},
+	{80, color.NRGBA{0xff, 0xff, 0xff, 0xff}},
+})
+
+// vertically integrated liquid, kg/m²
+var vilColor = gradient([]colorStop{
+	{0, color.NRGBA{0x5a, 0x5a, 0x5a, 0xff}},
+	{5, color.NRGBA{0x1e, 0x5a, 0xc8, 0xff}},
+	{15, color.NRGBA{0x28, 0xc8, 0x28, 0xff}},
+	{25, color.NRGBA{0x1e, 0x8c, 0x1e, 0xff}},
+	{35, color.NRGBA{0xf0, 0xe6, 0x28, 0xff}},
+	{45, color.NRGBA{0xf0, 0x82, 0x1e, 0xff}},
+	{55, color.NRGBA{0xdc, 0x14, 0x14, 0xff}},
+	{65, color.NRGBA{0xa0, 0x0a, 0x3c, 0xff}},
+	{80, color.NRGBA{0xdc, 0x3c, 0xdc, 0xff}},
+})
+
+// VIL density, g/m³
+var vildColor = gradient([]colorStop{
+	{0, color.NRGBA{0x5a, 0x5a, 0x5a, 0xff}},
+	{1, color.NRGBA{0x1e, 0x5a, 0xc8, 0xff}},
+	{2, color.NRGBA{0x28, 0xc8, 0x28, 0xff}},
+	{3, color.NRGBA{0xf0, 0xe6, 0x28, 0xff}},
+	{3.5, color.NRGBA{0xf0, 0x82, 0x1e, 0xff}},
+	{4, color.NRGBA{0xdc, 0x14, 0x14, 0xff}},
+	{5, color.NRGBA{0xdc, 0x3c, 0xdc, 0xff}},
+})
+
 func DefaultLUT(product string) func(float64) color.Color {
-	switch product {
-	case "ref":
+	switch CanonicalProduct(product) {
+	case "ref", "cref":
 		return dbzColorNOAA
-	case "vel":
+	case "vel", "srv":
 		return velColorRadarscope
+	case "sw":
+		return swColor
+	case "et":
+		return etColor
+	case "vil":
+		return vilColor
+	case "vild":
+		return vildColor
+	case "zdr":
+		return zdrColor
+	case "rho":
+		return rhoColor
+	case "phi":
+		return phiColor
 	default:
 		return func(f float64) color.Color {
 			// 0-255 grayscale
@@ -0,0 +1,405 @@
+package render
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Mesh is an indexed triangle mesh
+type Mesh struct {
+	// Name of the object (e.g. the isosurface threshold) in formats which have them
+	Name string
+	// What Positions are relative to, for coordinates too large for float32 to hold precisely
+	Origin [3]float64
+	// X, Y, Z of each vertex
+	Positions []float32
+	// Unit outward normal of each vertex
+	Normals []float32
+	// R, G, B, A of each vertex, nil if the mesh is uncolored
+	Colors []uint8
+	// Three vertices per triangle, counterclockwise seen from outside
+	Indices []uint32
+}
+
+// position returns vertex i of m, origin included
+func (m *Mesh) position(i int) [3]float64 {
+	return [3]float64{
+		m.Origin[0] + float64(m.Positions[3*i]),
+		m.Origin[1] + float64(m.Positions[3*i+1]),
+		m.Origin[2] + float64(m.Positions[3*i+2]),
+	}
+}
+
+// Vertices returns the number of vertices in m
+func (m *Mesh) Vertices() int {
+	return len(m.Positions) / 3
+}
+
+// Triangles returns the number of triangles in m
+func (m *Mesh) Triangles() int {
+	return len(m.Indices) / 3
+}
+
+// faceNormal returns the unit normal of triangle t of m
+func (m *Mesh) faceNormal(t int) [3]float32 {
+	var p [3][3]float64
+	for i := range p {
+		v := m.Indices[3*t+i]
+		for j := range p[i] {
+			p[i][j] = float64(m.Positions[3*v+uint32(j)])
+		}
+	}
+	a := [3]float64{p[1][0] - p[0][0], p[1][1] - p[0][1], p[1][2] - p[0][2]}
+	b := [3]float64{p[2][0] - p[0][0], p[2][1] - p[0][1], p[2][2] - p[0][2]}
+	n := [3]float64{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+	l := math.Sqrt(n[0]*n[0] + n[1]*n[1] + n[2]*n[2])
+	if l == 0 {
+		return [3]float32{}
+	}
+	return [3]float32{float32(n[0] / l), float32(n[1] / l), float32(n[2] / l)}
+}
+
+// mergeMeshes returns meshes as one, colored only if all of them are
+func mergeMeshes(meshes []*Mesh) *Mesh {
+	if len(meshes) == 1 {
+		return meshes[0]
+	}
+	// meshes from the same request share an origin
+	out := &Mesh{Origin: meshes[0].Origin, Colors: []uint8{}}
+	for _, m := range meshes {
+		base := uint32(out.Vertices())
+		out.Positions = append(out.Positions, m.Positions...)
+		out.Normals = append(out.Normals, m.Normals...)
+		if m.Colors == nil {
+			out.Colors = nil
+		} else if out.Colors != nil {
+			out.Colors = append(out.Colors, m.Colors...)
+		}
+		for _, i := range m.Indices {
+			out.Indices = append(out.Indices, base+i)
+		}
+	}
+	return out
+}
+
+// WriteOBJ writes meshes as a Wavefront OBJ, each in a group named after it. Vertex colors,
+// if any, follow the positions as floats from 0 to 1 (an extension most tools read).
+func WriteOBJ(meshes []*Mesh, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	// OBJ indices count from 1 across the whole file
+	base := uint32(1)
+	for _, m := range meshes {
+		if m.Name != "" {
+			fmt.Fprintf(bw, "g %s\n", m.Name)
+		}
+		for i := 0; i < m.Vertices(); i++ {
+			p := m.position(i)
+			if m.Colors != nil {
+				c := m.Colors[4*i : 4*i+4]
+				fmt.Fprintf(bw, "v %v %v %v %.3g %.3g %.3g\n", p[0], p[1], p[2], float64(c[0])/255, float64(c[1])/255, float64(c[2])/255)
+			} else {
+				fmt.Fprintf(bw, "v %v %v %v\n", p[0], p[1], p[2])
+			}
+		}
+		for i := 0; i < m.Vertices(); i++ {
+			n := m.Normals[3*i : 3*i+3]
+			fmt.Fprintf(bw, "vn %.4f %.4f %.4f\n", n[0], n[1], n[2])
+		}
+		for t := 0; t < m.Triangles(); t++ {
+			a, b, c := base+m.Indices[3*t], base+m.Indices[3*t+1], base+m.Indices[3*t+2]
+			fmt.Fprintf(bw, "f %d//%d %d//%d %d//%d\n", a, a, b, b, c, c)
+		}
+		base += uint32(m.Vertices())
+	}
+	return bw.Flush()
+}
+
+// leWriter writes little endian values through a bufio.Writer
+type leWriter struct {
+	*bufio.Writer
+	buf [8]byte
+}
+
+func (w *leWriter) uint16(v uint16) {
+	binary.LittleEndian.PutUint16(w.buf[:2], v)
+	w.Write(w.buf[:2])
+}
+
+func (w *leWriter) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(w.buf[:4], v)
+	w.Write(w.buf[:4])
+}
+
+func (w *leWriter) float32s(vs ...float32) {
+	for _, v := range vs {
+		w.uint32(math.Float32bits(v))
+	}
+}
+
+func (w *leWriter) float64s(vs ...float64) {
+	for _, v := range vs {
+		binary.LittleEndian.PutUint64(w.buf[:], math.Float64bits(v))
+		w.Write(w.buf[:])
+	}
+}
+
+// WritePLY writes meshes as a binary little endian PLY. PLY has no notion of objects, so
+// they're merged into one. Positions are doubles if they're offset from an origin.
+func WritePLY(meshes []*Mesh, w io.Writer) error {
+	m := mergeMeshes(meshes)
+	lw := &leWriter{Writer: bufio.NewWriter(w)}
+	positionType := "float"
+	if m.Origin != [3]float64{} {
+		positionType = "double"
+	}
+	fmt.Fprintf(lw, "ply\nformat binary_little_endian 1.0\ncomment radserv isosurface\n")
+	fmt.Fprintf(lw, "element vertex %d\n", m.Vertices())
+	fmt.Fprintf(lw, "property %[1]s x\nproperty %[1]s y\nproperty %[1]s z\n", positionType)
+	fmt.Fprintf(lw, "property float nx\nproperty float ny\nproperty float nz\n")
+	if m.Colors != nil {
+		fmt.Fprintf(lw, "property uchar red\nproperty uchar green\nproperty uchar blue\nproperty uchar alpha\n")
+	}
+	fmt.Fprintf(lw, "element face %d\nproperty list uchar uint vertex_indices\nend_header\n", m.Triangles())
+
+	for i := 0; i < m.Vertices(); i++ {
+		if positionType == "double" {
+			p := m.position(i)
+			lw.float64s(p[:]...)
+		} else {
+			lw.float32s(m.Positions[3*i : 3*i+3]...)
+		}
+		lw.float32s(m.Normals[3*i : 3*i+3]...)
+		if m.Colors != nil {
+			lw.Write(m.Colors[4*i : 4*i+4])
+		}
+	}
+	for t := 0; t < m.Triangles(); t++ {
+		lw.WriteByte(3)
+		for _, v := range m.Indices[3*t : 3*t+3] {
+			lw.uint32(v)
+		}
+	}
+	return lw.Flush()
+}
+
+// WriteSTL writes meshes as a binary STL. STL has no objects, shared vertices, normals or
+// colors, so meshes are merged and each triangle is written out with its face normal.
+func WriteSTL(meshes []*Mesh, w io.Writer) error {
+	m := mergeMeshes(meshes)
+	lw := &leWriter{Writer: bufio.NewWriter(w)}
+	var header [80]byte
+	copy(header[:], "radserv isosurface")
+	lw.Write(header[:])
+	lw.uint32(uint32(m.Triangles()))
+	for t := 0; t < m.Triangles(); t++ {
+		n := m.faceNormal(t)
+		lw.float32s(n[:]...)
+		for _, v := range m.Indices[3*t : 3*t+3] {
+			p := m.position(int(v))
+			lw.float32s(float32(p[0]), float32(p[1]), float32(p[2]))
+		}
+		lw.uint16(0)
+	}
+	return lw.Flush()
+}
+
+// glTF constants
+const (
+	gltfFloat         = 5126
+	gltfUnsignedByte  = 5121
+	gltfUnsignedInt   = 5125
+	gltfArrayBuffer   = 34962
+	gltfElementBuffer = 34963
+)
+
+type gltfAccessor struct {
+	BufferView    int       `json:"bufferView"`
+	ComponentType int       `json:"componentType"`
+	Normalized    bool      `json:"normalized,omitempty"`
+	Count         int       `json:"count"`
+	Type          string    `json:"type"`
+	Min           []float32 `json:"min,omitempty"`
+	Max           []float32 `json:"max,omitempty"`
+}
+
+type gltfBufferView struct {
+	Buffer     int `json:"buffer"`
+	ByteOffset int `json:"byteOffset"`
+	ByteLength int `json:"byteLength"`
+	Target     int `json:"target"`
+}
+
+type gltfPrimitive struct {
+	Attributes map[string]int `json:"attributes"`
+	Indices    int            `json:"indices"`
+	Material   int            `json:"material"`
+}
+
+type gltfMesh struct {
+	Name       string          `json:"name,omitempty"`
+	Primitives []gltfPrimitive `json:"primitives"`
+}
+
+type gltfNode struct {
+	Name        string    `json:"name,omitempty"`
+	Mesh        *int      `json:"mesh,omitempty"`
+	Rotation    []float64 `json:"rotation,omitempty"`
+	Translation []float64 `json:"translation,omitempty"`
+	Children    []int     `json:"children,omitempty"`
+}
+
+type gltfScene struct {
+	Nodes []int `json:"nodes"`
+}
+
+type gltfBuffer struct {
+	ByteLength int `json:"byteLength"`
+}
+
+type gltfDocument struct {
+	Asset struct {
+		Version   string `json:"version"`
+		Generator string `json:"generator"`
+	} `json:"asset"`
+	Scene       int               `json:"scene"`
+	Scenes      []gltfScene       `json:"scenes"`
+	Nodes       []gltfNode        `json:"nodes"`
+	Meshes      []gltfMesh        `json:"meshes,omitempty"`
+	Materials   []json.RawMessage `json:"materials,omitempty"`
+	Accessors   []gltfAccessor    `json:"accessors,omitempty"`
+	BufferViews []gltfBufferView  `json:"bufferViews,omitempty"`
+	Buffers     []gltfBuffer      `json:"buffers,omitempty"`
+}
+
+// gltfBuilder accumulates the JSON and binary chunks of a GLB
+type gltfBuilder struct {
+	doc gltfDocument
+	bin []byte
+}
+
+// view appends data to the binary chunk and returns its bufferView
+func (b *gltfBuilder) view(data []byte, target int) int {
+	b.doc.BufferViews = append(b.doc.BufferViews, gltfBufferView{ByteOffset: len(b.bin), ByteLength: len(data), Target: target})
+	b.bin = append(b.bin, data...)
+	// every component is at most 4 bytes, so keeping views 4 byte aligned keeps every accessor aligned
+	for len(b.bin)%4 != 0 {
+		b.bin = append(b.bin, 0)
+	}
+	return len(b.doc.BufferViews) - 1
+}
+
+// accessor adds an accessor over a new bufferView of data and returns it
+func (b *gltfBuilder) accessor(a gltfAccessor, data []byte, target int) int {
+	a.BufferView = b.view(data, target)
+	b.doc.Accessors = append(b.doc.Accessors, a)
+	return len(b.doc.Accessors) - 1
+}
+
+func float32Bytes(vs []float32) []byte {
+	out := make([]byte, 4*len(vs))
+	for i, v := range vs {
+		binary.LittleEndian.PutUint32(out[4*i:], math.Float32bits(v))
+	}
+	return out
+}
+
+func uint32Bytes(vs []uint32) []byte {
+	out := make([]byte, 4*len(vs))
+	for i, v := range vs {
+		binary.LittleEndian.PutUint32(out[4*i:], v)
+	}
+	return out
+}
+
+// addMesh adds m as a glTF mesh and returns it, or -1 if m is empty (glTF has no empty accessors)
+func (b *gltfBuilder) addMesh(m *Mesh) int {
+	if m.Triangles() == 0 {
+		return -1
+	}
+	min := []float32{math.MaxFloat32, math.MaxFloat32, math.MaxFloat32}
+	max := []float32{-math.MaxFloat32, -math.MaxFloat32, -math.MaxFloat32}
+	for i, p := range m.Positions {
+		if p < min[i%3] {
+			min[i%3] = p
+		}
+		if p > max[i%3] {
+			max[i%3] = p
+		}
+	}
+
+	attributes := map[string]int{
+		"POSITION": b.accessor(gltfAccessor{ComponentType: gltfFloat, Count: m.Vertices(), Type: "VEC3", Min: min, Max: max}, float32Bytes(m.Positions), gltfArrayBuffer),
+		"NORMAL":   b.accessor(gltfAccessor{ComponentType: gltfFloat, Count: m.Vertices(), Type: "VEC3"}, float32Bytes(m.Normals), gltfArrayBuffer),
+	}
+	if m.Colors != nil {
+		attributes["COLOR_0"] = b.accessor(gltfAccessor{ComponentType: gltfUnsignedByte, Normalized: true, Count: m.Vertices(), Type: "VEC4"}, m.Colors, gltfArrayBuffer)
+	}
+	indices := b.accessor(gltfAccessor{ComponentType: gltfUnsignedInt, Count: len(m.Indices), Type: "SCALAR"}, uint32Bytes(m.Indices), gltfElementBuffer)
+
+	if len(b.doc.Materials) == 0 {
+		// surfaces are open where the data ends, so both sides should be visible
+		b.doc.Materials = append(b.doc.Materials, json.RawMessage(`{"doubleSided":true,"pbrMetallicRoughness":{"metallicFactor":0,"roughnessFactor":1}}`))
+	}
+	b.doc.Meshes = append(b.doc.Meshes, gltfMesh{Name: m.Name, Primitives: []gltfPrimitive{{Attributes: attributes, Indices: indices}}})
+	return len(b.doc.Meshes) - 1
+}
+
+// WriteGLB writes meshes as binary glTF, each in a node named after it and translated to its
+// origin. glTF is Y up, so the nodes hang off a root node rotating Z up to Y up.
+func WriteGLB(meshes []*Mesh, w io.Writer) error {
+	b := &gltfBuilder{}
+	b.doc.Asset.Version = "2.0"
+	b.doc.Asset.Generator = "radserv"
+	b.doc.Scenes = []gltfScene{{Nodes: []int{0}}}
+	// -90 degrees about X
+	b.doc.Nodes = append(b.doc.Nodes, gltfNode{Rotation: []float64{-math.Sqrt2 / 2, 0, 0, math.Sqrt2 / 2}})
+	for _, m := range meshes {
+		mesh := b.addMesh(m)
+		if mesh < 0 {
+			continue
+		}
+		node := gltfNode{Name: m.Name, Mesh: &mesh}
+		if m.Origin != [3]float64{} {
+			node.Translation = m.Origin[:]
+		}
+		b.doc.Nodes = append(b.doc.Nodes, node)
+		b.doc.Nodes[0].Children = append(b.doc.Nodes[0].Children, len(b.doc.Nodes)-1)
+	}
+	if len(b.bin) > 0 {
+		b.doc.Buffers = append(b.doc.Buffers, gltfBuffer{ByteLength: len(b.bin)})
+	}
+	return b.write(w)
+}
+
+// write writes the GLB container: a header, then the JSON chunk, then the binary chunk (if any)
+func (b *gltfBuilder) write(w io.Writer) error {
+	doc, err := json.Marshal(b.doc)
+	if err != nil {
+		return err
+	}
+	for len(doc)%4 != 0 {
+		doc = append(doc, ' ')
+	}
+	length := 12 + 8 + len(doc)
+	if len(b.bin) > 0 {
+		length += 8 + len(b.bin)
+	}
+
+	lw := &leWriter{Writer: bufio.NewWriter(w)}
+	lw.uint32(0x46546C67) // "glTF"
+	lw.uint32(2)
+	lw.uint32(uint32(length))
+	lw.uint32(uint32(len(doc)))
+	lw.uint32(0x4E4F534A) // "JSON"
+	lw.Write(doc)
+	if len(b.bin) > 0 {
+		lw.uint32(uint32(len(b.bin)))
+		lw.uint32(0x004E4942) // "BIN"
+		lw.Write(b.bin)
+	}
+	return lw.Flush()
+}
@@ -0,0 +1,92 @@
+package render
+
+import (
+	"context"
+	"math"
+)
+
+// Overlap is how a mosaic picks the value of a pixel covered by more than one site
+type Overlap int
+
+const (
+	// NearestRadar takes the value from the closest site, whose beam is lowest there
+	NearestRadar Overlap = iota
+	// MaxValue takes the largest value of any site
+	MaxValue
+)
+
+// siteWindow returns the part of t which rs could cover, snapped to t's pixels, along with
+// its offset in pixels from the top left of t. ok is false if rs doesn't reach t at all.
+func siteWindow(rs *RadialSet, t Target) (win Target, x, y int, ok bool) {
+	extent, err := SiteExtent(rs, t.SRS)
+	if err != nil {
+		// can't tell, so look at all of it
+		return t, 0, 0, true
+	}
+
+	resX := (t.Extent[2] - t.Extent[0]) / float64(t.Width)
+	resY := (t.Extent[3] - t.Extent[1]) / float64(t.Height)
+	clamp := func(v float64, max int) int {
+		return int(math.Max(0, math.Min(float64(max), v)))
+	}
+	x0 := clamp(math.Floor((extent[0]-t.Extent[0])/resX), t.Width)
+	x1 := clamp(math.Ceil((extent[2]-t.Extent[0])/resX), t.Width)
+	y0 := clamp(math.Floor((t.Extent[3]-extent[3])/resY), t.Height)
+	y1 := clamp(math.Ceil((t.Extent[3]-extent[1])/resY), t.Height)
+	if x0 >= x1 || y0 >= y1 {
+		return Target{}, 0, 0, false
+	}
+
+	win = Target{
+		SRS: t.SRS,
+		Extent: [4]float64{
+			t.Extent[0] + float64(x0)*resX,
+			t.Extent[3] - float64(y1)*resY,
+			t.Extent[0] + float64(x1)*resX,
+			t.Extent[3] - float64(y0)*resY,
+		},
+		Width:  x1 - x0,
+		Height: y1 - y0,
+	}
+	return win, x0, y0, true
+}
+
+// Mosaic composites sets (typically from different sites) into one Raster of t,
+// resolving pixels covered by several of them by overlap
+func Mosaic(ctx context.Context, sets []*RadialSet, t Target, interp Interpolation, overlap Overlap) (*Raster, error) {
+	r := newRaster(t)
+	// range to the site each pixel's value came from
+	ranges := make([]float32, len(r.Values))
+	for i := range ranges {
+		ranges[i] = float32(math.Inf(1))
+	}
+
+	// Sets are sampled one at a time (each on all cores), so pixels only ever have one writer
+	for _, rs := range sets {
+		win, x0, y0, ok := siteWindow(rs, t)
+		if !ok {
+			continue
+		}
+		err := sample(ctx, rs, win, interp, func(i int, v, rng float64) {
+			if math.IsInf(rng, 1) {
+				return
+			}
+			p := (y0+i/win.Width)*t.Width + x0 + i%win.Width
+			switch overlap {
+			case NearestRadar:
+				if float32(rng) < ranges[p] {
+					ranges[p] = float32(rng)
+					r.Values[p] = float32(v)
+				}
+			case MaxValue:
+				if v != GateEmptyValue && (r.Values[p] == rasterEmptyValue || float32(v) > r.Values[p]) {
+					r.Values[p] = float32(v)
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,103 @@
+package render
+
+import "math"
+
+// azimuth bins per degree in a polarIndex
+const polarBinsPerDegree = 10
+
+// polarIndex finds the radial of a RadialSet covering a given azimuth in constant time
+type polarIndex struct {
+	rs   *RadialSet
+	bins [360 * polarBinsPerDegree]*Radial
+}
+
+func newPolarIndex(rs *RadialSet) *polarIndex {
+	p := &polarIndex{rs: rs}
+	for _, r := range rs.Radials {
+		res := r.AzimuthResolution
+		if res <= 0 {
+			res = 1
+		}
+		start := int(math.Floor(r.AzimuthAngle * polarBinsPerDegree))
+		n := int(math.Ceil(res * polarBinsPerDegree))
+		for i := 0; i < n; i++ {
+			b := (start + i) % len(p.bins)
+			if b < 0 {
+				b += len(p.bins)
+			}
+			p.bins[b] = r
+		}
+	}
+	return p
+}
+
+// radialAt returns the radial covering azimuth az (degrees clockwise from north), or nil
+func (p *polarIndex) radialAt(az float64) *Radial {
+	b := int(math.Floor(az*polarBinsPerDegree)) % len(p.bins)
+	if b < 0 {
+		b += len(p.bins)
+	}
+	return p.bins[b]
+}
+
+// valueAt returns the value of the gate nearest to slant range rng (meters) at azimuth az,
+// or GateEmptyValue if there isn't one
+func (p *polarIndex) valueAt(az, rng float64) float64 {
+	r := p.radialAt(az)
+	if r == nil || r.GateInterval <= 0 {
+		return GateEmptyValue
+	}
+	g := int(math.Round((rng - r.StartRange) / r.GateInterval))
+	if g < 0 || g >= len(r.Gates) {
+		return GateEmptyValue
+	}
+	return r.Gates[g]
+}
+
+// gateAt returns the value at slant range rng along r, interpolating linearly between gates.
+// Next to empty gates (or at the ends of the radial) the nearest gate is used as is.
+func gateAt(r *Radial, rng float64) float64 {
+	if r.GateInterval <= 0 {
+		return GateEmptyValue
+	}
+	f := (rng - r.StartRange) / r.GateInterval
+	g := int(math.Floor(f))
+	if g < 0 || g+1 >= len(r.Gates) || r.Gates[g] == GateEmptyValue || r.Gates[g+1] == GateEmptyValue {
+		n := int(math.Round(f))
+		if n < 0 || n >= len(r.Gates) {
+			return GateEmptyValue
+		}
+		return r.Gates[n]
+	}
+	t := f - float64(g)
+	return r.Gates[g]*(1-t) + r.Gates[g+1]*t
+}
+
+// bilinearAt is valueAt, but interpolated between the two nearest radials and gates
+func (p *polarIndex) bilinearAt(az, rng float64) float64 {
+	r := p.radialAt(az)
+	if r == nil {
+		return GateEmptyValue
+	}
+	v := gateAt(r, rng)
+	if v == GateEmptyValue {
+		return v
+	}
+
+	// how far off this radial's center az is, and so which neighbor to blend with
+	d := math.Mod(az-(r.AzimuthAngle+r.AzimuthResolution/2)+540, 360) - 180
+	step := r.AzimuthResolution
+	if d < 0 {
+		step = -step
+	}
+	other := p.radialAt(az + step)
+	if other == nil || other == r {
+		return v
+	}
+	ov := gateAt(other, rng)
+	if ov == GateEmptyValue {
+		return v
+	}
+	w := math.Abs(d) / r.AzimuthResolution
+	return v*(1-w) + ov*w
+}
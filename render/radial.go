@@ -1,6 +1,7 @@
 package render
 
 import (
+	"encoding/binary"
 	"fmt"
 
 	"github.com/kallsyms/go-nexrad/archive2"
@@ -33,9 +34,96 @@ type RadialSet struct {
 	// longitude of origin
 	Lon float64
 	// The distance from the origin to the edge of the radial image in meters
-	Radius         int
+	Radius int
+	// Height of the antenna in meters above sea level (0 if unknown)
+	Height         float64
 	ElevationAngle float64
-	Radials        RadialSlice
+	// Maximum unambiguous velocity in m/s, for velocity products (0 if unknown)
+	NyquistVelocity float64
+	Radials         RadialSlice
+}
+
+// Level2Products lists every product which can be extracted from a Level 2 volume, in display order.
+// CFP (clutter filter power removed) is not included since archive2 skips over that block.
+var Level2Products = []string{"ref", "vel", "sw", "zdr", "rho", "phi"}
+
+// CanonicalProduct maps alternate product names (e.g. "cc") to the name used everywhere else
+func CanonicalProduct(product string) string {
+	switch product {
+	case "cc":
+		return "rho"
+	case "dbz":
+		return "ref"
+	}
+	return product
+}
+
+func level2Moment(m31 *archive2.Message31, product string) (*archive2.DataMoment, error) {
+	switch CanonicalProduct(product) {
+	case "ref":
+		return m31.ReflectivityData, nil
+	case "vel":
+		return m31.VelocityData, nil
+	case "sw":
+		return m31.SwData, nil
+	case "zdr":
+		return m31.ZdrData, nil
+	case "rho":
+		return m31.RhoData, nil
+	case "phi":
+		return m31.PhiData, nil
+	case "cfp":
+		return nil, fmt.Errorf("Product %q is not decoded from Level 2 data", product)
+	default:
+		return nil, fmt.Errorf("Invalid product %q", product)
+	}
+}
+
+// Level2ProductsIn returns which of Level2Products have data in the given elevation
+func Level2ProductsIn(m31s []*archive2.Message31) []string {
+	products := []string{}
+	for _, product := range Level2Products {
+		for _, m31 := range m31s {
+			if m31 == nil {
+				continue
+			}
+			if moment, _ := level2Moment(m31, product); moment != nil && len(moment.Data) > 0 {
+				products = append(products, product)
+				break
+			}
+		}
+	}
+	return products
+}
+
+// momentGates scales the raw gate values of a moment, mapping below threshold and
+// range folded gates to GateEmptyValue.
+// archive2's ScaledData only handles 8 bit words, but e.g. PHI uses 16 bits.
+func momentGates(moment *archive2.DataMoment) []float64 {
+	wordBytes := int(moment.DataWordSize) / 8
+	if wordBytes < 1 {
+		wordBytes = 1
+	}
+	n := len(moment.Data) / wordBytes
+	gates := make([]float64, n)
+	for i := 0; i < n; i++ {
+		var raw uint16
+		if wordBytes == 2 {
+			raw = binary.BigEndian.Uint16(moment.Data[i*2:])
+		} else {
+			raw = uint16(moment.Data[i])
+		}
+		switch {
+		case raw == 0, raw == 1:
+			// below threshold, range folded
+			gates[i] = GateEmptyValue
+		case moment.Scale == 0:
+			gates[i] = float64(raw)
+		default:
+			gates[i] = (float64(raw) - float64(moment.Offset)) / float64(moment.Scale)
+		}
+	}
+	return gates
 }
 
 func RadialSetFromLevel2(m31s []*archive2.Message31, product string) (*RadialSet, error) {
@@ -46,21 +134,21 @@ func RadialSetFromLevel2(m31s []*archive2.Message31, product string) (*RadialSet
 		Lat:            float64(m31s[0].VolumeData.Lat),
 		Lon:            float64(m31s[0].VolumeData.Long),
 		Radius:         460 * 1000,
+		Height:         float64(m31s[0].VolumeData.SiteHeight) + float64(m31s[0].VolumeData.FeedhornHeight),
 		ElevationAngle: float64(m31s[0].Header.ElevationAngle),
 	}
+	if CanonicalProduct(product) == "vel" {
+		// stored in units of 0.01 m/s
+		s.NyquistVelocity = float64(m31s[0].RadialData.NyquistVelocity) / 100
+	}
 
 	for _, m31 := range m31s {
 		if m31 == nil {
 			continue
 		}
-		var moment *archive2.DataMoment
-		switch product {
-		case "ref":
-			moment = m31.ReflectivityData
-		case "vel":
-			moment = m31.VelocityData
-		default:
-			return nil, fmt.Errorf("Invalid product %q", product)
+		moment, err := level2Moment(m31, product)
+		if err != nil {
+			return nil, err
 		}
 		// Skip radials with no data for this product
 		if moment == nil || len(moment.Data) == 0 {
@@ -71,14 +159,7 @@ func RadialSetFromLevel2(m31s []*archive2.Message31, product string) (*RadialSet
 			AzimuthResolution: m31.Header.AzimuthResolutionSpacing(),
 			StartRange:        float64(moment.DataMomentRange),
 			GateInterval:      float64(moment.DataMomentRangeSampleInterval),
-			Gates:             make([]float64, len(moment.Data)),
-		}
-		for i, d := range moment.ScaledData() {
-			if d != archive2.MomentDataBelowThreshold && d != archive2.MomentDataFolded {
-				r.Gates[i] = float64(d)
-			} else {
-				r.Gates[i] = GateEmptyValue
-			}
+			Gates:             momentGates(moment),
 		}
 		s.Radials = append(s.Radials, r)
 	}
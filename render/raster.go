@@ -0,0 +1,65 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	pngenc "image/png"
+	"io"
+)
+
+// Raster holds values (dBZ, m/s, ...) for every pixel of a Target
+type Raster struct {
+	Target Target
+	// Row-major from the top left, GateEmptyValue where there's no data
+	Values []float32
+}
+
+// GateEmptyValue as stored in a Raster
+const rasterEmptyValue = float32(GateEmptyValue)
+
+// newRaster returns an empty Raster of t
+func newRaster(t Target) *Raster {
+	r := &Raster{Target: t, Values: make([]float32, t.Width*t.Height)}
+	for i := range r.Values {
+		r.Values[i] = rasterEmptyValue
+	}
+	return r
+}
+
+// SampleRadialSet evaluates rs at every pixel of t
+func SampleRadialSet(ctx context.Context, rs *RadialSet, t Target, interp Interpolation) (*Raster, error) {
+	r := newRaster(t)
+	err := sample(ctx, rs, t, interp, func(i int, v, rng float64) {
+		r.Values[i] = float32(v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// PNG colors r through lut, leaving pixels without data transparent
+func (r *Raster) PNG(lut func(float64) color.Color) (io.ReadCloser, error) {
+	return encodePNG(r.Values, r.Target.Width, r.Target.Height, lut)
+}
+
+// encodePNG colors values (row-major from the top left) through lut into a width x height PNG,
+// leaving pixels without data transparent
+func encodePNG(values []float32, width, height int, lut func(float64) color.Color) (io.ReadCloser, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i, v := range values {
+		if v == rasterEmptyValue {
+			continue
+		}
+		c := color.NRGBAModel.Convert(lut(float64(v))).(color.NRGBA)
+		copy(img.Pix[i*4:], []byte{c.R, c.G, c.B, c.A})
+	}
+
+	var buf bytes.Buffer
+	if err := pngenc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
@@ -3,185 +3,158 @@ package render
 import (
 	"context"
 	"fmt"
-	"image"
 	"image/color"
-	"image/draw"
-	pngenc "image/png"
 	"io"
 	"math"
 	"os"
-	"strconv"
+	"runtime"
+	"sync"
 
 	"github.com/airbusgeo/godal"
-	"github.com/llgcode/draw2d"
-	"github.com/llgcode/draw2d/draw2dimg"
-	"github.com/sirupsen/logrus"
 )
 
-func RenderAndReproject(ctx context.Context, rs *RadialSet, lut func(float64) color.Color, width, height int) (io.ReadCloser, error) {
-	godal.RegisterAll()
+// Interpolation is how values are sampled from a RadialSet
+type Interpolation int
 
-	// 1) Render the radial set to an RGBA image in Azimuthal Equidistant
-	intermediateSize := 1000 // initial render size before reprojection
-	// Early cancel
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	default:
-	}
-	renderImg := render(ctx, rs, intermediateSize, lut)
-	// Cancel after render
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	default:
-	}
-
-	// 2) Create a MEM dataset with 4 bands (RGBA) and write pixels band-by-band
-	srcDS, err := godal.Create(godal.DriverName("MEM"), "", 4, godal.Byte, renderImg.Rect.Dx(), renderImg.Rect.Dy())
-	if err != nil {
-		// fallback: try vsimem GTiff if MEM driver unavailable
-		srcDS, err = godal.Create(godal.GTiff, "/vsimem/src.tif", 4, godal.Byte, renderImg.Rect.Dx(), renderImg.Rect.Dy())
-		if err != nil {
-			// last resort: return Go-encoded PNG of the unwarped render
-			f, _ := os.CreateTemp("", "*.png")
-			_ = pngenc.Encode(f, renderImg)
-			return f, nil
-		}
-	}
-	defer srcDS.Close()
-
-	// Set source dataset projection (Azimuthal Equidistant centered on radar) and geotransform
-	srWKT := azimuthalEquidistantWKT(rs.Lat, rs.Lon)
-	sr, _ := godal.NewSpatialRefFromWKT(srWKT)
-	defer sr.Close()
-	_ = srcDS.SetSpatialRef(sr)
+const (
+	// Nearest takes the value of the gate under each pixel
+	Nearest Interpolation = iota
+	// Bilinear blends the nearest two radials and two gates
+	Bilinear
+)
 
-	distM := float64(rs.Radius)
-	pixStepM := distM * 2.0 / float64(renderImg.Rect.Dx())
-	_ = srcDS.SetGeoTransform([6]float64{-distM, pixStepM, 0, distM, 0, -pixStepM})
+// Size in pixels of the cells the target is split into for projection. Only cell corners are
+// projected exactly, the rest is interpolated, which is far cheaper and still well under a
+// pixel off at any sensible scale.
+const projectionCell = 8
 
-	// Deinterleave RGBA into per-band planes and write bands
-	w := renderImg.Rect.Dx()
-	h := renderImg.Rect.Dy()
-	rplane := make([]byte, w*h)
-	gplane := make([]byte, w*h)
-	bplane := make([]byte, w*h)
-	aplane := make([]byte, w*h)
-	idx := 0
-	for y := 0; y < h; y++ {
-		row := renderImg.Pix[y*renderImg.Stride : y*renderImg.Stride+w*4]
-		for x := 0; x < w; x++ {
-			rplane[idx] = row[x*4+0]
-			gplane[idx] = row[x*4+1]
-			bplane[idx] = row[x*4+2]
-			aplane[idx] = row[x*4+3]
-			idx++
-		}
+// projectGrid returns, for every projectionCell'th pixel corner of t (and the last row and column),
+// its coordinates in the Azimuthal Equidistant projection centered on rs.
+// Points which can't be projected are NaN.
+func projectGrid(rs *RadialSet, t Target) (xs, ys []float64, cols, rows int, err error) {
+	dst, err := godal.NewSpatialRef(t.SRS)
+	if err != nil {
+		return nil, nil, 0, 0, err
 	}
-	bands := srcDS.Bands()
-	// Set band color interpretations so -srcalpha is recognized
-	_ = bands[0].SetColorInterp(godal.CIRed)
-	_ = bands[1].SetColorInterp(godal.CIGreen)
-	_ = bands[2].SetColorInterp(godal.CIBlue)
-	_ = bands[3].SetColorInterp(godal.CIAlpha)
-	if err := bands[0].Write(0, 0, rplane, w, h); err != nil {
-		logrus.Errorf("band0 write: %v", err)
+	defer dst.Close()
+	aeqd, err := godal.NewSpatialRefFromWKT(azimuthalEquidistantWKT(rs.Lat, rs.Lon))
+	if err != nil {
+		return nil, nil, 0, 0, err
 	}
-	if err := bands[1].Write(0, 0, gplane, w, h); err != nil {
-		logrus.Errorf("band1 write: %v", err)
+	defer aeqd.Close()
+	trn, err := godal.NewTransform(dst, aeqd)
+	if err != nil {
+		return nil, nil, 0, 0, err
 	}
-	if err := bands[2].Write(0, 0, bplane, w, h); err != nil {
-		logrus.Errorf("band2 write: %v", err)
+	defer trn.Close()
+
+	cols = (t.Width+projectionCell-1)/projectionCell + 1
+	rows = (t.Height+projectionCell-1)/projectionCell + 1
+	resX := (t.Extent[2] - t.Extent[0]) / float64(t.Width)
+	resY := (t.Extent[3] - t.Extent[1]) / float64(t.Height)
+	xs = make([]float64, cols*rows)
+	ys = make([]float64, cols*rows)
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			xs[r*cols+c] = t.Extent[0] + float64(c*projectionCell)*resX
+			ys[r*cols+c] = t.Extent[3] - float64(r*projectionCell)*resY
+		}
 	}
-	if err := bands[3].Write(0, 0, aplane, w, h); err != nil {
-		logrus.Errorf("band3 write: %v", err)
+	ok := make([]bool, len(xs))
+	// errors if any point fails, which is expected for points off the edge of the world
+	trn.TransformEx(xs, ys, nil, ok)
+	for i := range ok {
+		if !ok[i] {
+			xs[i], ys[i] = math.NaN(), math.NaN()
+		}
 	}
+	return xs, ys, cols, rows, nil
+}
 
-	// 3) Warp to EPSG:3857 with the CONUS extent and desired output size
-	// Bounds from previous implementation (Web Mercator meters)
-	upperLeftX := -13914936.3491592
-	upperLeftY := 6446275.84101716
-	lowerRightX := -7235766.90156278
-	lowerRightY := 2875744.62435224
-
-	warpSwitches := []string{
-		"-of", "MEM", // in-memory output dataset
-		"-t_srs", "EPSG:3857",
-		"-te_srs", "EPSG:3857",
-		"-srcalpha",
-		"-dstalpha",
-		"-ts", strconv.Itoa(width), strconv.Itoa(height),
-		"-te",
-		fmt.Sprintf("%f", upperLeftX),
-		fmt.Sprintf("%f", lowerRightY),
-		fmt.Sprintf("%f", lowerRightX),
-		fmt.Sprintf("%f", upperLeftY),
-	}
-	// Create an in-memory warped dataset (no filename) in EPSG:3857
-	warpedDS, err := godal.Warp("", []*godal.Dataset{srcDS}, warpSwitches)
+// sample evaluates rs at the center of every pixel of t, calling set with each pixel's
+// offset (row-major from the top left), value, and range from the radar in meters (+Inf if
+// rs doesn't cover it). set is called from multiple goroutines, but never twice for the same pixel.
+func sample(ctx context.Context, rs *RadialSet, t Target, interp Interpolation, set func(i int, v, rng float64)) error {
+	xs, ys, cols, _, err := projectGrid(rs, t)
 	if err != nil {
-		logrus.Errorf("godal.Warp failed: %v", err)
-		f, _ := os.CreateTemp("", "*.png")
-		_ = pngenc.Encode(f, renderImg)
-		return f, nil
+		return err
 	}
-	defer warpedDS.Close()
-
-	// 4) Translate to PNG into a temp file name, then open and return the reader
-	tmpf, _ := os.CreateTemp("", "*.png")
-	tmpname := tmpf.Name()
-	tmpf.Close()
-	// Cancel before translate/encode
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	default:
+	idx := newPolarIndex(rs)
+	lookup := idx.valueAt
+	if interp == Bilinear {
+		lookup = idx.bilinearAt
 	}
-	outDS, err := warpedDS.Translate(tmpname, []string{"-of", "PNG"})
-	if err != nil {
-		logrus.Errorf("godal.Translate failed: %v", err)
-		// Fallback: read back bands and encode with Go's PNG
-		w := width
-		h := height
-		planes := make([][]byte, 4)
-		planes[0] = make([]byte, w*h)
-		planes[1] = make([]byte, w*h)
-		planes[2] = make([]byte, w*h)
-		planes[3] = make([]byte, w*h)
-		bnds := warpedDS.Bands()
-		if len(bnds) >= 4 {
-			_ = bnds[0].Read(0, 0, planes[0], w, h)
-			_ = bnds[1].Read(0, 0, planes[1], w, h)
-			_ = bnds[2].Read(0, 0, planes[2], w, h)
-			_ = bnds[3].Read(0, 0, planes[3], w, h)
-			img := image.NewRGBA(image.Rect(0, 0, w, h))
-			for y := 0; y < h; y++ {
-				for x := 0; x < w; x++ {
-					i := y*w + x
-					off := y*img.Stride + x*4
-					img.Pix[off+0] = planes[0][i]
-					img.Pix[off+1] = planes[1][i]
-					img.Pix[off+2] = planes[2][i]
-					img.Pix[off+3] = planes[3][i]
+	maxRange := float64(rs.Radius)
+
+	rowsCh := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range rowsCh {
+				fy := (float64(row) + 0.5) / projectionCell
+				r0 := int(fy)
+				ty := fy - float64(r0)
+				for col := 0; col < t.Width; col++ {
+					fx := (float64(col) + 0.5) / projectionCell
+					c0 := int(fx)
+					tx := fx - float64(c0)
+					i00, i01 := r0*cols+c0, r0*cols+c0+1
+					i10, i11 := i00+cols, i01+cols
+					x := (xs[i00]*(1-tx)+xs[i01]*tx)*(1-ty) + (xs[i10]*(1-tx)+xs[i11]*tx)*ty
+					y := (ys[i00]*(1-tx)+ys[i01]*tx)*(1-ty) + (ys[i10]*(1-tx)+ys[i11]*tx)*ty
+
+					rng := math.Hypot(x, y)
+					if math.IsNaN(rng) || rng > maxRange {
+						set(row*t.Width+col, GateEmptyValue, math.Inf(1))
+						continue
+					}
+					az := math.Atan2(x, y) * 180 / math.Pi
+					if az < 0 {
+						az += 360
+					}
+					set(row*t.Width+col, lookup(az, rng), rng)
 				}
 			}
-			f, _ := os.CreateTemp("", "*.png")
-			_ = pngenc.Encode(f, img)
-			return f, nil
+		}()
+	}
+
+	var canceled error
+	for row := 0; row < t.Height; row++ {
+		if row%64 == 0 {
+			if err := ctx.Err(); err != nil {
+				canceled = err
+				break
+			}
 		}
-		// If we can't read bands, still return a valid (empty) PNG
-		f, _ := os.CreateTemp("", "*.png")
-		_ = pngenc.Encode(f, image.NewRGBA(image.Rect(0, 0, w, h)))
-		return f, nil
+		rowsCh <- row
+	}
+	close(rowsCh)
+	wg.Wait()
+	return canceled
+}
+
+// RenderAndReproject renders rs through lut into a PNG of target t
+func RenderAndReproject(ctx context.Context, rs *RadialSet, lut func(float64) color.Color, t Target, interp Interpolation) (io.ReadCloser, error) {
+	r, err := SampleRadialSet(ctx, rs, t, interp)
+	if err != nil {
+		return nil, err
 	}
-	outDS.Close()
-	f, _ := os.Open(tmpname)
-	return f, nil
+	return r.PNG(lut)
+}
+
+// removeOnClose deletes the temp file it reads from once closed
+type removeOnClose struct {
+	*os.File
+}
+
+func (f removeOnClose) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
 }
 
-// little helper to keep both a GDAL dataset and the DS's backing Image together
-// both for convenience but also to make sure the DS's backing memory doesn't get GCd
 // Build WKT for an Azimuthal Equidistant projection centered on given lat/lon
 func azimuthalEquidistantWKT(lat, lon float64) string {
 	return fmt.Sprintf(
@@ -207,78 +180,3 @@ func azimuthalEquidistantWKT(lat, lon float64) string {
 		lon,
 	)
 }
-
-func render(ctx context.Context, rs *RadialSet, imageSize int, lut func(float64) color.Color) *image.RGBA {
-	width := float64(imageSize)
-	height := float64(imageSize)
-
-	canvas := image.NewRGBA(image.Rect(0, 0, imageSize, imageSize))
-	draw.Draw(canvas, canvas.Bounds(), image.Transparent, image.ZP, draw.Src)
-
-	gc := draw2dimg.NewGraphicContext(canvas)
-
-	xc := width / 2
-	yc := height / 2
-	pxPerKm := width / 2 / (float64(rs.Radius) / 1000)
-
-	for _, radial := range rs.Radials {
-		select {
-		case <-ctx.Done():
-			return canvas
-		default:
-		}
-		// round to the nearest rounded azimuth for the given resolution.
-		// ex: for radial 20.5432, round to 20.5
-		azimuthAngle := float64(radial.AzimuthAngle) - 90
-		if azimuthAngle < 0 {
-			azimuthAngle = 360.0 + azimuthAngle
-		}
-		azimuthSpacing := radial.AzimuthResolution
-		azimuth := math.Floor(azimuthAngle)
-		if math.Floor(azimuthAngle+float64(azimuthSpacing)) > azimuth {
-			azimuth += float64(azimuthSpacing)
-		}
-		startAngle := float64(azimuth * (math.Pi / 180.0))        /* angles are specified */
-		angleDelta := float64(azimuthSpacing * (math.Pi / 180.0)) /* clockwise in radians */
-
-		// start drawing gates from the start of the first gate
-		firstGatePx := (radial.StartRange / 1000) * pxPerKm
-		gateIntervalKm := radial.GateInterval / 1000
-		gateWidthPx := gateIntervalKm * pxPerKm
-		distanceX, distanceY := firstGatePx, firstGatePx
-		gc.SetLineWidth(gateWidthPx + 1)
-		gc.SetLineCap(draw2d.ButtCap)
-
-		numGates := len(radial.Gates)
-		for i, v := range radial.Gates {
-			if i%256 == 0 { // periodic cancel check to reduce overhead
-				select {
-				case <-ctx.Done():
-					return canvas
-				default:
-				}
-			}
-			if v != GateEmptyValue {
-				gc.MoveTo(xc+math.Cos(startAngle)*distanceX, yc+math.Sin(startAngle)*distanceY)
-
-				// make the gates connect visually by extending arcs so there is no space between adjacent gates.
-				if i == 0 {
-					gc.ArcTo(xc, yc, distanceX, distanceY, startAngle-.001, angleDelta+.001)
-				} else if i == numGates-1 {
-					gc.ArcTo(xc, yc, distanceX, distanceY, startAngle, angleDelta)
-				} else {
-					gc.ArcTo(xc, yc, distanceX, distanceY, startAngle, angleDelta+.001)
-				}
-
-				gc.SetStrokeColor(lut(v))
-				gc.Stroke()
-			}
-
-			distanceX += gateWidthPx
-			distanceY += gateWidthPx
-			azimuth += radial.AzimuthResolution
-		}
-	}
-
-	return canvas
-}
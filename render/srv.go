@@ -0,0 +1,30 @@
+package render
+
+import "math"
+
+// StormRelative returns a copy of the velocity RadialSet rs with the component of the storm
+// motion m along each radial subtracted, giving storm-relative velocity.
+// rs is not modified.
+func StormRelative(rs *RadialSet, m Motion) *RadialSet {
+	out := *rs
+	out.Radials = make(RadialSlice, len(rs.Radials))
+	// the beam is tilted, so only part of the (horizontal) motion is seen along it
+	cosElv := math.Cos(rs.ElevationAngle * math.Pi / 180)
+	for i, r := range rs.Radials {
+		az := r.AzimuthAngle * math.Pi / 180
+		// along the beam, away from the radar, the same sign as (outbound) radial velocity
+		away := (m.U*math.Sin(az) + m.V*math.Cos(az)) * cosElv
+
+		nr := *r
+		nr.Gates = make([]float64, len(r.Gates))
+		for g, v := range r.Gates {
+			if v == GateEmptyValue {
+				nr.Gates[g] = v
+				continue
+			}
+			nr.Gates[g] = v - away
+		}
+		out.Radials[i] = &nr
+	}
+	return &out
+}
@@ -0,0 +1,184 @@
+package render
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	pngenc "image/png"
+	"math"
+	"sync"
+
+	"github.com/airbusgeo/godal"
+)
+
+// Target describes the raster a RadialSet is rendered into
+type Target struct {
+	// Spatial reference of the output, anything GDAL understands (e.g. "EPSG:3857")
+	SRS string
+	// Output extent in SRS units as minX, minY, maxX, maxY
+	Extent [4]float64
+	Width  int
+	Height int
+}
+
+// CONUS is the default target: all of the continental US in Web Mercator
+var CONUS = Target{
+	SRS:    "EPSG:3857",
+	Extent: [4]float64{-13914936.3491592, 2875744.62435224, -7235766.90156278, 6446275.84101716},
+	Width:  6000,
+	Height: 2600,
+}
+
+// Half the width of the world in Web Mercator meters
+const webMercatorHalfWorld = 20037508.342789244
+
+// InCONUS returns whether lat, lon falls in the CONUS target
+func InCONUS(lat, lon float64) bool {
+	toLon := func(x float64) float64 { return x / webMercatorHalfWorld * 180 }
+	toLat := func(y float64) float64 {
+		return math.Atan(math.Sinh(y/webMercatorHalfWorld*math.Pi)) * 180 / math.Pi
+	}
+	e := CONUS.Extent
+	return lon >= toLon(e[0]) && lon <= toLon(e[2]) && lat >= toLat(e[1]) && lat <= toLat(e[3])
+}
+
+// transformExtent returns the bounding box in dst of extent in src.
+// Edges are sampled since they needn't be straight lines after projection.
+func transformExtent(src, dst *godal.SpatialRef, extent [4]float64) ([4]float64, error) {
+	trn, err := godal.NewTransform(src, dst)
+	if err != nil {
+		return [4]float64{}, err
+	}
+	defer trn.Close()
+
+	const steps = 20
+	xs := make([]float64, 0, 4*(steps+1))
+	ys := make([]float64, 0, 4*(steps+1))
+	for i := 0; i <= steps; i++ {
+		fx := extent[0] + (extent[2]-extent[0])*float64(i)/steps
+		fy := extent[1] + (extent[3]-extent[1])*float64(i)/steps
+		xs = append(xs, fx, fx, extent[0], extent[2])
+		ys = append(ys, extent[1], extent[3], fy, fy)
+	}
+	ok := make([]bool, len(xs))
+	// errors if any point fails, which is fine as long as some didn't
+	trn.TransformEx(xs, ys, nil, ok)
+
+	out := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for i := range xs {
+		if !ok[i] {
+			continue
+		}
+		out[0] = math.Min(out[0], xs[i])
+		out[1] = math.Min(out[1], ys[i])
+		out[2] = math.Max(out[2], xs[i])
+		out[3] = math.Max(out[3], ys[i])
+	}
+	if out[0] >= out[2] || out[1] >= out[3] {
+		return [4]float64{}, errors.New("Extent can't be projected into the target SRS")
+	}
+	return out, nil
+}
+
+// TransformExtent returns the bounding box in dstSRS of extent in srcSRS
+func TransformExtent(extent [4]float64, srcSRS, dstSRS string) ([4]float64, error) {
+	src, err := godal.NewSpatialRef(srcSRS)
+	if err != nil {
+		return [4]float64{}, err
+	}
+	defer src.Close()
+	dst, err := godal.NewSpatialRef(dstSRS)
+	if err != nil {
+		return [4]float64{}, err
+	}
+	defer dst.Close()
+	return transformExtent(src, dst, extent)
+}
+
+// SiteExtent returns the extent covered by rs in srs
+func SiteExtent(rs *RadialSet, srs string) ([4]float64, error) {
+	src, err := godal.NewSpatialRefFromWKT(azimuthalEquidistantWKT(rs.Lat, rs.Lon))
+	if err != nil {
+		return [4]float64{}, err
+	}
+	defer src.Close()
+	dst, err := godal.NewSpatialRef(srs)
+	if err != nil {
+		return [4]float64{}, err
+	}
+	defer dst.Close()
+	r := float64(rs.Radius)
+	return transformExtent(src, dst, [4]float64{-r, -r, r, r})
+}
+
+// TileTarget returns the target for the XYZ (slippy map) tile z/x/y in Web Mercator
+func TileTarget(z, x, y, size int) Target {
+	tileSize := 2 * webMercatorHalfWorld / float64(int(1)<<z)
+	minX := -webMercatorHalfWorld + float64(x)*tileSize
+	maxY := webMercatorHalfWorld - float64(y)*tileSize
+	return Target{
+		SRS:    "EPSG:3857",
+		Extent: [4]float64{minX, maxY - tileSize, minX + tileSize, maxY},
+		Width:  size,
+		Height: size,
+	}
+}
+
+// TileLatLonBounds returns the extent of tile z/x/y as minLon, minLat, maxLon, maxLat
+func TileLatLonBounds(z, x, y int) [4]float64 {
+	n := float64(int(1) << z)
+	lon := func(x int) float64 { return float64(x)/n*360 - 180 }
+	lat := func(y int) float64 { return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi }
+	return [4]float64{lon(x), lat(y + 1), lon(x + 1), lat(y)}
+}
+
+// LatLonBounds returns the (approximate, slightly generous) extent covered by rs as
+// minLon, minLat, maxLon, maxLat
+func (rs *RadialSet) LatLonBounds() [4]float64 {
+	return LatLonBoundsAround(rs.Lat, rs.Lon, float64(rs.Radius))
+}
+
+// LatLonBoundsAround returns the (approximate, slightly generous) extent within radius meters
+// of lat, lon as minLon, minLat, maxLon, maxLat
+func LatLonBoundsAround(lat, lon, radius float64) [4]float64 {
+	const metersPerDegree = 111320.0
+	dLat := radius / metersPerDegree * 1.05
+	dLon := dLat / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	return [4]float64{lon - dLon, lat - dLat, lon + dLon, lat + dLat}
+}
+
+// TileIntersects returns whether any of rs could fall in tile z/x/y
+func TileIntersects(rs *RadialSet, z, x, y int) bool {
+	return TileIntersectsBounds(rs.LatLonBounds(), z, x, y)
+}
+
+// TileIntersectsBounds returns whether tile z/x/y overlaps b (minLon, minLat, maxLon, maxLat)
+func TileIntersectsBounds(b [4]float64, z, x, y int) bool {
+	t := TileLatLonBounds(z, x, y)
+	return t[0] <= b[2] && b[0] <= t[2] && t[1] <= b[3] && b[1] <= t[3]
+}
+
+var emptyPNGs sync.Map
+
+// EmptyPNG returns a fully transparent PNG of the given size
+func EmptyPNG(width, height int) []byte {
+	key := [2]int{width, height}
+	if png, ok := emptyPNGs.Load(key); ok {
+		return png.([]byte)
+	}
+	var buf bytes.Buffer
+	pngenc.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height)))
+	emptyPNGs.Store(key, buf.Bytes())
+	return buf.Bytes()
+}
+
+// LatLonOrder returns whether srs officially has latitude as its first axis (e.g. EPSG:4326),
+// as WMS 1.3.0 bboxes follow the official order
+func LatLonOrder(srs string) bool {
+	sr, err := godal.NewSpatialRef(srs)
+	if err != nil {
+		return false
+	}
+	defer sr.Close()
+	return sr.EPSGTreatsAsLatLong()
+}
@@ -0,0 +1,115 @@
+package render
+
+import (
+	"context"
+	"image/color"
+	"io"
+	"math"
+)
+
+// CrossSection is a vertical slice through a volume along a great circle segment
+type CrossSection struct {
+	// Length of the segment in meters
+	Length float64
+	// Position of each column, evenly spaced from the start to the end of the segment
+	Lats []float64
+	Lons []float64
+	// Height of each level in meters above sea level, ascending
+	Heights []float64
+	// Indexed by level*len(Lats) + column, GateEmptyValue where there's no data
+	Values []float32
+}
+
+// greatCircle returns the distance in meters and initial bearing in degrees from lat1, lon1 to lat2, lon2
+func greatCircle(lat1, lon1, lat2, lon2 float64) (float64, float64) {
+	p1, p2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dLon := (lon2 - lon1) * math.Pi / 180
+	a := math.Pow(math.Sin((p2-p1)/2), 2) + math.Cos(p1)*math.Cos(p2)*math.Pow(math.Sin(dLon/2), 2)
+	dist := 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+	bearing := math.Atan2(math.Sin(dLon)*math.Cos(p2), math.Cos(p1)*math.Sin(p2)-math.Sin(p1)*math.Cos(p2)*math.Cos(dLon))
+	return dist, math.Mod(bearing*180/math.Pi+360, 360)
+}
+
+// destination returns the point dist meters from lat, lon along the great circle with initial
+// bearing (degrees clockwise from north)
+func destination(lat, lon, bearing, dist float64) (float64, float64) {
+	p1, b, d := lat*math.Pi/180, bearing*math.Pi/180, dist/earthRadius
+	p2 := math.Asin(math.Sin(p1)*math.Cos(d) + math.Cos(p1)*math.Sin(d)*math.Cos(b))
+	dLon := math.Atan2(math.Sin(b)*math.Sin(d)*math.Cos(p1), math.Cos(d)-math.Sin(p1)*math.Sin(p2))
+	return p2 * 180 / math.Pi, math.Mod(lon+dLon*180/math.Pi+540, 360) - 180
+}
+
+// intermediatePoint returns the point fraction f of the way along the great circle from
+// lat1, lon1 to lat2, lon2
+func intermediatePoint(lat1, lon1, lat2, lon2, f float64) (float64, float64) {
+	dist, _ := greatCircle(lat1, lon1, lat2, lon2)
+	d := dist / earthRadius
+	if d == 0 {
+		return lat1, lon1
+	}
+	p1, l1 := lat1*math.Pi/180, lon1*math.Pi/180
+	p2, l2 := lat2*math.Pi/180, lon2*math.Pi/180
+	a := math.Sin((1-f)*d) / math.Sin(d)
+	b := math.Sin(f*d) / math.Sin(d)
+	x := a*math.Cos(p1)*math.Cos(l1) + b*math.Cos(p2)*math.Cos(l2)
+	y := a*math.Cos(p1)*math.Sin(l1) + b*math.Cos(p2)*math.Sin(l2)
+	z := a*math.Sin(p1) + b*math.Sin(p2)
+	return math.Atan2(z, math.Hypot(x, y)) * 180 / math.Pi, math.Atan2(y, x) * 180 / math.Pi
+}
+
+// NewCrossSection samples the volume elvs at columns points evenly spaced along the great
+// circle from start to end (lat, lon), at each of heights (meters above sea level, ascending).
+// Horizontally each elevation is sampled with interp; vertically values are linearly
+// interpolated between beams.
+func NewCrossSection(ctx context.Context, elvs ElevationSet, start, end [2]float64, columns int, heights []float64, interp Interpolation) (*CrossSection, error) {
+	vs := newVolumeSampler(elvs, interp)
+	x := &CrossSection{
+		Lats:    make([]float64, columns),
+		Lons:    make([]float64, columns),
+		Heights: heights,
+		Values:  make([]float32, columns*len(heights)),
+	}
+	x.Length, _ = greatCircle(start[0], start[1], end[0], end[1])
+	for i := range x.Values {
+		x.Values[i] = rasterEmptyValue
+	}
+	if len(vs.elvs) == 0 {
+		return x, nil
+	}
+	site := vs.elvs[0]
+
+	col := make([]columnSample, 0, len(vs.elvs))
+	for c := 0; c < columns; c++ {
+		if c%64 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		f := 0.0
+		if columns > 1 {
+			f = float64(c) / float64(columns-1)
+		}
+		lat, lon := intermediatePoint(start[0], start[1], end[0], end[1], f)
+		x.Lats[c], x.Lons[c] = lat, lon
+
+		gr, az := greatCircle(site.Lat, site.Lon, lat, lon)
+		col = vs.column(col[:0], gr, az)
+		for z, h := range heights {
+			if v := interpolateColumn(col, h-site.Height); v != GateEmptyValue {
+				x.Values[z*columns+c] = float32(v)
+			}
+		}
+	}
+	return x, nil
+}
+
+// PNG colors x through lut, with distance along the segment to the right and height up
+func (x *CrossSection) PNG(lut func(float64) color.Color) (io.ReadCloser, error) {
+	columns, levels := len(x.Lats), len(x.Heights)
+	// images go top down
+	flipped := make([]float32, len(x.Values))
+	for z := 0; z < levels; z++ {
+		copy(flipped[(levels-1-z)*columns:(levels-z)*columns], x.Values[z*columns:(z+1)*columns])
+	}
+	return encodePNG(flipped, columns, levels, lut)
+}
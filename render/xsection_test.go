@@ -0,0 +1,83 @@
+package render
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestIntermediatePoint(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+	}{
+		{"along the equator", 0, 0, 0, 10},
+		{"north-south", 30, -97, 40, -97},
+		{"diagonal", 35.3, -97.3, 36.1, -95.9},
+		{"across the antimeridian", 10, 179, 12, -178},
+		{"same point", 35, -97, 35, -97},
+	}
+	for _, tt := range tests {
+		total, _ := greatCircle(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+		for _, f := range []float64{0, 0.25, 0.5, 1} {
+			lat, lon := intermediatePoint(tt.lat1, tt.lon1, tt.lat2, tt.lon2, f)
+			// on the great circle, f of the way along it
+			fromStart, _ := greatCircle(tt.lat1, tt.lon1, lat, lon)
+			toEnd, _ := greatCircle(lat, lon, tt.lat2, tt.lon2)
+			if math.Abs(fromStart-f*total) > 0.01 || math.Abs(toEnd-(1-f)*total) > 0.01 {
+				t.Errorf("%s: point %g of the way is %gm from the start and %gm from the end of %gm", tt.name, f, fromStart, toEnd, total)
+			}
+		}
+	}
+}
+
+func TestNewCrossSection(t *testing.T) {
+	ctx := context.Background()
+	// uniformSweeps are at 0, 0 and reach 40km
+	elvs := ElevationSet{uniformSweep(3.0, 40), uniformSweep(0.5, 20)}
+	start, end := [2]float64{0, 0.2}, [2]float64{0, 0.5}
+	// height of the beam at elev over the point lon degrees east
+	h := func(lon, elev float64) float64 {
+		gr, _ := greatCircle(0, 0, 0, lon)
+		return beamHeight(slantRange(gr, elev), elev) + 400
+	}
+	// value at height over lon between the beams, from 20 at the 0.5 one to 40 at the 3.0
+	at := func(lon, height float64) float32 {
+		lo, hi := h(lon, 0.5), h(lon, 3.0)
+		return float32(20 + 20*(height-lo)/(hi-lo))
+	}
+	// halfway between the beams over the start, and at the lower one
+	heights := []float64{(h(0.2, 0.5) + h(0.2, 3.0)) / 2, h(0.2, 0.5)}
+
+	x, err := NewCrossSection(ctx, elvs, start, end, 4, heights, Nearest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := greatCircle(0, 0.2, 0, 0.5); math.Abs(x.Length-want) > 1e-6 {
+		t.Errorf("length %g, want %g", x.Length, want)
+	}
+	for c, want := range []float64{0.2, 0.3, 0.4, 0.5} {
+		if math.Abs(x.Lats[c]) > 1e-9 || math.Abs(x.Lons[c]-want) > 1e-9 {
+			t.Errorf("column %d at %g, %g, want 0, %g", c, x.Lats[c], x.Lons[c], want)
+		}
+	}
+	// columns 2 and 3 are 44km and 56km out, beyond the data. Over column 1 the lower height is
+	// below the 0.5 beam's center, but within its width.
+	const empty = rasterEmptyValue
+	want := []float32{30, at(0.3, heights[0]), empty, empty, 20, 20, empty, empty}
+	for i := range want {
+		if math.Abs(float64(x.Values[i]-want[i])) > 1e-3 {
+			t.Errorf("level %d column %d = %g, want %g", i/4, i%4, x.Values[i], want[i])
+		}
+	}
+
+	x, err = NewCrossSection(ctx, nil, start, end, 4, heights, Nearest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range x.Values {
+		if v != empty {
+			t.Errorf("value %d of an empty volume = %g", i, v)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Site is a radar site's location, as listed in nexrad.kml
+type Site struct {
+	ID   string
+	Name string
+	Lat  float64
+	Lon  float64
+	// Elevation of the site in feet
+	Elevation float64
+}
+
+// Sites holds every known site by ID (e.g. KTLX)
+var Sites = map[string]Site{}
+
+var kmlFieldRe = regexp.MustCompile(`<td>(SITE ID NEXRAD:|LATITUDE |LONGITUDE |ELEVATION )([^<]+)</td>`)
+
+// LoadSites reads site locations from a KML file like nexrad.kml
+func LoadSites(path string) (map[string]Site, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var doc struct {
+		Placemarks []struct {
+			Name        string `xml:"name"`
+			Description string `xml:"description"`
+		} `xml:"Document>Placemark"`
+	}
+	if err := xml.NewDecoder(f).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	sites := make(map[string]Site, len(doc.Placemarks))
+	for _, p := range doc.Placemarks {
+		s := Site{Name: strings.TrimSpace(p.Name)}
+		for _, m := range kmlFieldRe.FindAllStringSubmatch(p.Description, -1) {
+			v := strings.TrimSpace(m[2])
+			switch m[1] {
+			case "SITE ID NEXRAD:":
+				s.ID = v
+			case "LATITUDE ":
+				s.Lat, _ = strconv.ParseFloat(v, 64)
+			case "LONGITUDE ":
+				s.Lon, _ = strconv.ParseFloat(v, 64)
+			case "ELEVATION ":
+				s.Elevation, _ = strconv.ParseFloat(v, 64)
+			}
+		}
+		if s.ID != "" {
+			sites[s.ID] = s
+		}
+	}
+	return sites, nil
+}
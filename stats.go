@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/kallsyms/radserv/diskcache"
+)
+
+// DiskCache is the persistent L2 volume cache, or nil if disabled
+var DiskCache *diskcache.Cache
+
+type serverStats struct {
+	L2Meta CacheStats
+	// Cost is an estimate of bytes held
+	RadialSets CacheStats
+	// Cost is bytes held
+	Tiles     CacheStats
+	DiskCache *diskcache.Stats `json:",omitempty"`
+}
+
+func statsHandler(c *gin.Context) {
+	stats := serverStats{
+		L2Meta:     ChunkCache.Stats(),
+		RadialSets: RadialCache.Stats(),
+		Tiles:      TileCache.Stats(),
+	}
+	if DiskCache != nil {
+		ds := DiskCache.Stats()
+		stats.DiskCache = &ds
+	}
+	c.JSON(200, stats)
+}
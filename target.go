@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kallsyms/radserv/render"
+)
+
+const (
+	// Largest width or height of a render
+	maxRenderSize = 8192
+	// Largest width*height of a render
+	maxRenderPixels = 40 * 1000 * 1000
+	// Longest side of renders which aren't of CONUS when no size is given
+	defaultRenderSize = 2048
+)
+
+// Only EPSG codes are accepted, as GDAL will also happily take e.g. file paths as an SRS
+var srsRe = regexp.MustCompile(`^EPSG:[0-9]+$`)
+
+func parseSRS(c *gin.Context, param, def string) (string, error) {
+	srs := strings.ToUpper(c.DefaultQuery(param, def))
+	if !srsRe.MatchString(srs) {
+		return "", fmt.Errorf("Invalid %s, expected EPSG:<code>", param)
+	}
+	return srs, nil
+}
+
+func parseRenderSize(c *gin.Context, param string) (int, error) {
+	s := c.Query(param)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxRenderSize {
+		return 0, fmt.Errorf("Invalid %s, expected 1-%d", param, maxRenderSize)
+	}
+	return n, nil
+}
+
+// targetParams are the srs, bbox (and bbox_srs), width and height query params
+type targetParams struct {
+	SRS string
+	// In SRS, nil if not given
+	BBox *[4]float64
+	// 0 if not given
+	Width, Height int
+}
+
+func parseTargetParams(c *gin.Context) (targetParams, error) {
+	var p targetParams
+	var err error
+	p.SRS, err = parseSRS(c, "srs", "EPSG:3857")
+	if err != nil {
+		return p, err
+	}
+	p.Width, err = parseRenderSize(c, "width")
+	if err != nil {
+		return p, err
+	}
+	p.Height, err = parseRenderSize(c, "height")
+	if err != nil {
+		return p, err
+	}
+
+	if s := c.Query("bbox"); s != "" {
+		b, err := parseBBox(s)
+		if err != nil {
+			return p, err
+		}
+		bboxSRS, err := parseSRS(c, "bbox_srs", p.SRS)
+		if err != nil {
+			return p, err
+		}
+		if bboxSRS != p.SRS {
+			b, err = render.TransformExtent(b, bboxSRS, p.SRS)
+			if err != nil {
+				return p, err
+			}
+		}
+		p.BBox = &b
+	}
+	return p, nil
+}
+
+// parseTarget builds the render target for rs from the srs, bbox, bbox_srs, width and height
+// query params
+func parseTarget(c *gin.Context, rs *render.RadialSet) (render.Target, error) {
+	p, err := parseTargetParams(c)
+	if err != nil {
+		return render.Target{}, err
+	}
+	return buildTarget(rs, p.SRS, p.BBox, p.Width, p.Height)
+}
+
+// parseBBox parses minx,miny,maxx,maxy
+func parseBBox(s string) ([4]float64, error) {
+	var b [4]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return b, errors.New("Invalid bbox, expected minx,miny,maxx,maxy")
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return b, errors.New("Invalid bbox, expected minx,miny,maxx,maxy")
+		}
+		b[i] = v
+	}
+	if b[0] >= b[2] || b[1] >= b[3] {
+		return b, errors.New("Invalid bbox, min must be less than max")
+	}
+	return b, nil
+}
+
+// buildTarget makes a target in srs covering bbox, or if nil, the CONUS extent (in EPSG:3857,
+// for sites in CONUS) or an extent around the site. A width or height of 0 is derived from
+// the other (or a default size) to keep pixels square. rs is only used if bbox is nil.
+func buildTarget(rs *render.RadialSet, srs string, bbox *[4]float64, width, height int) (render.Target, error) {
+	t := render.Target{SRS: srs}
+	var err error
+	if bbox != nil {
+		t.Extent = *bbox
+	} else if srs == render.CONUS.SRS && render.InCONUS(rs.Lat, rs.Lon) {
+		t.Extent = render.CONUS.Extent
+		if width == 0 && height == 0 {
+			width, height = render.CONUS.Width, render.CONUS.Height
+		}
+	} else {
+		t.Extent, err = render.SiteExtent(rs, srs)
+		if err != nil {
+			return t, err
+		}
+	}
+
+	aspect := (t.Extent[2] - t.Extent[0]) / (t.Extent[3] - t.Extent[1])
+	switch {
+	case width == 0 && height == 0:
+		if aspect >= 1 {
+			width = defaultRenderSize
+		} else {
+			height = defaultRenderSize
+		}
+		fallthrough
+	case width == 0 || height == 0:
+		if width == 0 {
+			width = int(math.Round(float64(height) * aspect))
+		} else {
+			height = int(math.Round(float64(width) / aspect))
+		}
+	}
+	if width < 1 || height < 1 || width > maxRenderSize || height > maxRenderSize || width*height > maxRenderPixels {
+		return t, fmt.Errorf("Render size %dx%d is out of range", width, height)
+	}
+	t.Width, t.Height = width, height
+	return t, nil
+}
+
+// parseRenderFormat parses ?format=, png (the default), geotiff or cog (Cloud Optimized GeoTIFF)
+func parseRenderFormat(c *gin.Context) (string, error) {
+	format := strings.ToLower(c.DefaultQuery("format", "png"))
+	switch format {
+	case "png", "geotiff", "cog":
+		return format, nil
+	}
+	return "", fmt.Errorf("Invalid format %q, expected png, geotiff or cog", format)
+}
+
+// parseInterp parses ?interp=, nearest (the default) or bilinear
+func parseInterp(c *gin.Context) (render.Interpolation, error) {
+	switch interp := strings.ToLower(c.DefaultQuery("interp", "nearest")); interp {
+	case "nearest":
+		return render.Nearest, nil
+	case "bilinear":
+		return render.Bilinear, nil
+	default:
+		return render.Nearest, fmt.Errorf("Invalid interp %q, expected nearest or bilinear", interp)
+	}
+}
+
+// renderRadialSet renders rs into target in format, returning the output and its content type
+func renderRadialSet(ctx context.Context, rs *render.RadialSet, lut func(float64) color.Color, target render.Target, format string, interp render.Interpolation) (io.ReadCloser, string, error) {
+	r, err := render.SampleRadialSet(ctx, rs, target, interp)
+	if err != nil {
+		return nil, "", err
+	}
+	return encodeRaster(r, lut, format)
+}
+
+// encodeRaster encodes r in format, returning the output and its content type.
+// PNGs are colored by lut; GeoTIFFs hold the values themselves.
+func encodeRaster(r *render.Raster, lut func(float64) color.Color, format string) (io.ReadCloser, string, error) {
+	switch format {
+	case "geotiff":
+		f, err := r.GeoTIFF()
+		return f, "image/tiff", err
+	case "cog":
+		f, err := r.COG()
+		return f, "image/tiff", err
+	}
+	f, err := r.PNG(lut)
+	return f, "image/png", err
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"image/color"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kallsyms/radserv/render"
+)
+
+// TileCache holds rendered tiles (PNG bytes) by request URL
+var TileCache *lruCache[string, []byte]
+
+func NewTileCache(maxBytes int64) *lruCache[string, []byte] {
+	return newLRUCache[string, []byte](maxBytes, 0, func(png []byte) int64 { return int64(len(png)) })
+}
+
+const maxTileZoom = 22
+
+// Tiles further than this many meters from a site can't have any of its data
+const tileSiteRange = 460e3
+
+type tileCoord struct {
+	Z, X, Y int
+	// Width and height in pixels
+	Size   int
+	Interp render.Interpolation
+}
+
+// parseTile parses the :z/:x/:y(.png) path parameters, ?size= (256 or 512) and ?interp=
+func parseTile(c *gin.Context) (tileCoord, error) {
+	z, err := strconv.Atoi(c.Param("z"))
+	if err != nil || z < 0 || z > maxTileZoom {
+		return tileCoord{}, errors.New("Invalid z")
+	}
+	n := 1 << z
+	x, err := strconv.Atoi(c.Param("x"))
+	if err != nil || x < 0 || x >= n {
+		return tileCoord{}, errors.New("Invalid x")
+	}
+	y, err := strconv.Atoi(strings.TrimSuffix(c.Param("y"), ".png"))
+	if err != nil || y < 0 || y >= n {
+		return tileCoord{}, errors.New("Invalid y")
+	}
+	size := 256
+	if s := c.Query("size"); s != "" {
+		size, err = strconv.Atoi(s)
+		if err != nil || (size != 256 && size != 512) {
+			return tileCoord{}, errors.New("Invalid size, expected 256 or 512")
+		}
+	}
+	interp, err := parseInterp(c)
+	if err != nil {
+		return tileCoord{}, err
+	}
+	return tileCoord{z, x, y, size, interp}, nil
+}
+
+// tileCacheKey identifies the tile a request is for. Everything that changes the output is in the URL.
+func tileCacheKey(c *gin.Context) string {
+	return c.Request.URL.Path + "?" + c.Request.URL.RawQuery
+}
+
+func writeTile(c *gin.Context, png []byte) {
+	// Tiles only depend on their file
+	setFileCacheHeaders(c)
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+// tileOutsideSite returns whether tile t is beyond the range of site (a 4 letter ID, or the 3
+// letter one used for Level 3), so it can be served empty without loading any data.
+// Unknown sites might reach anywhere.
+func tileOutsideSite(site string, t tileCoord) bool {
+	site = strings.ToUpper(site)
+	s, ok := Sites[site]
+	if !ok && len(site) == 3 {
+		s, ok = Sites["K"+site]
+	}
+	if !ok {
+		return false
+	}
+	return !render.TileIntersectsBounds(render.LatLonBoundsAround(s.Lat, s.Lon, tileSiteRange), t.Z, t.X, t.Y)
+}
+
+// serveEmptyTile serves (and caches under key) a transparent tile
+func serveEmptyTile(c *gin.Context, key string, t tileCoord) {
+	png := render.EmptyPNG(t.Size, t.Size)
+	TileCache.Put(key, png)
+	writeTile(c, png)
+}
+
+// serveTile renders tile t of rs (or an empty tile if rs doesn't reach it), caching it under key
+func serveTile(c *gin.Context, key string, t tileCoord, rs *render.RadialSet, lut func(float64) color.Color) {
+	if !render.TileIntersects(rs, t.Z, t.X, t.Y) {
+		serveEmptyTile(c, key, t)
+		return
+	}
+
+	pngFile, err := render.RenderAndReproject(c.Request.Context(), rs, lut, render.TileTarget(t.Z, t.X, t.Y, t.Size), t.Interp)
+	if err != nil {
+		if c.Request.Context().Err() == nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+	png, err := io.ReadAll(pngFile)
+	pngFile.Close()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	TileCache.Put(key, png)
+
+	select {
+	case <-c.Request.Context().Done():
+		return
+	default:
+	}
+	writeTile(c, png)
+}
+
+// l2FileTileHandler serves /:product/:elv/tiles/:z/:x/:y and /:product/tiles/:z/:x/:y?angle=
+func l2FileTileHandler(c *gin.Context) {
+	t, err := parseTile(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	key := tileCacheKey(c)
+	if png, ok := TileCache.Get(key); ok {
+		writeTile(c, png)
+		return
+	}
+	if tileOutsideSite(c.Param("site"), t) {
+		serveEmptyTile(c, key, t)
+		return
+	}
+
+	sel, err := parseSweepSelector(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if sel.Which == "all" {
+		c.AbortWithError(http.StatusBadRequest, errors.New("which=all is not supported for tiles"))
+		return
+	}
+
+	product, sets, ok := loadL2RadialSets(c, sel)
+	if !ok {
+		return
+	}
+	lut := render.DefaultLUT(product)
+	if _, ok := c.GetQuery("nolut"); ok {
+		lut = render.DefaultLUT("")
+	}
+
+	serveTile(c, key, t, sets[0], lut)
+}
+
+func l3FileTileHandler(c *gin.Context) {
+	t, err := parseTile(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	key := tileCacheKey(c)
+	if png, ok := TileCache.Get(key); ok {
+		writeTile(c, png)
+		return
+	}
+	if tileOutsideSite(c.Param("site"), t) {
+		serveEmptyTile(c, key, t)
+		return
+	}
+
+	r, err := l3radial(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	serveTile(c, key, t, r, render.DefaultLUT(c.Param("product")))
+}
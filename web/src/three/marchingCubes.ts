@@ -5,6 +5,8 @@ import type { VolumeGrid } from './grid'
 
 export type MeshData = { positions: Float32Array; indices: Uint32Array }
 
+const EFFECTIVE_EARTH_RADIUS = 6371000 * 4 / 3
+
 function lerp(a: number, b: number, t: number) { return a + (b - a) * t }
 
 export function generateIsosurface(grid: VolumeGrid, threshold: number): MeshData {
@@ -43,13 +45,16 @@ export function generateIsosurface(grid: VolumeGrid, threshold: number): MeshDat
     // Clamp vx to valid gate index range to avoid numeric spillover
     const vxClamped = Math.max(0, Math.min(nx - 1, vx))
     const gateDist = grid.startRange + (vxClamped * grid.gateInterval)
+    // 4/3 earth radius beam model, as in server-side render/beam.go
     const elvRad = elvAngle * Math.PI / 180.0
-    const horiz = Math.cos(elvRad) * gateDist // ground distance
+    const height = Math.sqrt(gateDist * gateDist + EFFECTIVE_EARTH_RADIUS * EFFECTIVE_EARTH_RADIUS +
+      2 * gateDist * EFFECTIVE_EARTH_RADIUS * Math.sin(elvRad)) - EFFECTIVE_EARTH_RADIUS
+    const horiz = EFFECTIVE_EARTH_RADIUS * Math.asin(gateDist * Math.cos(elvRad) / (EFFECTIVE_EARTH_RADIUS + height)) // ground distance
     // Map radar azimuth (0°=north, CW positive) to ENU meters (x=east, y=north).
     // Fix north-south mirroring by using positive Y component
     const X = Math.cos(angle) * horiz
     const Y = Math.sin(angle) * horiz
-    const Z = Math.sin(elvRad) * gateDist
+    const Z = height
     return [X, Y, Z]
   }
 
@@ -1,7 +1,30 @@
 export type DataSource = 'L2' | 'L3'
 
+export interface L2Sweep {
+  ElevationNumber: number
+  ElevationAngle: number
+  // RFC 3339
+  Time: string
+  EndTime: string
+  // SAILS/MESO-SAILS supplemental low level sweep
+  Supplemental: boolean
+  VCP: number
+  Products: string[]
+}
+
+// JSON shape returned by /l2/:site/:fn/frames
+export interface L2Frame {
+  Start: string
+  End: string
+  ElevationAngle: number
+  Supplemental: boolean
+  // product -> elevation number
+  Elevations: Record<string, number>
+}
+
 export interface L2Meta {
   ElevationChunks: number[][]
+  Sweeps: L2Sweep[]
 }
 
 export type ViewMode = '2d' | '3d'
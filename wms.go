@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kallsyms/radserv/render"
+)
+
+// A minimal WMS 1.3.0 (and 1.1.1 GetMap) server over L2 data.
+//
+// Layers are SITE_product (e.g. KTLX_ref). The ELEVATION dimension picks the sweep by angle
+// and TIME picks the volume being scanned at that time. GetCapabilities lists every site with
+// TIME as a period over the last day, or with the vendor parameter SITE=KTLX, only that site
+// along with its actual volume times and elevation angles.
+
+var errNoVolume = errors.New("No volume at that time")
+
+var wmsProductTitles = map[string]string{
+	"ref": "Reflectivity",
+	"vel": "Velocity",
+	"sw":  "Spectrum Width",
+	"zdr": "Differential Reflectivity",
+	"rho": "Correlation Coefficient",
+	"phi": "Differential Phase",
+}
+
+var wmsFormats = map[string]string{
+	"image/png":  "png",
+	"image/tiff": "geotiff",
+	// GeoTIFFs are always cloud optimized if asked for in this form
+	"image/tiff; application=geotiff; profile=cloud-optimized": "cog",
+}
+
+// WMS clients request many maps of the same time, so keep listings around briefly
+var wmsListings = newLRUCache[string, []L2FileInfo](1024, time.Minute, nil)
+
+func wmsListFiles(ctx context.Context, site string, day time.Time) ([]L2FileInfo, error) {
+	key := site + day.Format("/20060102")
+	if files, ok := wmsListings.Get(key); ok {
+		return files, nil
+	}
+	files, err := L2Data.ListFiles(ctx, site, day)
+	if err != nil {
+		return nil, err
+	}
+	wmsListings.Put(key, files)
+	return files, nil
+}
+
+// l2FileAt finds the volume of site being scanned at t, i.e. the last one to start at or before t
+func l2FileAt(ctx context.Context, site string, t time.Time) (string, error) {
+	best := ""
+	var bestTime time.Time
+	for _, day := range []time.Time{t, t.AddDate(0, 0, -1)} {
+		files, err := wmsListFiles(ctx, site, day)
+		if err != nil {
+			return "", err
+		}
+		for _, f := range files {
+			if isMDMFile(f.Name) {
+				continue
+			}
+			ft, err := l2FileTime(f.Name)
+			if err != nil || ft.After(t) {
+				continue
+			}
+			if best == "" || ft.After(bestTime) {
+				best = f.Name
+				bestTime = ft
+			}
+		}
+		if best != "" {
+			return best, nil
+		}
+	}
+	return "", errNoVolume
+}
+
+type wmsException struct {
+	Code    string `xml:"code,attr,omitempty"`
+	Message string `xml:",chardata"`
+}
+
+type wmsServiceException struct {
+	XMLName    xml.Name       `xml:"ServiceExceptionReport"`
+	Version    string         `xml:"version,attr"`
+	Xmlns      string         `xml:"xmlns,attr"`
+	Exceptions []wmsException `xml:"ServiceException"`
+}
+
+func wmsError(c *gin.Context, status int, code string, err error) {
+	c.Error(err)
+	c.XML(status, wmsServiceException{
+		Version:    "1.3.0",
+		Xmlns:      "http://www.opengis.net/ogc",
+		Exceptions: []wmsException{{code, err.Error()}},
+	})
+	c.Abort()
+}
+
+// wmsHandler serves /wms
+func wmsHandler(c *gin.Context) {
+	// WMS parameter names are case insensitive
+	params := map[string]string{}
+	for k, v := range c.Request.URL.Query() {
+		if len(v) > 0 {
+			params[strings.ToUpper(k)] = v[0]
+		}
+	}
+
+	if s := params["SERVICE"]; s != "" && !strings.EqualFold(s, "WMS") {
+		wmsError(c, http.StatusBadRequest, "InvalidParameterValue", fmt.Errorf("Unsupported service %q", s))
+		return
+	}
+	switch strings.ToLower(params["REQUEST"]) {
+	case "getcapabilities":
+		wmsGetCapabilities(c, params)
+	case "getmap":
+		wmsGetMap(c, params)
+	default:
+		wmsError(c, http.StatusBadRequest, "OperationNotSupported", fmt.Errorf("Unsupported request %q", params["REQUEST"]))
+	}
+}
+
+type wmsOnlineResource struct {
+	Type string `xml:"xlink:type,attr"`
+	Href string `xml:"xlink:href,attr"`
+}
+
+type wmsOperation struct {
+	Formats        []string          `xml:"Format"`
+	OnlineResource wmsOnlineResource `xml:"DCPType>HTTP>Get>OnlineResource"`
+}
+
+type wmsGeographicBoundingBox struct {
+	West  float64 `xml:"westBoundLongitude"`
+	East  float64 `xml:"eastBoundLongitude"`
+	South float64 `xml:"southBoundLatitude"`
+	North float64 `xml:"northBoundLatitude"`
+}
+
+type wmsBoundingBox struct {
+	CRS  string  `xml:"CRS,attr"`
+	MinX float64 `xml:"minx,attr"`
+	MinY float64 `xml:"miny,attr"`
+	MaxX float64 `xml:"maxx,attr"`
+	MaxY float64 `xml:"maxy,attr"`
+}
+
+type wmsDimension struct {
+	Name         string `xml:"name,attr"`
+	Units        string `xml:"units,attr"`
+	Default      string `xml:"default,attr,omitempty"`
+	NearestValue int    `xml:"nearestValue,attr"`
+	Values       string `xml:",chardata"`
+}
+
+type wmsLayer struct {
+	Queryable  int                       `xml:"queryable,attr"`
+	Opaque     int                       `xml:"opaque,attr"`
+	Name       string                    `xml:"Name,omitempty"`
+	Title      string                    `xml:"Title"`
+	CRS        []string                  `xml:"CRS,omitempty"`
+	GeoBBox    *wmsGeographicBoundingBox `xml:"EX_GeographicBoundingBox,omitempty"`
+	BBoxes     []wmsBoundingBox          `xml:"BoundingBox,omitempty"`
+	Dimensions []wmsDimension            `xml:"Dimension,omitempty"`
+	Layers     []wmsLayer                `xml:"Layer,omitempty"`
+}
+
+type wmsCapabilities struct {
+	XMLName    xml.Name `xml:"WMS_Capabilities"`
+	Version    string   `xml:"version,attr"`
+	Xmlns      string   `xml:"xmlns,attr"`
+	XmlnsXlink string   `xml:"xmlns:xlink,attr"`
+	Service    struct {
+		Name           string            `xml:"Name"`
+		Title          string            `xml:"Title"`
+		OnlineResource wmsOnlineResource `xml:"OnlineResource"`
+	} `xml:"Service"`
+	Capability struct {
+		GetCapabilities wmsOperation `xml:"Request>GetCapabilities"`
+		GetMap          wmsOperation `xml:"Request>GetMap"`
+		Exceptions      []string     `xml:"Exception>Format"`
+		Layer           wmsLayer     `xml:"Layer"`
+	} `xml:"Capability"`
+}
+
+// How far back TIME goes when the actual volume times aren't listed, matching how far back
+// l2FileAt looks, and the step advertised within that window
+const (
+	wmsTimeWindow = 24 * time.Hour
+	wmsTimeStep   = 5 * time.Minute
+)
+
+// wmsTimePeriod returns the TIME dimension values covering the window before now as a
+// start/end/period extent. Any time within it is served by the volume being scanned then.
+func wmsTimePeriod(now time.Time) string {
+	end := now.UTC().Truncate(wmsTimeStep)
+	start := end.Add(-wmsTimeWindow)
+	return fmt.Sprintf("%s/%s/PT%dM", start.Format(time.RFC3339), end.Format(time.RFC3339), int(wmsTimeStep.Minutes()))
+}
+
+// wmsSiteLayer describes the layers of one site. If volumes is given, they're the
+// available values of the TIME dimension and the latest of them gives the elevation angles.
+// Otherwise TIME is a period over the recent past.
+func wmsSiteLayer(ctx context.Context, site Site, volumes []string) wmsLayer {
+	b := (&render.RadialSet{Lat: site.Lat, Lon: site.Lon, Radius: 460 * 1000}).LatLonBounds()
+	geo := &wmsGeographicBoundingBox{West: b[0], East: b[2], South: b[1], North: b[3]}
+	layer := wmsLayer{
+		Title:   fmt.Sprintf("%s (%s)", site.ID, site.Name),
+		GeoBBox: geo,
+		BBoxes:  []wmsBoundingBox{{CRS: "CRS:84", MinX: b[0], MinY: b[1], MaxX: b[2], MaxY: b[3]}},
+	}
+
+	// Angles differ between VCPs, so without a volume to look at just allow anything
+	elevation := wmsDimension{Name: "elevation", Units: "degrees", Default: "0.5", NearestValue: 1, Values: "0/20/0.1"}
+	timeDim := wmsDimension{Name: "time", Units: "ISO8601", Default: "current", NearestValue: 1, Values: wmsTimePeriod(time.Now())}
+	if len(volumes) > 0 {
+		times := make([]string, 0, len(volumes))
+		for _, v := range volumes {
+			if t, err := l2FileTime(v); err == nil {
+				times = append(times, t.Format(time.RFC3339))
+			}
+		}
+		if len(times) > 0 {
+			timeDim.Values = strings.Join(times, ",")
+		}
+
+		if meta, _, err := ChunkCache.GetMeta(ctx, volumes[len(volumes)-1]); err == nil {
+			angles := []string{}
+			seen := map[string]bool{}
+			for _, s := range meta.Sweeps {
+				a := strconv.FormatFloat(math.Round(s.ElevationAngle*10)/10, 'f', 1, 64)
+				if !seen[a] {
+					seen[a] = true
+					angles = append(angles, a)
+				}
+			}
+			if len(angles) > 0 {
+				elevation.Default = angles[0]
+				elevation.Values = strings.Join(angles, ",")
+			}
+		}
+	}
+
+	// bounding boxes and dimensions are inherited by the product layers
+	layer.Dimensions = []wmsDimension{elevation, timeDim}
+	for _, product := range render.Level2Products {
+		layer.Layers = append(layer.Layers, wmsLayer{
+			Name:  site.ID + "_" + product,
+			Title: site.ID + " " + wmsProductTitles[product],
+		})
+	}
+	return layer
+}
+
+func wmsGetCapabilities(c *gin.Context, params map[string]string) {
+	ctx := c.Request.Context()
+
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	url := scheme + "://" + c.Request.Host + c.Request.URL.Path
+
+	caps := wmsCapabilities{
+		Version:    "1.3.0",
+		Xmlns:      "http://www.opengis.net/wms",
+		XmlnsXlink: "http://www.w3.org/1999/xlink",
+	}
+	caps.Service.Name = "WMS"
+	caps.Service.Title = "radserv"
+	caps.Service.OnlineResource = wmsOnlineResource{Type: "simple", Href: url}
+	caps.Capability.GetCapabilities = wmsOperation{
+		Formats:        []string{"text/xml"},
+		OnlineResource: wmsOnlineResource{Type: "simple", Href: url + "?"},
+	}
+	formats := make([]string, 0, len(wmsFormats))
+	for f := range wmsFormats {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	caps.Capability.GetMap = wmsOperation{
+		Formats:        formats,
+		OnlineResource: wmsOnlineResource{Type: "simple", Href: url + "?"},
+	}
+	caps.Capability.Exceptions = []string{"XML"}
+	caps.Capability.Layer = wmsLayer{
+		Title: "NEXRAD Level 2",
+		CRS:   []string{"CRS:84", "EPSG:4326", "EPSG:3857"},
+		GeoBBox: &wmsGeographicBoundingBox{
+			West: -180, East: 180, South: -90, North: 90,
+		},
+	}
+
+	if id := strings.ToUpper(params["SITE"]); id != "" {
+		site, ok := Sites[id]
+		if !ok {
+			wmsError(c, http.StatusNotFound, "InvalidParameterValue", fmt.Errorf("Unknown site %q", id))
+			return
+		}
+		now := time.Now().UTC()
+		volumes := []string{}
+		for _, day := range []time.Time{now.AddDate(0, 0, -1), now} {
+			files, err := wmsListFiles(ctx, id, day)
+			if err != nil {
+				wmsError(c, http.StatusInternalServerError, "", err)
+				return
+			}
+			for _, f := range files {
+				if !isMDMFile(f.Name) {
+					volumes = append(volumes, f.Name)
+				}
+			}
+		}
+		sort.Strings(volumes)
+		caps.Capability.Layer.Layers = []wmsLayer{wmsSiteLayer(ctx, site, volumes)}
+	} else {
+		ids := make([]string, 0, len(Sites))
+		for id := range Sites {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			caps.Capability.Layer.Layers = append(caps.Capability.Layer.Layers, wmsSiteLayer(ctx, Sites[id], nil))
+		}
+	}
+
+	out, err := xml.MarshalIndent(caps, "", "  ")
+	if err != nil {
+		wmsError(c, http.StatusInternalServerError, "", err)
+		return
+	}
+	c.Data(http.StatusOK, "text/xml; charset=utf-8", append([]byte(xml.Header), out...))
+}
+
+func wmsGetMap(c *gin.Context, params map[string]string) {
+	ctx := c.Request.Context()
+
+	layer := params["LAYERS"]
+	if layer == "" || strings.Contains(layer, ",") {
+		wmsError(c, http.StatusBadRequest, "LayerNotDefined", errors.New("Exactly one layer must be requested"))
+		return
+	}
+	site, product, ok := strings.Cut(layer, "_")
+	product = render.CanonicalProduct(strings.ToLower(product))
+	if !ok || !validSite(site) || wmsProductTitles[product] == "" {
+		wmsError(c, http.StatusBadRequest, "LayerNotDefined", fmt.Errorf("Unknown layer %q", layer))
+		return
+	}
+
+	format, ok := wmsFormats[strings.ToLower(params["FORMAT"])]
+	if !ok {
+		wmsError(c, http.StatusBadRequest, "InvalidFormat", fmt.Errorf("Unsupported format %q", params["FORMAT"]))
+		return
+	}
+
+	// 1.3.0 uses CRS and the CRS's official axis order, 1.1.1 uses SRS and always x,y
+	srs := strings.ToUpper(params["CRS"])
+	if params["VERSION"] == "1.1.1" || srs == "" {
+		srs = strings.ToUpper(params["SRS"])
+	}
+	swapAxes := false
+	if srs == "CRS:84" {
+		srs = "EPSG:4326"
+	} else if params["VERSION"] != "1.1.1" && srsRe.MatchString(srs) {
+		swapAxes = render.LatLonOrder(srs)
+	}
+	if !srsRe.MatchString(srs) {
+		wmsError(c, http.StatusBadRequest, "InvalidCRS", fmt.Errorf("Unsupported CRS %q", srs))
+		return
+	}
+
+	bbox, err := parseBBox(params["BBOX"])
+	if err != nil {
+		wmsError(c, http.StatusBadRequest, "InvalidParameterValue", err)
+		return
+	}
+	if swapAxes {
+		bbox = [4]float64{bbox[1], bbox[0], bbox[3], bbox[2]}
+	}
+	width, err := strconv.Atoi(params["WIDTH"])
+	if err != nil || width < 1 {
+		wmsError(c, http.StatusBadRequest, "InvalidParameterValue", errors.New("Invalid WIDTH"))
+		return
+	}
+	height, err := strconv.Atoi(params["HEIGHT"])
+	if err != nil || height < 1 {
+		wmsError(c, http.StatusBadRequest, "InvalidParameterValue", errors.New("Invalid HEIGHT"))
+		return
+	}
+
+	angle := 0.5
+	if e := params["ELEVATION"]; e != "" {
+		angle, err = strconv.ParseFloat(e, 64)
+		if err != nil {
+			wmsError(c, http.StatusBadRequest, "InvalidDimensionValue", errors.New("Invalid ELEVATION"))
+			return
+		}
+	}
+	at := time.Now().UTC()
+	if t := params["TIME"]; t != "" && !strings.EqualFold(t, "current") {
+		at, err = time.Parse(time.RFC3339, t)
+		if err != nil {
+			wmsError(c, http.StatusBadRequest, "InvalidDimensionValue", errors.New("Invalid TIME, expected ISO8601"))
+			return
+		}
+	}
+
+	fn, err := l2FileAt(ctx, site, at)
+	if errors.Is(err, errNoVolume) {
+		wmsError(c, http.StatusNotFound, "InvalidDimensionValue", err)
+		return
+	} else if err != nil {
+		wmsError(c, http.StatusInternalServerError, "", err)
+		return
+	}
+
+	elvs, err := resolveSweeps(ctx, fn, product, sweepSelector{Angle: angle, Which: "latest"})
+	if errors.Is(err, errNoSweep) {
+		wmsError(c, http.StatusNotFound, "InvalidDimensionValue", err)
+		return
+	} else if err != nil {
+		wmsError(c, http.StatusInternalServerError, "", err)
+		return
+	}
+	rs, err := l2RadialSet(ctx, site, fn, product, elvs[0], l2RadialOptions{})
+	if err != nil {
+		wmsError(c, http.StatusInternalServerError, "", err)
+		return
+	}
+
+	target, err := buildTarget(rs, srs, &bbox, width, height)
+	if err != nil {
+		wmsError(c, http.StatusBadRequest, "InvalidParameterValue", err)
+		return
+	}
+	out, contentType, err := renderRadialSet(ctx, rs, render.DefaultLUT(product), target, format, render.Nearest)
+	if err != nil {
+		if ctx.Err() == nil {
+			wmsError(c, http.StatusInternalServerError, "", err)
+		}
+		return
+	}
+	data, _ := ioutil.ReadAll(out)
+	out.Close()
+
+	c.Header("Cache-Control", "public, max-age=60")
+	c.Data(http.StatusOK, contentType, data)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWMSTimePeriod(t *testing.T) {
+	tests := []struct {
+		now  time.Time
+		want string
+	}{
+		{time.Date(2024, 5, 20, 23, 12, 41, 0, time.UTC), "2024-05-19T23:10:00Z/2024-05-20T23:10:00Z/PT5M"},
+		{time.Date(2024, 5, 20, 0, 0, 0, 0, time.UTC), "2024-05-19T00:00:00Z/2024-05-20T00:00:00Z/PT5M"},
+		{time.Date(2024, 5, 20, 18, 4, 0, 0, time.FixedZone("CDT", -5*3600)), "2024-05-19T23:00:00Z/2024-05-20T23:00:00Z/PT5M"},
+	}
+	for _, tt := range tests {
+		if got := wmsTimePeriod(tt.now); got != tt.want {
+			t.Errorf("wmsTimePeriod(%v) = %q, want %q", tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestWMSSiteLayerHasTimeWithoutSite(t *testing.T) {
+	// as listed by a plain GetCapabilities, without SITE=
+	layer := wmsSiteLayer(context.Background(), Site{ID: "KTLX", Name: "Oklahoma City", Lat: 35.333, Lon: -97.278}, nil)
+	for _, d := range layer.Dimensions {
+		if d.Name != "time" {
+			continue
+		}
+		if d.Default != "current" || !strings.HasSuffix(d.Values, "/PT5M") {
+			t.Errorf("time dimension = %+v, want a period defaulting to current", d)
+		}
+		return
+	}
+	t.Errorf("no time dimension in %+v", layer.Dimensions)
+}